@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/stahir80td/incident-management/services"
+)
+
+// Replay is the serverless function handler for re-enriching an existing
+// PagerDuty incident; vercel.json passes the ID as ?incident_id=
+func Replay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, ok := services.ConfigForRequest(w)
+	if !ok {
+		return
+	}
+	if !services.AuthorizeOperator(w, r, cfg.TriageAPITokens) {
+		return
+	}
+
+	incidentID := r.URL.Query().Get("incident_id")
+	if incidentID == "" {
+		http.Error(w, "incident ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// ?tenant= picks the PagerDuty account the incident lives in
+	tenant, ok := cfg.Tenant(r.URL.Query().Get("tenant"))
+	if !ok {
+		http.Error(w, "unknown tenant", http.StatusBadRequest)
+		return
+	}
+	logger := services.TenantLogger(tenant.ID())
+
+	ragService, err := services.NewRAGService(cfg.RAGOptions().WithContext(r.Context()))
+	if err != nil {
+		logger.Printf("❌ [ERROR] Failed to create RAG service: %v", err)
+		http.Error(w, "Failed to replay incident", http.StatusInternalServerError)
+		return
+	}
+	defer ragService.Close()
+
+	// Run inline so the caller learns whether the revised note was posted
+	logger.Printf("🔁 [REPLAY] Re-enriching incident: %s", incidentID)
+	if _, err := ragService.ReplayIncident(tenant.ID(), incidentID); err != nil {
+		logger.Printf("❌ [ERROR] Failed to replay incident %s: %v", incidentID, err)
+		http.Error(w, "Failed to replay incident", http.StatusBadGateway)
+		return
+	}
+	logger.Printf("🎉 [COMPLETE] Posted revised enrichment for incident: %s", incidentID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "replayed",
+		"incident_id": incidentID,
+	})
+}
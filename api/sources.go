@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/stahir80td/incident-management/services"
+)
+
+// Sources is the serverless function handler for every alert source in
+// services.SourceRoutes; vercel.json passes the source name as ?source=
+func Sources(w http.ResponseWriter, r *http.Request) {
+	route, ok := services.LookupSourceRoute(r.URL.Query().Get("source"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	cfg, ok := services.ConfigForRequest(w)
+	if !ok {
+		return
+	}
+
+	event, ok := services.ReadSourceEvent(w, r, route.NewSource(cfg))
+	if !ok {
+		return
+	}
+	logger := services.TenantLogger(event.Incident.Tenant)
+	logger.Printf("Received %s %s: %s - %s", route.Name, event.Type, event.Incident.ID, event.Incident.Title)
+
+	// Alert sources share the default tenant's rate limit
+	if !services.SharedTenantLimiters(cfg).Admit(w, event) {
+		return
+	}
+
+	// Dry runs preview the note and skip dedup
+	if event.DryRun {
+		if !services.AuthorizeDryRun(w, r, cfg.TriageAPITokens) {
+			return
+		}
+		previewSourceEvent(r.Context(), w, cfg, event)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	store := services.SharedDedupStore(cfg.Dedup)
+	if !services.ClaimEvent(store, event) {
+		logger.Printf("Ignoring duplicate %s delivery of event: %s", route.Name, event.ID)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "duplicate",
+			"reason": "event already received",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "accepted",
+		"event_type":  event.Type,
+		"incident_id": event.Incident.ID,
+	})
+
+	// Process synchronously (Vercel has timeout limits for background processing).
+	// WithoutCancel drops the request's cancellation and deadline, so the work
+	// carries on when the sender hangs up after the 202; the function's
+	// maxDuration is what stops it.
+	if err := processSourceEvent(context.WithoutCancel(r.Context()), cfg, route, event, store); err != nil {
+		logger.Printf("❌ [ERROR] Failed to handle %s %s for %s: %v", route.Name, event.Type, event.Incident.ID, err)
+		return
+	}
+	logger.Printf("🎉 [COMPLETE] Handled %s %s for: %s", route.Name, event.Type, event.Incident.ID)
+}
+
+func processSourceEvent(ctx context.Context, cfg *services.Config, route services.SourceRoute, event services.Event, store services.DedupStore) error {
+	sink, err := route.NewSink(cfg)
+	if err != nil {
+		return err
+	}
+
+	ragService, err := services.NewRAGService(cfg.RAGOptions().WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer ragService.Close()
+
+	router := services.NewAlertEventRouter(func(incident services.IncidentData) error {
+		_, err := ragService.EnrichIncidentTo(incident, sink)
+		return err
+	}, func(incident services.IncidentData) error {
+		_, err := ragService.DraftPostmortemTo(incident, sink)
+		return err
+	}, store)
+
+	return router.Dispatch(event)
+}
+
+// previewSourceEvent answers a dry run with the enrichment instead of posting it
+func previewSourceEvent(ctx context.Context, w http.ResponseWriter, cfg *services.Config, event services.Event) {
+	ragService, err := services.NewRAGService(cfg.RAGOptions().WithContext(ctx))
+	if err != nil {
+		services.TenantLogger(event.Incident.Tenant).Printf("❌ [ERROR] Failed to create RAG service: %v", err)
+		http.Error(w, "Failed to preview enrichment", http.StatusInternalServerError)
+		return
+	}
+	defer ragService.Close()
+
+	services.ServeDryRun(w, ragService, event)
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/stahir80td/incident-management/services"
+)
+
+// Triage is the serverless function handler for previewing an enrichment:
+// it runs the pipeline for the posted incident and returns the result
+// without posting a note anywhere
+func Triage(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := services.ConfigForRequest(w)
+	if !ok {
+		return
+	}
+
+	incident, ok := services.ReadTriageRequest(w, r, cfg.TriageAPITokens)
+	if !ok {
+		return
+	}
+
+	ragService, err := services.NewRAGService(cfg.RAGOptions().WithContext(r.Context()))
+	if err != nil {
+		log.Printf("❌ [ERROR] Failed to create RAG service: %v", err)
+		http.Error(w, "Failed to preview enrichment", http.StatusInternalServerError)
+		return
+	}
+	defer ragService.Close()
+
+	services.ServeDryRun(w, ragService, services.Event{Type: services.EventIncidentTriggered, Incident: incident})
+}
@@ -1,56 +1,13 @@
 package handler
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
-	"os"
-	"strings"
 
-	genai "github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
+	"github.com/stahir80td/incident-management/services"
 )
 
-// PagerDuty webhook payload structures
-type WebhookPayload struct {
-	Event WebhookEvent `json:"event"`
-}
-
-type WebhookEvent struct {
-	ID           string       `json:"id"`
-	EventType    string       `json:"event_type"`
-	ResourceType string       `json:"resource_type"`
-	OccurredAt   string       `json:"occurred_at"`
-	Data         IncidentData `json:"data"`
-}
-
-type IncidentData struct {
-	ID          string         `json:"id"`
-	Type        string         `json:"type"`
-	Title       string         `json:"title"`
-	Description string         `json:"description"`
-	Service     ServiceSummary `json:"service"`
-	Urgency     string         `json:"urgency"`
-	Status      string         `json:"status"`
-}
-
-type ServiceSummary struct {
-	Summary string `json:"summary"`
-}
-
-type SearchResult struct {
-	IncidentID string  `json:"incident_id"`
-	Section    string  `json:"section"`
-	Service    string  `json:"service"`
-	Severity   string  `json:"severity"`
-	Date       string  `json:"date"`
-	Text       string  `json:"text"`
-	Score      float32 `json:"score"`
-}
-
 // Webhook is the serverless function handler for Vercel
 func Webhook(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers
@@ -64,363 +21,107 @@ func Webhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Only accept POST
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	cfg, ok := services.ConfigForRequest(w)
+	if !ok {
+		return
+	}
+
+	// vercel.json passes /api/webhook/<tenant> as ?tenant=; deliveries to
+	// /api/webhook are matched by subscription ID
+	tenant, ok := cfg.ResolveTenant(r, r.URL.Query().Get("tenant"))
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
+	logger := services.TenantLogger(tenant.ID())
 
-	// Parse webhook payload
-	var payload WebhookPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		log.Printf("Failed to decode payload: %v", err)
-		http.Error(w, "Invalid payload", http.StatusBadRequest)
+	// Read, verify the tenant's PagerDuty signature and parse
+	event, ok := services.ReadSourceEvent(w, r, services.NewPagerDutySource(tenant))
+	if !ok {
 		return
 	}
 
 	// Log the event
-	log.Printf("Received webhook: %s - %s", payload.Event.EventType, payload.Event.Data.ID)
+	logger.Printf("Received webhook: %s - %s", event.Type, event.Incident.ID)
 
-	// Only process incident.triggered events
-	if payload.Event.EventType != "incident.triggered" {
-		log.Printf("Ignoring event type: %s", payload.Event.EventType)
+	// Only process incident lifecycle events
+	if !services.IsLifecycleEvent(event.Type) {
+		logger.Printf("Ignoring event type: %s", event.Type)
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status": "ignored",
-			"reason": "not an incident.triggered event",
+			"reason": "unsupported event type",
 		})
 		return
 	}
 
-	// Return 202 immediately
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":      "accepted",
-		"incident_id": payload.Event.Data.ID,
-	})
-
-	// Process synchronously (Vercel has timeout limits for background processing)
-	processIncident(payload.Event.Data)
-}
-
-func processIncident(data IncidentData) {
-	log.Printf("🔄 [START] Processing incident: %s - %s", data.ID, data.Title)
-
-	ctx := context.Background()
-
-	// Validate environment variables
-	log.Printf("📋 [CONFIG] Checking environment variables...")
-	geminiKey := os.Getenv("GEMINI_API_KEY")
-	qdrantURL := os.Getenv("QDRANT_URL")
-	qdrantKey := os.Getenv("QDRANT_API_KEY")
-	pdToken := os.Getenv("PAGERDUTY_API_TOKEN")
-	pdEmail := os.Getenv("PAGERDUTY_EMAIL")
-	collectionName := os.Getenv("COLLECTION_NAME")
-	embeddingModel := os.Getenv("EMBEDDING_MODEL")
-
-	if geminiKey == "" {
-		log.Println("❌ [ERROR] GEMINI_API_KEY is required")
-		return
-	}
-	if qdrantURL == "" {
-		log.Println("❌ [ERROR] QDRANT_URL is required")
-		return
-	}
-	if qdrantKey == "" {
-		log.Println("❌ [ERROR] QDRANT_API_KEY is required")
-		return
-	}
-	if pdToken == "" {
-		log.Println("❌ [ERROR] PAGERDUTY_API_TOKEN is required")
-		return
-	}
-	if pdEmail == "" {
-		log.Println("❌ [ERROR] PAGERDUTY_EMAIL is required")
+	if !services.SharedTenantLimiters(cfg).Admit(w, event) {
 		return
 	}
-	if collectionName == "" {
-		collectionName = "incident-knowledge-base"
-	}
-	if embeddingModel == "" {
-		embeddingModel = "models/gemini-embedding-001"
-	}
-
-	log.Printf("✅ [CONFIG] All environment variables present")
-	log.Printf("📊 [CONFIG] Qdrant URL: %s", qdrantURL)
-	log.Printf("📊 [CONFIG] Collection: %s", collectionName)
-	log.Printf("📊 [CONFIG] Embedding Model: %s", embeddingModel)
-
-	// Initialize Gemini client
-	log.Printf("🤖 [GEMINI] Initializing client...")
-	client, err := genai.NewClient(ctx, option.WithAPIKey(geminiKey))
-	if err != nil {
-		log.Printf("❌ [GEMINI] Failed to create client: %v", err)
-		return
-	}
-	defer client.Close()
-	log.Printf("✅ [GEMINI] Client initialized")
-
-	// Step 1: Generate embedding
-	searchQuery := fmt.Sprintf("%s %s", data.Title, data.Description)
-	log.Printf("🔍 [EMBEDDING] Generating embedding for query: %s", searchQuery[:min(100, len(searchQuery))])
-	embedding, err := generateEmbedding(ctx, client, searchQuery, embeddingModel)
-	if err != nil {
-		log.Printf("❌ [EMBEDDING] Failed: %v", err)
-		return
-	}
-	log.Printf("✅ [EMBEDDING] Generated embedding with %d dimensions", len(embedding))
-
-	// Step 2: Search Qdrant
-	log.Printf("🔎 [QDRANT] Searching for similar incidents...")
-	results, err := searchQdrant(qdrantURL, qdrantKey, collectionName, embedding, 3)
-	if err != nil {
-		log.Printf("❌ [QDRANT] Search failed: %v", err)
-		return
-	}
-	log.Printf("✅ [QDRANT] Found %d similar incidents", len(results))
 
-	if len(results) == 0 {
-		log.Printf("⚠️  [QDRANT] No similar incidents found, posting generic note")
-		note := "================================\n       AI ENRICHMENT\n================================\n\nNo similar past incidents found in the knowledge base."
-		err := postNoteToPagerDuty(data.ID, note, pdToken, pdEmail)
-		if err != nil {
-			log.Printf("❌ [PAGERDUTY] Failed to post note: %v", err)
-		} else {
-			log.Printf("✅ [COMPLETE] Generic note posted successfully")
+	// Dry runs preview the note and skip dedup
+	if event.DryRun {
+		if !services.AuthorizeDryRun(w, r, cfg.TriageAPITokens) {
+			return
 		}
+		previewEvent(r.Context(), w, cfg, event)
 		return
 	}
 
-	// Log search results
-	for i, result := range results {
-		log.Printf("   [%d] %s - %.1f%% match (%s section)", i+1, result.IncidentID, result.Score*100, result.Section)
-	}
-
-	// Step 3: Generate AI context
-	log.Printf("🤖 [GEMINI] Generating AI context from similar incidents...")
-	prompt := buildPrompt(data, results)
-	aiContext, err := generateContext(ctx, client, prompt)
-	if err != nil {
-		log.Printf("❌ [GEMINI] Failed to generate context: %v", err)
-		return
-	}
-	log.Printf("✅ [GEMINI] Generated context (%d chars)", len(aiContext))
-
-	// Step 4: Format and post note
-	log.Printf("📝 [PAGERDUTY] Formatting and posting enrichment note...")
-	note := formatNote(aiContext, results)
-	err = postNoteToPagerDuty(data.ID, note, pdToken, pdEmail)
-	if err != nil {
-		log.Printf("❌ [PAGERDUTY] Failed to post note: %v", err)
+	// Drop PagerDuty's retried deliveries of an event we already accepted
+	if !services.ClaimEvent(services.SharedDedupStore(cfg.Dedup), event) {
+		logger.Printf("Ignoring duplicate delivery of event: %s", event.ID)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "duplicate",
+			"reason": "event already received",
+		})
 		return
 	}
 
-	log.Printf("🎉 [COMPLETE] Successfully enriched incident: %s", data.ID)
-}
-
-func generateEmbedding(ctx context.Context, client *genai.Client, text string, modelName string) ([]float32, error) {
-	log.Printf("🔧 [EMBEDDING] Using model: %s", modelName)
-	em := client.EmbeddingModel(modelName)
-	res, err := em.EmbedContent(ctx, genai.Text(text))
-	if err != nil {
-		return nil, fmt.Errorf("embedding generation failed: %w", err)
-	}
-	return res.Embedding.Values, nil
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
-func searchQdrant(url, apiKey, collection string, embedding []float32, limit int) ([]SearchResult, error) {
-	searchURL := fmt.Sprintf("%s/collections/%s/points/search", url, collection)
-	log.Printf("🔎 [QDRANT] Request URL: %s", searchURL)
-	log.Printf("🔎 [QDRANT] Embedding dimensions: %d", len(embedding))
-
-	payload := map[string]interface{}{
-		"vector":       embedding,
-		"limit":        limit,
-		"with_payload": true,
-	}
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-
-	req, err := http.NewRequest("POST", searchURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("api-key", apiKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		log.Printf("❌ [QDRANT] Error status: %d", resp.StatusCode)
-		return nil, fmt.Errorf("qdrant returned status %d", resp.StatusCode)
-	}
-
-	log.Printf("✅ [QDRANT] Response received with status 200")
-
-	var searchResp struct {
-		Result []struct {
-			Score   float32                `json:"score"`
-			Payload map[string]interface{} `json:"payload"`
-		} `json:"result"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
-		return nil, err
-	}
-
-	results := make([]SearchResult, 0, len(searchResp.Result))
-	for _, point := range searchResp.Result {
-		result := SearchResult{Score: point.Score}
-		if val, ok := point.Payload["incident_id"].(string); ok {
-			result.IncidentID = val
-		}
-		if val, ok := point.Payload["section"].(string); ok {
-			result.Section = val
-		}
-		if val, ok := point.Payload["service"].(string); ok {
-			result.Service = val
-		}
-		if val, ok := point.Payload["severity"].(string); ok {
-			result.Severity = val
-		}
-		if val, ok := point.Payload["date"].(string); ok {
-			result.Date = val
-		}
-		if val, ok := point.Payload["text"].(string); ok {
-			result.Text = val
-		}
-		results = append(results, result)
-	}
+	// Return 202 immediately
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "accepted",
+		"event_type":  event.Type,
+		"incident_id": event.Incident.ID,
+	})
 
-	return results, nil
+	// Process synchronously (Vercel has timeout limits for background processing).
+	// WithoutCancel drops the request's cancellation and deadline, so the work
+	// carries on when PagerDuty hangs up after the 202; the function's
+	// maxDuration is what stops it.
+	processEvent(context.WithoutCancel(r.Context()), cfg, event)
 }
 
-func generateContext(ctx context.Context, client *genai.Client, prompt string) (string, error) {
-	generativeModel := os.Getenv("GENERATIVE_MODEL")
-	if generativeModel == "" {
-		generativeModel = "gemini-2.0-flash-exp"
-	}
-
-	log.Printf("🤖 [GEMINI] Using generative model: %s", generativeModel)
-	model := client.GenerativeModel(generativeModel)
-	model.SetTemperature(0.7)
-	model.SetMaxOutputTokens(800)
+func processEvent(ctx context.Context, cfg *services.Config, event services.Event) {
+	logger := services.TenantLogger(event.Incident.Tenant)
 
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	ragService, err := services.NewRAGService(cfg.RAGOptions().WithContext(ctx))
 	if err != nil {
-		return "", err
-	}
-
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return "", fmt.Errorf("no response from Gemini")
-	}
-
-	return fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0]), nil
-}
-
-func buildPrompt(incident IncidentData, results []SearchResult) string {
-	var sb strings.Builder
-
-	sb.WriteString("You are an expert SRE assistant helping with incident triage.\n\n")
-	sb.WriteString("NEW ALERT:\n")
-	sb.WriteString(fmt.Sprintf("Title: %s\n", incident.Title))
-	sb.WriteString(fmt.Sprintf("Description: %s\n", incident.Description))
-	sb.WriteString(fmt.Sprintf("Service: %s\n", incident.Service.Summary))
-	sb.WriteString(fmt.Sprintf("Urgency: %s\n\n", incident.Urgency))
-
-	sb.WriteString("SIMILAR PAST INCIDENTS:\n\n")
-	for idx, result := range results {
-		sb.WriteString(fmt.Sprintf("%d. %s (%s section, %.0f%% match)\n", idx+1, result.IncidentID, result.Section, result.Score*100))
-		sb.WriteString(fmt.Sprintf("   Service: %s | Severity: %s | Date: %s\n", result.Service, result.Severity, result.Date))
-
-		text := result.Text
-		if len(text) > 300 {
-			text = text[:300] + "..."
-		}
-		sb.WriteString(fmt.Sprintf("   Content: %s\n\n", text))
+		logger.Printf("❌ [ERROR] Failed to create RAG service: %v", err)
+		return
 	}
+	defer ragService.Close()
 
-	sb.WriteString("TASK:\n")
-	sb.WriteString("Generate a concise triage note (max 400 words) with:\n")
-	sb.WriteString("1. Likely Root Cause (based on similar incidents)\n")
-	sb.WriteString("2. Recommended Resolution Steps (specific and actionable)\n")
-	sb.WriteString("3. Related Incident IDs for reference\n\n")
-	sb.WriteString("Format the response in clear, professional sections using proper headers.\n")
-	sb.WriteString("Use plain text formatting - no bold, italics, or markdown styling.\n")
-	sb.WriteString("Be concise and action-oriented. Focus on what the on-call engineer should do NOW.\n")
-
-	return sb.String()
-}
-
-func formatNote(aiContext string, results []SearchResult) string {
-	var sb strings.Builder
-
-	sb.WriteString("================================\n")
-	sb.WriteString("       AI ENRICHMENT\n")
-	sb.WriteString("================================\n\n")
-	sb.WriteString(aiContext)
-	sb.WriteString("\n\n")
-	sb.WriteString("--------------------------------\n")
-	sb.WriteString("SIMILARITY SCORES\n")
-	sb.WriteString("--------------------------------\n")
-	for idx, result := range results {
-		sb.WriteString(fmt.Sprintf("  [%d] %s: %.1f%% match (%s)\n", idx+1, result.IncidentID, result.Score*100, result.Section))
+	// Same routing and pipeline as the local server, run inline
+	router := services.NewDefaultEventRouter(ragService, services.SharedDedupStore(cfg.Dedup))
+	if err := router.Dispatch(event); err != nil {
+		logger.Printf("❌ [ERROR] Failed to handle %s for incident %s: %v", event.Type, event.Incident.ID, err)
+		return
 	}
-	sb.WriteString("\n")
-
-	return sb.String()
+	logger.Printf("✅ [COMPLETE] Handled %s for incident: %s", event.Type, event.Incident.ID)
 }
 
-func postNoteToPagerDuty(incidentID, note, token, email string) error {
-	url := fmt.Sprintf("https://api.pagerduty.com/incidents/%s/notes", incidentID)
-
-	payload := map[string]interface{}{
-		"note": map[string]string{
-			"content": note,
-		},
-	}
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
-	req.Header.Set("Authorization", "Token token="+token)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("From", email)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// previewEvent answers a dry run with the enrichment instead of posting it
+func previewEvent(ctx context.Context, w http.ResponseWriter, cfg *services.Config, event services.Event) {
+	ragService, err := services.NewRAGService(cfg.RAGOptions().WithContext(ctx))
 	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("PagerDuty API returned status %d", resp.StatusCode)
+		services.TenantLogger(event.Incident.Tenant).Printf("❌ [ERROR] Failed to create RAG service: %v", err)
+		http.Error(w, "Failed to preview enrichment", http.StatusInternalServerError)
+		return
 	}
+	defer ragService.Close()
 
-	return nil
+	services.ServeDryRun(w, ragService, event)
 }
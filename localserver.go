@@ -1,42 +1,49 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/stahir80td/incident-management/services"
 )
 
-// Webhook payload structures
-type WebhookPayload struct {
-	Event WebhookEvent `json:"event"`
-}
+var (
+	// config is loaded and validated once at startup
+	config *services.Config
 
-type WebhookEvent struct {
-	ID           string       `json:"id"`
-	EventType    string       `json:"event_type"`
-	ResourceType string       `json:"resource_type"`
-	OccurredAt   string       `json:"occurred_at"`
-	Data         IncidentData `json:"data"`
-}
+	// dedupStore remembers handled events and enriched incidents across requests
+	dedupStore services.DedupStore
 
-type IncidentData struct {
-	ID          string         `json:"id"`
-	Type        string         `json:"type"`
-	Title       string         `json:"title"`
-	Description string         `json:"description"`
-	Service     ServiceSummary `json:"service"`
-	Urgency     string         `json:"urgency"`
-	Status      string         `json:"status"`
-}
+	// jobQueue holds AI jobs on disk until they succeed or dead-letter
+	jobQueue *services.JobQueue
 
-type ServiceSummary struct {
-	Summary string `json:"summary"`
-}
+	// ragService is shared by every worker so Gemini/Qdrant clients are long-lived
+	ragService *services.RAGService
+
+	// eventRouter dispatches PagerDuty events; AI work is handed to jobQueue
+	eventRouter *services.EventRouter
+
+	// noteSinks maps a job's sink name to where its note is posted; jobs
+	// without a sink name go to their tenant's PagerDuty account. Alert
+	// sources use their route name.
+	noteSinks map[string]services.NoteSink
+
+	// tenantLimiters applies each tenant's event rate limit
+	tenantLimiters *services.TenantLimiters
+)
+
+// pagerDutySink is the sink name for notes on PagerDuty incidents
+const pagerDutySink = "pagerduty"
 
 // Health check handler
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -47,111 +54,421 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		"status":    "healthy",
 		"timestamp": time.Now().UTC(),
 		"service":   "incident-triage-rag-api",
+		"queue":     jobQueue.Stats(),
+		"tenants":   tenantLimiters.Stats(),
+		"usage":     ragService.Usage().Stats(),
+	}
+	if stats := ragService.EmbeddingCacheStats(); len(stats) > 0 {
+		response["embedding_cache"] = stats
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
-// Webhook handler
+// metricsHandler exposes model usage and spend for Prometheus to scrape
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := ragService.Usage().WriteMetrics(w); err != nil {
+		log.Printf("⚠️  Failed to write metrics: %v", err)
+	}
+}
+
+// sourceHandler serves one webhook source: it authenticates and parses the
+// request, drops repeat deliveries and dispatches the event to router
+func sourceHandler(source services.Source, router *services.EventRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Set CORS headers
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+		// Handle OPTIONS preflight
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		event, ok := services.ReadSourceEvent(w, r, source)
+		if !ok {
+			return
+		}
+
+		logger := services.TenantLogger(event.Incident.Tenant)
+
+		// Log the event
+		logger.Printf("✅ Received %s webhook: %s - %s", source.Name(), event.Type, event.Incident.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Only process events this route has an action for
+		if !router.Handles(event.Type) {
+			logger.Printf("⭐️ Ignoring event type: %s", event.Type)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "ignored",
+				"reason": "unsupported event type",
+			})
+			return
+		}
+
+		if !tenantLimiters.Admit(w, event) {
+			return
+		}
+
+		// Dry runs preview the note inline and skip dedup and the job queue
+		if event.DryRun {
+			if !services.AuthorizeDryRun(w, r, config.TriageAPITokens) {
+				return
+			}
+			services.ServeDryRun(w, ragService, event)
+			return
+		}
+
+		// Drop retried deliveries of an event we already accepted
+		if !services.ClaimEvent(dedupStore, event) {
+			logger.Printf("⭐️ Ignoring duplicate delivery of event: %s", event.ID)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "duplicate",
+				"reason": "event already received",
+			})
+			return
+		}
+
+		// Dispatch now; AI work is only queued, so this is quick and a full
+		// queue can be reported back to the sender
+		if err := processEvent(router, event); err != nil {
+			// Let the sender's retry of this event through
+			if event.ID != "" {
+				dedupStore.Release(services.EventKey(event.ID))
+			}
+
+			if errors.Is(err, services.ErrQueueFull) {
+				respondQueueFull(w)
+				return
+			}
+
+			http.Error(w, "Failed to process event", http.StatusInternalServerError)
+			return
+		}
+
+		// Return 202 once the work is queued
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":      "accepted",
+			"event_type":  event.Type,
+			"incident_id": event.Incident.ID,
+		})
+	}
+}
+
+// respondQueueFull tells the sender to back off and retry later
+func respondQueueFull(w http.ResponseWriter) {
+	retryAfter := int(jobQueue.RetryAfter.Seconds())
+	log.Printf("🚦 Queue full, asking sender to retry in %ds", retryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Enrichment queue is full", http.StatusServiceUnavailable)
+}
+
+// webhookHandler serves PagerDuty deliveries for every tenant: on
+// /api/webhook/<tenant>, or on /api/webhook matched by subscription ID
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
-	// Set CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	// Handle OPTIONS preflight
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/webhook"), "/")
+	tenant, ok := config.ResolveTenant(r, name)
+	if !ok || strings.Contains(name, "/") {
+		http.NotFound(w, r)
 		return
 	}
+	sourceHandler(services.NewPagerDutySource(tenant), eventRouter)(w, r)
+}
+
+func processEvent(router *services.EventRouter, event services.Event) error {
+	logger := services.TenantLogger(event.Incident.Tenant)
+	logger.Printf("🔄 Processing %s for incident: %s - %s", event.Type, event.Incident.ID, event.Incident.Title)
+
+	// Dispatch to the action registered for this event type
+	if err := router.Dispatch(event); err != nil {
+		logger.Printf("❌ Failed to handle %s for incident %s: %v", event.Type, event.Incident.ID, err)
+		return err
+	}
 
-	// Only accept POST
+	logger.Printf("✅ Successfully handled %s for incident: %s", event.Type, event.Incident.ID)
+	return nil
+}
+
+// processJob runs one queued job on a pool worker and reports its usage;
+// transient errors are retried by the queue
+func processJob(job services.Job) (*services.Usage, error) {
+	logger := services.TenantLogger(job.Incident.Tenant)
+	logger.Printf("🔄 Processing %s job %s (attempt %d) for incident: %s - %s", job.Kind, job.ID, job.Attempts, job.Incident.ID, job.Incident.Title)
+
+	var sink services.NoteSink = ragService.PagerDuty(job.Incident.Tenant)
+	if job.Sink != "" && job.Sink != pagerDutySink {
+		var ok bool
+		if sink, ok = noteSinks[job.Sink]; !ok {
+			return nil, fmt.Errorf("unknown note sink %q", job.Sink)
+		}
+	}
+
+	var usage *services.Usage
+	var err error
+	switch job.Kind {
+	case services.JobReplay:
+		usage, err = ragService.ReplayIncident(job.Incident.Tenant, job.Incident.ID)
+	case services.JobPostmortem:
+		usage, err = ragService.DraftPostmortemTo(job.Incident, sink)
+	default:
+		usage, err = ragService.EnrichIncidentTo(job.Incident, sink)
+	}
+	if err != nil {
+		logger.Printf("❌ Failed %s job for incident %s: %v", job.Kind, job.Incident.ID, err)
+		return usage, err
+	}
+
+	logger.Printf("✅ Successfully completed %s job for incident: %s", job.Kind, job.Incident.ID)
+	return usage, nil
+}
+
+// Triage handler previews the enrichment for an ad-hoc incident without posting it
+func triageHandler(w http.ResponseWriter, r *http.Request) {
+	incident, ok := services.ReadTriageRequest(w, r, config.TriageAPITokens)
+	if !ok {
+		return
+	}
+	services.ServeDryRun(w, ragService, services.Event{Type: services.EventIncidentTriggered, Incident: incident})
+}
+
+// Replay handler queues a fresh enrichment of an existing PagerDuty incident
+func replayHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !services.AuthorizeOperator(w, r, config.TriageAPITokens) {
+		return
+	}
 
-	// Parse webhook payload
-	var payload WebhookPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		log.Printf("Failed to decode payload: %v", err)
-		http.Error(w, "Invalid payload", http.StatusBadRequest)
+	incidentID := strings.TrimPrefix(r.URL.Path, "/api/replay/")
+	if incidentID == "" || strings.Contains(incidentID, "/") {
+		http.Error(w, "incident ID is required", http.StatusBadRequest)
 		return
 	}
 
-	// Log the event
-	log.Printf("✅ Received webhook: %s - %s", payload.Event.EventType, payload.Event.Data.ID)
+	// ?tenant= picks the PagerDuty account the incident lives in
+	tenant, ok := config.Tenant(r.URL.Query().Get("tenant"))
+	if !ok {
+		http.Error(w, "unknown tenant", http.StatusBadRequest)
+		return
+	}
+	logger := services.TenantLogger(tenant.ID())
 
-	// Only process incident.triggered events
-	if payload.Event.EventType != "incident.triggered" {
-		log.Printf("⭐️ Ignoring event type: %s", payload.Event.EventType)
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "ignored",
-			"reason": "not an incident.triggered event",
-		})
+	job, err := jobQueue.Enqueue(services.JobReplay, pagerDutySink, services.IncidentData{ID: incidentID, Tenant: tenant.ID()})
+	if err != nil {
+		if errors.Is(err, services.ErrQueueFull) {
+			respondQueueFull(w)
+			return
+		}
+		logger.Printf("❌ Failed to queue replay of incident %s: %v", incidentID, err)
+		http.Error(w, "Failed to queue replay", http.StatusInternalServerError)
 		return
 	}
+	logger.Printf("🔁 Queued replay of incident: %s", incidentID)
 
-	// Return 202 immediately (async processing)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
 		"status":      "accepted",
-		"incident_id": payload.Event.Data.ID,
+		"incident_id": incidentID,
+		"job_id":      job.ID,
 	})
-
-	// Process in background
-	go processIncident(payload.Event.Data)
 }
 
-func processIncident(data IncidentData) {
-	log.Printf("🔄 Processing incident: %s - %s", data.ID, data.Title)
+// runReplay is the "replay" subcommand: it re-enriches each incident ID
+// given on the command line and exits
+func runReplay(cfg *services.Config, args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	tenantName := flags.String("tenant", "", "tenant whose PagerDuty account holds the incidents")
+	flags.Parse(args)
 
-	// Create RAG service
-	ragService, err := services.NewRAGService()
+	incidentIDs := flags.Args()
+	if len(incidentIDs) == 0 {
+		log.Fatal("usage: go run localserver.go replay [-tenant name] <incident_id>...")
+	}
+	tenant, ok := cfg.Tenant(*tenantName)
+	if !ok {
+		log.Fatalf("❌ Unknown tenant %q", *tenantName)
+	}
+	logger := services.TenantLogger(tenant.ID())
+
+	rag, err := services.NewRAGService(cfg.RAGOptions())
 	if err != nil {
-		log.Printf("❌ Failed to create RAG service: %v", err)
+		log.Fatalf("❌ Failed to create RAG service: %v", err)
+	}
+	defer rag.Close()
+
+	failed := 0
+	for _, id := range incidentIDs {
+		logger.Printf("🔁 Replaying incident: %s", id)
+		if _, err := rag.ReplayIncident(tenant.ID(), id); err != nil {
+			logger.Printf("❌ Failed to replay incident %s: %v", id, err)
+			failed++
+			continue
+		}
+		logger.Printf("✅ Posted revised enrichment for incident: %s", id)
+	}
+
+	if failed > 0 {
+		rag.Close()
+		os.Exit(1)
+	}
+}
+
+// Jobs handler lists queued, running and recent jobs plus the dead-letter
+// list. Jobs carry incident titles and error details, so it needs the
+// operator token.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !services.AuthorizeOperator(w, r, config.TriageAPITokens) {
 		return
 	}
-	defer ragService.Close()
 
-	// Build incident data
-	incident := services.IncidentData{
-		ID:          data.ID,
-		Title:       data.Title,
-		Description: data.Description,
-		Service:     data.Service.Summary,
-		Urgency:     data.Urgency,
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs":         jobQueue.Jobs(),
+		"dead_letters": jobQueue.DeadLetters(),
+	})
+}
+
+// setup creates the shared services from cfg, starts the job workers and
+// registers every route on mux. It returns the alert source paths that were enabled.
+func setup(ctx context.Context, cfg *services.Config, mux *http.ServeMux) ([]string, error) {
+	config = cfg
+
+	store, err := services.NewDedupStore(cfg.Dedup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dedup store: %w", err)
 	}
+	dedupStore = store
 
-	// Enrich incident with AI context
-	err = ragService.EnrichIncident(incident)
+	queue, err := services.NewJobQueueFromConfig(cfg.Jobs)
 	if err != nil {
-		log.Printf("❌ Failed to enrich incident %s: %v", data.ID, err)
-		return
+		return nil, fmt.Errorf("failed to open job queue: %w", err)
 	}
+	// A dead-lettered incident may be enriched or drafted again by a later event
+	queue.OnDeadLetter = services.ReleaseDeadLetter(dedupStore)
+	jobQueue = queue
 
-	log.Printf("✅ Successfully enriched incident: %s", data.ID)
+	rag, err := services.NewRAGService(cfg.RAGOptions().WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create RAG service: %w", err)
+	}
+	ragService = rag
+
+	if err := ragService.CheckEmbeddingDimensions(); err != nil {
+		ragService.Close()
+		return nil, err
+	}
+
+	// Each route picks its own sink; sinks are registered before workers start
+	noteSinks = make(map[string]services.NoteSink)
+	tenantLimiters = services.NewTenantLimiters(cfg)
+
+	// Every event that needs Gemini goes through the bounded worker pool
+	eventRouter = services.NewDefaultEventRouter(ragService, dedupStore)
+	eventRouter.Handle(services.EventIncidentTriggered, services.EnrichAction(jobQueue.Submit, dedupStore))
+	eventRouter.Handle(services.EventIncidentPriorityUpdated, services.EnrichOnPriorityRaiseAction(jobQueue.Submit, dedupStore))
+	eventRouter.Handle(services.EventIncidentResolved, services.PostmortemDraftAction(jobQueue.SubmitPostmortem, dedupStore))
+
+	// Each alert source posts to its own sink; a source whose sink can't be
+	// built (e.g. Opsgenie without an API key) is left unregistered
+	var sourcePaths []string
+	for _, route := range services.SourceRoutes {
+		sink, err := route.NewSink(cfg)
+		if err != nil {
+			log.Printf("⚠️  %s route disabled: %v", route.Name, err)
+			continue
+		}
+		noteSinks[route.Name] = sink
+
+		router := services.NewAlertEventRouter(
+			jobQueue.SubmitTo(services.JobEnrich, route.Name),
+			jobQueue.SubmitTo(services.JobPostmortem, route.Name),
+			dedupStore,
+		)
+		path := "/api/" + route.Name
+		mux.HandleFunc(path, sourceHandler(route.NewSource(cfg), router))
+		sourcePaths = append(sourcePaths, path)
+	}
+
+	pending := 0
+	for _, job := range jobQueue.Jobs() {
+		if job.Status == services.JobQueued {
+			pending++
+		}
+	}
+	if pending > 0 {
+		log.Printf("♻️  Resuming %d pending job(s)", pending)
+	}
+	go jobQueue.Run(ctx, processJob)
+	log.Printf("👷 Started %d workers (queue depth %d)", jobQueue.Workers, jobQueue.MaxDepth)
+
+	mux.HandleFunc("/api/webhook", webhookHandler)
+	mux.HandleFunc("/api/webhook/", webhookHandler)
+	mux.HandleFunc("/api/health", healthHandler)
+	mux.HandleFunc("/api/metrics", metricsHandler)
+	mux.HandleFunc("/api/jobs", jobsHandler)
+	mux.HandleFunc("/api/triage", triageHandler)
+	mux.HandleFunc("/api/replay/", replayHandler)
+
+	return sourcePaths, nil
 }
 
 func main() {
 	// Load .env file for local development (ignored in Vercel)
 	_ = godotenv.Load()
 
-	http.HandleFunc("/api/webhook", webhookHandler)
-	http.HandleFunc("/api/health", healthHandler)
+	cfg, err := services.LoadConfig()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(cfg, os.Args[2:])
+		return
 	}
 
+	mux := http.NewServeMux()
+	sourcePaths, err := setup(context.Background(), cfg, mux)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	defer ragService.Close()
+
+	for _, tenant := range cfg.AllTenants() {
+		if len(tenant.PagerDuty.WebhookSecrets) == 0 {
+			services.TenantLogger(tenant.ID()).Println("⚠️  No webhook signing secrets set - its webhooks will be rejected with 401")
+		}
+	}
+
+	port := cfg.Port
+
 	log.Println("🚀 Incident Triage RAG API - Local Server")
 	log.Printf("🔗 Webhook endpoint: http://localhost:%s/api/webhook", port)
+	for _, tenant := range cfg.Tenants {
+		log.Printf("🏢 Tenant webhook:   http://localhost:%s/api/webhook/%s", port, tenant.Name)
+	}
 	log.Printf("💚 Health endpoint:  http://localhost:%s/api/health", port)
+	log.Printf("📈 Metrics:          http://localhost:%s/api/metrics", port)
+	log.Printf("📋 Jobs endpoint:    http://localhost:%s/api/jobs", port)
+	log.Printf("🧪 Triage preview:   http://localhost:%s/api/triage", port)
+	log.Printf("🔁 Replay:           http://localhost:%s/api/replay/{incident_id}", port)
+	for _, path := range sourcePaths {
+		log.Printf("🔔 Alert source:     http://localhost:%s%s", port, path)
+	}
 	log.Printf("✨ Server listening on port %s...\n", port)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
 		log.Fatal(err)
 	}
 }
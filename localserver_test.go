@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	handler "github.com/stahir80td/incident-management/api"
+	"github.com/stahir80td/incident-management/services"
+)
+
+// The root directory holds several main programs, so run this file with the
+// server it tests: go test localserver.go localserver_test.go
+
+const (
+	testSigningSecret = "parity-secret"
+	testOperatorToken = "operator-token"
+	testGeneratedText = "Likely Root Cause\nConnection pool exhausted after the 14:00 deploy.\n\nRecommended Resolution Steps\n1. Roll back the deploy."
+	// testTriageJSON answers requests that carry a response schema
+	testTriageJSON = `{"root_cause": "Connection pool exhausted after the 14:00 deploy.", "resolution_steps": ["Roll back the deploy."], "related_incidents": ["INC-2024-007"], "confidence": 0.8, "suggested_severity": "SEV2", "open_questions": []}`
+)
+
+// fakeBackends stands in for Gemini, Qdrant and PagerDuty, and hands every
+// note PagerDuty receives to notes
+func fakeBackends(notes chan<- string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":embedContent"):
+			w.Write([]byte(`{"embedding": {"values": [0.1, 0.2, 0.3]}}`))
+		case strings.HasSuffix(r.URL.Path, ":generateContent"):
+			body, _ := io.ReadAll(r.Body)
+			text := testGeneratedText
+			if strings.Contains(string(body), "responseSchema") {
+				text = testTriageJSON
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"candidates": []map[string]interface{}{{
+					"content":      map[string]interface{}{"role": "model", "parts": []map[string]string{{"text": text}}},
+					"finishReason": "STOP",
+				}},
+			})
+		case strings.HasSuffix(r.URL.Path, "/points/search"):
+			w.Write([]byte(`{"result": [
+				{"id": 1, "score": 0.91, "payload": {"incident_id": "INC-2024-007", "section": "root_cause", "service": "checkout-api", "severity": "SEV2", "date": "2024-06-03", "text": "Connection pool exhausted after deploy."}},
+				{"id": 2, "score": 0.84, "payload": {"incident_id": "INC-2024-012", "section": "resolution", "service": "checkout-api", "severity": "SEV2", "date": "2024-08-19", "text": "Rolled back and raised the pool size."}}
+			]}`))
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/collections/"):
+			w.Write([]byte(`{"result": {"config": {"params": {"vectors": {"size": 3, "distance": "Cosine"}}}}}`))
+		case strings.HasSuffix(r.URL.Path, "/notes"):
+			var body struct {
+				Note struct {
+					Content string `json:"content"`
+				} `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				log.Printf("decode note: %v", err)
+			}
+			notes <- body.Note.Content
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			log.Printf("unexpected request to fake backend: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// The Vercel handlers load their configuration once per process, so every
+// test shares one set of fake backends and the environment pointing at them
+var testNotes = make(chan string, 4)
+
+func TestMain(m *testing.M) {
+	srv := fakeBackends(testNotes)
+
+	env := map[string]string{
+		"GEMINI_API_KEY":            "test-key",
+		"GEMINI_API_ENDPOINT":       srv.URL,
+		"EMBEDDING_DIMENSIONS":      "3",
+		"QDRANT_URL":                srv.URL,
+		"QDRANT_API_KEY":            "test-key",
+		"PAGERDUTY_API_URL":         srv.URL,
+		"PAGERDUTY_API_TOKEN":       "test-token",
+		"PAGERDUTY_EMAIL":           "triage@example.com",
+		"PAGERDUTY_WEBHOOK_SECRETS": testSigningSecret,
+		"TRIAGE_API_TOKEN":          testOperatorToken,
+		"DEDUP_STORE":               "memory",
+		"OPSGENIE_SINK":             "log",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+// signedWebhook builds a signed PagerDuty v3 webhook for a fixture incident
+func signedWebhook(t *testing.T, eventType, incidentID string) *http.Request {
+	t.Helper()
+
+	var payload services.WebhookPayload
+	payload.Event.ID = eventType + "-" + incidentID
+	payload.Event.EventType = eventType
+	payload.Event.ResourceType = "incident"
+	payload.Event.Data.ID = incidentID
+	payload.Event.Data.Type = "incident"
+	payload.Event.Data.Title = "checkout-api 5xx rate above 5%"
+	payload.Event.Data.Description = "Error rate spiked to 12% after the 14:00 deploy"
+	payload.Event.Data.Service = services.Reference{ID: "PSVC01", Summary: "checkout-api"}
+	payload.Event.Data.Urgency = "high"
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/webhook", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(services.SignatureHeader, services.SignWebhookBody(body, testSigningSecret))
+	return req
+}
+
+// newTestServer sets up the local server against the shared fake backends
+func newTestServer(t *testing.T) *http.ServeMux {
+	t.Helper()
+
+	t.Setenv("JOB_QUEUE_FILE", filepath.Join(t.TempDir(), "jobs.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cfg, err := services.LoadConfig()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	local := http.NewServeMux()
+	if _, err := setup(ctx, cfg, local); err != nil {
+		t.Fatalf("setup local server: %v", err)
+	}
+	t.Cleanup(ragService.Close)
+
+	return local
+}
+
+func waitForNote(t *testing.T, notes <-chan string) string {
+	t.Helper()
+	select {
+	case note := <-testNotes:
+		return note
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a note")
+		return ""
+	}
+}
+
+// TestHandlerParity runs the same fixture incident through the Vercel
+// function and the local server and checks both post the same note
+func TestHandlerParity(t *testing.T) {
+	local := newTestServer(t)
+
+	tests := []struct {
+		name      string
+		eventType string
+		want      string
+	}{
+		{name: "triggered", eventType: services.EventIncidentTriggered, want: "AI ENRICHMENT"},
+		{name: "resolved", eventType: services.EventIncidentResolved, want: "POSTMORTEM DRAFT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Vercel processes inline, so its note is posted before Webhook returns
+			rec := httptest.NewRecorder()
+			handler.Webhook(rec, signedWebhook(t, tt.eventType, "PVERCEL-"+tt.name))
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("Vercel handler returned %d: %s", rec.Code, rec.Body.String())
+			}
+			vercelNote := waitForNote(t, testNotes)
+
+			// The local server queues the work and a worker posts the note
+			rec = httptest.NewRecorder()
+			local.ServeHTTP(rec, signedWebhook(t, tt.eventType, "PLOCAL-"+tt.name))
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("local server returned %d: %s", rec.Code, rec.Body.String())
+			}
+			localNote := waitForNote(t, testNotes)
+
+			if vercelNote != localNote {
+				t.Errorf("notes differ\nVercel:\n%s\nlocal:\n%s", vercelNote, localNote)
+			}
+			if !strings.Contains(vercelNote, tt.want) {
+				t.Errorf("note is missing %q:\n%s", tt.want, vercelNote)
+			}
+			if !strings.Contains(vercelNote, "Connection pool exhausted after the 14:00 deploy.") {
+				t.Errorf("note is missing the generated text:\n%s", vercelNote)
+			}
+		})
+	}
+}
+
+// TestDryRunParity checks that a dry run returns the same enrichment from
+// both handlers and posts nothing
+func TestDryRunParity(t *testing.T) {
+	local := newTestServer(t)
+
+	dryRun := func(serve func(http.ResponseWriter, *http.Request)) services.Enrichment {
+		t.Helper()
+		req := signedWebhook(t, services.EventIncidentTriggered, "PDRYRUN")
+		req.Header.Set(services.DryRunHeader, "true")
+		req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+
+		rec := httptest.NewRecorder()
+		serve(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("dry run returned %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var enrichment services.Enrichment
+		if err := json.NewDecoder(rec.Body).Decode(&enrichment); err != nil {
+			t.Fatalf("decode dry run response: %v", err)
+		}
+		return enrichment
+	}
+
+	vercel := dryRun(handler.Webhook)
+	localResult := dryRun(local.ServeHTTP)
+
+	if vercel.Note != localResult.Note || vercel.Prompt != localResult.Prompt {
+		t.Errorf("dry runs differ\nVercel:\n%s\nlocal:\n%s", vercel.Note, localResult.Note)
+	}
+	if vercel.GeneratedText != testTriageJSON {
+		t.Errorf("generated text = %q, want %q", vercel.GeneratedText, testTriageJSON)
+	}
+	if vercel.Triage == nil || vercel.Triage.SuggestedSeverity != "SEV2" {
+		t.Errorf("unexpected triage note: %+v", vercel.Triage)
+	}
+	if len(vercel.Results) != 2 || vercel.Results[0].IncidentID != "INC-2024-007" {
+		t.Errorf("unexpected search results: %+v", vercel.Results)
+	}
+
+	select {
+	case note := <-testNotes:
+		t.Errorf("dry run posted a note:\n%s", note)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestDryRunRequiresOperatorToken checks that a signed delivery replayed as a
+// dry run is refused by both handlers without the operator token
+func TestDryRunRequiresOperatorToken(t *testing.T) {
+	local := newTestServer(t)
+
+	handlers := map[string]func(http.ResponseWriter, *http.Request){
+		"Vercel": handler.Webhook,
+		"local":  local.ServeHTTP,
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		query         string
+	}{
+		{name: "no token", query: "?dry_run=true"},
+		{name: "wrong token", authorization: "Bearer wrong", query: "?dry_run=true"},
+		{name: "header flag", query: ""},
+	}
+
+	for handlerName, serve := range handlers {
+		for _, tt := range tests {
+			t.Run(handlerName+"/"+tt.name, func(t *testing.T) {
+				req := signedWebhook(t, services.EventIncidentTriggered, "PDRYRUN-"+handlerName)
+				req.URL.RawQuery = strings.TrimPrefix(tt.query, "?")
+				if tt.query == "" {
+					req.Header.Set(services.DryRunHeader, "true")
+				}
+				if tt.authorization != "" {
+					req.Header.Set("Authorization", tt.authorization)
+				}
+
+				rec := httptest.NewRecorder()
+				serve(rec, req)
+				if rec.Code != http.StatusUnauthorized {
+					t.Errorf("unauthenticated dry run returned %d, want 401: %s", rec.Code, rec.Body.String())
+				}
+				if strings.Contains(rec.Body.String(), "prompt") {
+					t.Errorf("refused dry run leaked the enrichment: %s", rec.Body.String())
+				}
+			})
+		}
+	}
+
+	select {
+	case note := <-testNotes:
+		t.Errorf("refused dry run posted a note:\n%s", note)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,330 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a route triages an alert
+const (
+	// TriageModeClassic is a single prompt over the retrieved incidents
+	TriageModeClassic = "classic"
+	// TriageModeAgent lets the model investigate with tools before answering
+	TriageModeAgent = "agent"
+)
+
+// Agent defaults
+const (
+	DefaultAgentMaxSteps = 6
+	DefaultAgentTimeout  = 90 * time.Second
+)
+
+// maxToolOutput caps what one tool call may hand back to the model
+const maxToolOutput = 16 * 1024
+
+// Roles of the messages in an agent conversation
+const (
+	AgentRoleUser  = "user"
+	AgentRoleModel = "model"
+	AgentRoleTool  = "tool"
+)
+
+// ToolSpec describes a function the model may call
+type ToolSpec struct {
+	Name        string
+	Description string
+	// Parameters is an object schema of the call's arguments
+	Parameters *Schema
+}
+
+// AgentTool is a registered tool and the function that runs it. Run's result
+// is handed to the model as JSON.
+type AgentTool struct {
+	ToolSpec
+	Run func(ctx context.Context, args map[string]interface{}) (interface{}, error)
+}
+
+// ToolCall is the model asking for a tool
+type ToolCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// ToolResult is what a tool call returned, as the model saw it
+type ToolResult struct {
+	Name       string          `json:"name"`
+	Output     json.RawMessage `json:"output,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// AgentMessage is one turn of an agent conversation: the prompt, the model's
+// text and tool calls, or the tools' results
+type AgentMessage struct {
+	Role    string       `json:"role"`
+	Text    string       `json:"text,omitempty"`
+	Calls   []ToolCall   `json:"calls,omitempty"`
+	Results []ToolResult `json:"results,omitempty"`
+}
+
+// ToolRequest is one step of an agent conversation
+type ToolRequest struct {
+	Model string
+	Tools []ToolSpec
+	// Final forbids more tool calls, so the model has to answer
+	Final        bool
+	Conversation []AgentMessage
+}
+
+// ToolCaller is a Generator that supports function calling
+type ToolCaller interface {
+	// CallTools sends the conversation so far and returns the model's next
+	// message: tool calls, or its answer
+	CallTools(ctx context.Context, req ToolRequest) (AgentMessage, error)
+}
+
+// AgentTranscript is the audit record of an agent run: every model turn and
+// tool call, in order
+type AgentTranscript struct {
+	IncidentID string `json:"incident_id"`
+	Provider   string `json:"provider"`
+	// Model is empty for the provider's default model
+	Model    string         `json:"model,omitempty"`
+	Started  time.Time      `json:"started"`
+	Steps    int            `json:"steps"`
+	Messages []AgentMessage `json:"messages"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// ToolRegistry holds the tools an agent run may call
+type ToolRegistry struct {
+	tools map[string]AgentTool
+	order []string
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]AgentTool)}
+}
+
+// Register adds tool, replacing any registered under the same name
+func (t *ToolRegistry) Register(tool AgentTool) {
+	if _, ok := t.tools[tool.Name]; !ok {
+		t.order = append(t.order, tool.Name)
+	}
+	t.tools[tool.Name] = tool
+}
+
+// Specs describes the registered tools, in the order registered
+func (t *ToolRegistry) Specs() []ToolSpec {
+	specs := make([]ToolSpec, 0, len(t.order))
+	for _, name := range t.order {
+		specs = append(specs, t.tools[name].ToolSpec)
+	}
+	return specs
+}
+
+// call runs one tool call. Failures go back to the model as the result's
+// error, so it can try something else.
+func (t *ToolRegistry) call(ctx context.Context, call ToolCall) ToolResult {
+	result := ToolResult{Name: call.Name}
+	start := time.Now()
+	defer func() { result.DurationMS = time.Since(start).Milliseconds() }()
+
+	tool, ok := t.tools[call.Name]
+	if !ok {
+		result.Error = fmt.Sprintf("unknown tool %q", call.Name)
+		return result
+	}
+
+	out, err := tool.Run(ctx, call.Args)
+	if err == nil {
+		result.Output, err = json.Marshal(out)
+	}
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case len(result.Output) > maxToolOutput:
+		result.Output = nil
+		result.Error = fmt.Sprintf("result is over %d bytes; narrow the request", maxToolOutput)
+	}
+	return result
+}
+
+// agentRun drives one function-calling conversation
+type agentRun struct {
+	caller   ToolCaller
+	model    string
+	tools    *ToolRegistry
+	maxSteps int
+	logger   *log.Logger
+}
+
+// run lets the model call tools until it answers, for at most maxSteps model
+// turns. The last turn may not call tools, so a run that fits its steps
+// always ends with an answer. The transcript is returned even on failure.
+func (a *agentRun) run(ctx context.Context, transcript *AgentTranscript, prompt string) (string, error) {
+	transcript.Messages = []AgentMessage{{Role: AgentRoleUser, Text: prompt}}
+	specs := a.tools.Specs()
+
+	for step := 1; step <= a.maxSteps; step++ {
+		transcript.Steps = step
+		msg, err := a.caller.CallTools(ctx, ToolRequest{
+			Model:        a.model,
+			Tools:        specs,
+			Final:        step == a.maxSteps,
+			Conversation: transcript.Messages,
+		})
+		if err != nil {
+			return "", fmt.Errorf("agent step %d: %w", step, err)
+		}
+		transcript.Messages = append(transcript.Messages, msg)
+
+		if len(msg.Calls) == 0 {
+			if strings.TrimSpace(msg.Text) == "" {
+				return "", fmt.Errorf("agent step %d: empty answer", step)
+			}
+			return msg.Text, nil
+		}
+		if step == a.maxSteps {
+			break
+		}
+
+		results := AgentMessage{Role: AgentRoleTool}
+		for _, call := range msg.Calls {
+			a.logger.Printf("🛠️  Agent step %d for incident %s: %s", step, transcript.IncidentID, describeCall(call))
+			results.Results = append(results.Results, a.tools.call(ctx, call))
+		}
+		if step+1 == a.maxSteps {
+			results.Text = "You have no tool calls left. Write the triage note now from what you have found."
+		}
+		transcript.Messages = append(transcript.Messages, results)
+	}
+	return "", fmt.Errorf("no answer within %d steps", a.maxSteps)
+}
+
+// enrichWithAgent triages with an agent run, filling in the enrichment's
+// prompt, answer, transcript and note
+func (r *RAGService) enrichWithAgent(route Route, enrichment *Enrichment) error {
+	caller, ok := r.providers.generators[route.Provider].(ToolCaller)
+	if !ok {
+		return fmt.Errorf("provider %s doesn't support function calling", route.Provider)
+	}
+	incident := enrichment.Incident
+
+	enrichment.Prompt, enrichment.PromptReport = r.buildAgentPrompt(route, incident, enrichment.Results)
+	logPromptReport(r.logger, incident.ID, enrichment.PromptReport)
+
+	transcript := &AgentTranscript{IncidentID: incident.ID, Provider: route.Provider, Model: route.GenerativeModel, Started: time.Now().UTC()}
+	enrichment.Agent = transcript
+	run := &agentRun{
+		caller:   caller,
+		model:    route.GenerativeModel,
+		tools:    r.agentTools(route, incident),
+		maxSteps: r.agent.MaxSteps,
+		logger:   r.logger,
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.agent.Timeout)
+	defer cancel()
+	answer, err := run.run(ctx, transcript, enrichment.Prompt)
+	if err != nil {
+		transcript.Error = err.Error()
+	}
+	r.saveTranscript(transcript)
+	if err != nil {
+		return err
+	}
+
+	enrichment.GeneratedText = answer
+	enrichment.Note = r.formatNote(enrichment.Degraded, answer+investigationSummary(transcript), enrichment.Results)
+	return nil
+}
+
+// buildAgentPrompt is the built-in prompt with a task that asks the model to
+// investigate before answering
+func (r *RAGService) buildAgentPrompt(route Route, incident IncidentData, results []SearchResult) (string, *PromptReport) {
+	sections := alertSections("You are an expert SRE assistant investigating a new alert. You can call tools to search past incidents, read their full postmortems, read this incident's PagerDuty log and list recent change events.\n\nNEW ALERT:\n", incident)
+	sections = append(sections, resultSections(results)...)
+
+	var sb strings.Builder
+	sb.WriteString("TASK:\n")
+	sb.WriteString("Investigate before answering: look for a recent change to the affected service, and\n")
+	sb.WriteString("read the full postmortem of any past incident that looks like a match. Use only\n")
+	sb.WriteString("the tools you need. Then write a concise triage note (max 400 words) with:\n")
+	sb.WriteString("1. Likely Root Cause\n")
+	sb.WriteString("2. Recommended Resolution Steps (specific and actionable)\n")
+	sb.WriteString("3. Related Incident IDs for reference\n")
+	sb.WriteString("4. Evidence: the change events, log entries or past incidents the root cause rests on\n\n")
+	sb.WriteString("Use plain text formatting - no bold, italics, or markdown styling.\n")
+	sb.WriteString("Be concise and action-oriented. Focus on what the on-call engineer should do NOW.\n")
+	sections = append(sections, PromptSection{Name: "task", Text: sb.String()})
+
+	return r.promptAssembler(route).Assemble(sections)
+}
+
+// investigationSummary lists an agent run's tool calls under its answer, so
+// on-call can see what the note is based on
+func investigationSummary(transcript *AgentTranscript) string {
+	var sb strings.Builder
+	n := 0
+	for idx, msg := range transcript.Messages {
+		var results []ToolResult
+		if idx+1 < len(transcript.Messages) {
+			results = transcript.Messages[idx+1].Results
+		}
+		for i, call := range msg.Calls {
+			if n == 0 {
+				sb.WriteString("\n\n--------------------------------\n")
+				sb.WriteString("INVESTIGATION\n")
+				sb.WriteString("--------------------------------\n")
+			}
+			n++
+			sb.WriteString(fmt.Sprintf("  [%d] %s", n, describeCall(call)))
+			if i < len(results) && results[i].Error != "" {
+				sb.WriteString(fmt.Sprintf(" (failed: %s)", truncateUTF8(results[i].Error, 100)))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// describeCall renders a tool call as name(arg=value, ...)
+func describeCall(call ToolCall) string {
+	data, _ := json.Marshal(call.Args)
+	args := strings.Trim(string(data), "{}")
+	return fmt.Sprintf("%s(%s)", call.Name, truncateUTF8(args, 120))
+}
+
+// saveTranscript writes an agent run's transcript under the transcript
+// directory, if one is configured
+func (r *RAGService) saveTranscript(transcript *AgentTranscript) {
+	if r.agent.TranscriptDir == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	if err == nil {
+		name := fmt.Sprintf("%s-%s.json", safeFileName(transcript.IncidentID), transcript.Started.Format("20060102T150405.000000000Z"))
+		err = writeFileAtomic(filepath.Join(r.agent.TranscriptDir, name), data)
+	}
+	if err != nil {
+		r.logger.Printf("⚠️  Failed to save agent transcript for incident %s: %v", transcript.IncidentID, err)
+	}
+}
+
+// safeFileName keeps letters, digits, dashes and underscores
+func safeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedCaller answers each step with the next of replies, or keeps
+// calling tools once they run out. It records the requests it was sent.
+type scriptedCaller struct {
+	replies  []AgentMessage
+	requests []ToolRequest
+}
+
+func (s *scriptedCaller) CallTools(ctx context.Context, req ToolRequest) (AgentMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return AgentMessage{}, err
+	}
+	s.requests = append(s.requests, req)
+	if n := len(s.requests); n <= len(s.replies) {
+		return s.replies[n-1], nil
+	}
+	return toolCallMessage("echo"), nil
+}
+
+func toolCallMessage(names ...string) AgentMessage {
+	msg := AgentMessage{Role: AgentRoleModel}
+	for _, name := range names {
+		msg.Calls = append(msg.Calls, ToolCall{Name: name, Args: map[string]interface{}{"q": name}})
+	}
+	return msg
+}
+
+func answerMessage(text string) AgentMessage {
+	return AgentMessage{Role: AgentRoleModel, Text: text}
+}
+
+func testTools() *ToolRegistry {
+	tools := NewToolRegistry()
+	tools.Register(AgentTool{
+		ToolSpec: ToolSpec{Name: "echo"},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			return args, nil
+		},
+	})
+	tools.Register(AgentTool{
+		ToolSpec: ToolSpec{Name: "huge"},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			return strings.Repeat("x", maxToolOutput), nil
+		},
+	})
+	tools.Register(AgentTool{
+		ToolSpec: ToolSpec{Name: "slow"},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	return tools
+}
+
+func TestAgentRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		replies     []AgentMessage
+		maxSteps    int
+		timeout     time.Duration
+		wantAnswer  string
+		wantErr     string
+		wantSteps   int
+		wantResults []string
+	}{
+		{
+			name:       "answers straight away",
+			replies:    []AgentMessage{answerMessage("Roll back the deploy.")},
+			maxSteps:   3,
+			wantAnswer: "Roll back the deploy.",
+			wantSteps:  1,
+		},
+		{
+			name:        "calls a tool then answers",
+			replies:     []AgentMessage{toolCallMessage("echo"), answerMessage("Roll back the deploy.")},
+			maxSteps:    3,
+			wantAnswer:  "Roll back the deploy.",
+			wantSteps:   2,
+			wantResults: []string{""},
+		},
+		{
+			name:        "step limit",
+			maxSteps:    3,
+			wantErr:     "no answer within 3 steps",
+			wantSteps:   3,
+			wantResults: []string{"", ""},
+		},
+		{
+			name:        "unknown tool",
+			replies:     []AgentMessage{toolCallMessage("drop_tables"), answerMessage("done")},
+			maxSteps:    3,
+			wantAnswer:  "done",
+			wantSteps:   2,
+			wantResults: []string{`unknown tool "drop_tables"`},
+		},
+		{
+			name:        "oversized result",
+			replies:     []AgentMessage{toolCallMessage("huge", "echo"), answerMessage("done")},
+			maxSteps:    3,
+			wantAnswer:  "done",
+			wantSteps:   2,
+			wantResults: []string{"result is over 16384 bytes; narrow the request", ""},
+		},
+		{
+			name:        "timeout",
+			replies:     []AgentMessage{toolCallMessage("slow")},
+			maxSteps:    3,
+			timeout:     20 * time.Millisecond,
+			wantErr:     context.DeadlineExceeded.Error(),
+			wantSteps:   2,
+			wantResults: []string{context.DeadlineExceeded.Error()},
+		},
+		{
+			name:      "empty answer",
+			replies:   []AgentMessage{answerMessage("  ")},
+			maxSteps:  3,
+			wantErr:   "agent step 1: empty answer",
+			wantSteps: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &scriptedCaller{replies: tt.replies}
+			run := &agentRun{caller: caller, tools: testTools(), maxSteps: tt.maxSteps, logger: log.Default()}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			transcript := &AgentTranscript{IncidentID: "PINC1"}
+			answer, err := run.run(ctx, transcript, "triage this")
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if answer != tt.wantAnswer {
+				t.Errorf("answer = %q, want %q", answer, tt.wantAnswer)
+			}
+			if transcript.Steps != tt.wantSteps {
+				t.Errorf("steps = %d, want %d", transcript.Steps, tt.wantSteps)
+			}
+
+			var results []string
+			for _, msg := range transcript.Messages {
+				for _, result := range msg.Results {
+					results = append(results, result.Error)
+				}
+			}
+			if strings.Join(results, "|") != strings.Join(tt.wantResults, "|") {
+				t.Errorf("tool result errors = %q, want %q", results, tt.wantResults)
+			}
+
+			// Only the last allowed turn forbids tool calls
+			for i, req := range caller.requests {
+				if want := i+1 == tt.maxSteps; req.Final != want {
+					t.Errorf("step %d: Final = %v, want %v", i+1, req.Final, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAgentRunWarnsBeforeTheFinalTurn(t *testing.T) {
+	caller := &scriptedCaller{}
+	run := &agentRun{caller: caller, tools: testTools(), maxSteps: 2, logger: log.Default()}
+
+	transcript := &AgentTranscript{IncidentID: "PINC1"}
+	if _, err := run.run(context.Background(), transcript, "triage this"); err == nil {
+		t.Fatal("run without an answer succeeded")
+	}
+
+	// prompt, tool calls, results, final tool calls
+	if len(transcript.Messages) != 4 {
+		t.Fatalf("%d messages, want 4", len(transcript.Messages))
+	}
+	if results := transcript.Messages[2]; !strings.Contains(results.Text, "no tool calls left") {
+		t.Errorf("results before the final turn = %q, want the no-tool-calls warning", results.Text)
+	}
+}
+
+func TestToolRegistryCallError(t *testing.T) {
+	tools := NewToolRegistry()
+	tools.Register(AgentTool{
+		ToolSpec: ToolSpec{Name: "broken"},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("backend down")
+		},
+	})
+
+	result := tools.call(context.Background(), ToolCall{Name: "broken"})
+	if result.Error != "backend down" || result.Output != nil {
+		t.Errorf("result = %+v, want the tool's error and no output", result)
+	}
+}
+
+func TestInvestigationSummary(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript *AgentTranscript
+		want       string
+	}{
+		{
+			name:       "no calls",
+			transcript: &AgentTranscript{Messages: []AgentMessage{{Role: AgentRoleUser, Text: "triage this"}, answerMessage("done")}},
+			want:       "",
+		},
+		{
+			name: "calls and a failure",
+			transcript: &AgentTranscript{Messages: []AgentMessage{
+				{Role: AgentRoleUser, Text: "triage this"},
+				toolCallMessage("echo", "huge"),
+				{Role: AgentRoleTool, Results: []ToolResult{{Name: "echo"}, {Name: "huge", Error: "result is over 16384 bytes; narrow the request"}}},
+				toolCallMessage("echo"),
+				{Role: AgentRoleTool, Results: []ToolResult{{Name: "echo"}}},
+				answerMessage("done"),
+			}},
+			want: "\n\n--------------------------------\nINVESTIGATION\n--------------------------------\n" +
+				"  [1] echo(\"q\":\"echo\")\n" +
+				"  [2] huge(\"q\":\"huge\") (failed: result is over 16384 bytes; narrow the request)\n" +
+				"  [3] echo(\"q\":\"echo\")",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := investigationSummary(tt.transcript); got != tt.want {
+				t.Errorf("investigationSummary() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limits on what the built-in tools hand back, to keep each result well
+// under maxToolOutput
+const (
+	toolTextLimit        = 1000
+	toolMaxResults       = 10
+	toolMaxLogEntries    = 100
+	toolMaxChangeEvents  = 20
+	toolMaxChangeHours   = 7 * 24
+	defaultToolResults   = 5
+	defaultToolLogLimit  = 25
+	defaultToolChangeAge = 24
+)
+
+// agentTools registers the built-in tools for one incident. They search the
+// route's collections and the incident's PagerDuty account; the incident's
+// own log is only there when it is a PagerDuty incident.
+func (r *RAGService) agentTools(route Route, incident IncidentData) *ToolRegistry {
+	tools := NewToolRegistry()
+	tools.Register(r.searchTool(route))
+	tools.Register(r.postmortemTool(route))
+	if incident.Source == SourcePagerDuty {
+		tools.Register(r.incidentLogTool(incident))
+	}
+	tools.Register(r.changeEventsTool(incident))
+	return tools
+}
+
+// toolSection is a past incident's section as tools return it
+type toolSection struct {
+	IncidentID string  `json:"incident_id,omitempty"`
+	Section    string  `json:"section"`
+	Service    string  `json:"service,omitempty"`
+	Severity   string  `json:"severity,omitempty"`
+	Date       string  `json:"date,omitempty"`
+	Score      float32 `json:"score,omitempty"`
+	Text       string  `json:"text"`
+}
+
+func (r *RAGService) searchTool(route Route) AgentTool {
+	return AgentTool{
+		ToolSpec: ToolSpec{
+			Name:        "search_knowledge_base",
+			Description: "Search past incident postmortems for sections similar to a query. Each result is one section (summary, root_cause, resolution, prevention, impact or timeline) of a past incident.",
+			Parameters: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"query":    {Type: "string", Description: "What to look for, e.g. a symptom, error message or suspected cause"},
+					"service":  {Type: "string", Description: "Only incidents of this service"},
+					"severity": {Type: "string", Description: "Only incidents of this severity", Enum: Severities},
+					"since":    {Type: "string", Description: "Only incidents on or after this date, YYYY-MM-DD"},
+					"limit":    {Type: "integer", Description: "Most results to return, 1 to 10; default 5"},
+				},
+				Required: []string{"query"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			query := stringArg(args, "query")
+			if query == "" {
+				return nil, fmt.Errorf("query is required")
+			}
+			filter := &Filter{}
+			if service := stringArg(args, "service"); service != "" {
+				filter.Must = append(filter.Must, MatchAny(PayloadService, serviceNames(service)...))
+			}
+			if severity := stringArg(args, "severity"); severity != "" {
+				filter.Must = append(filter.Must, MatchValue(PayloadSeverity, strings.ToUpper(severity)))
+			}
+			if since := stringArg(args, "since"); since != "" {
+				from, err := time.Parse("2006-01-02", since)
+				if err != nil {
+					return nil, fmt.Errorf("since must be a date, YYYY-MM-DD")
+				}
+				filter.Must = append(filter.Must, DateRange(PayloadDate, from, time.Time{}))
+			}
+			limit := intArg(args, "limit", defaultToolResults, 1, toolMaxResults)
+
+			embedding, err := r.providers.embedders[route.EmbeddingProvider].GenerateEmbedding(ctx, query, TaskRetrievalQuery)
+			if err != nil {
+				return nil, fmt.Errorf("failed to embed query: %w", err)
+			}
+
+			var results []SearchResult
+			for _, collection := range route.Collections {
+				found, err := r.qdrant.SearchCollection(ctx, collection, embedding, uint64(limit), filter)
+				if err != nil {
+					return nil, fmt.Errorf("failed to search %s: %w", collection, err)
+				}
+				results = append(results, found...)
+			}
+
+			sections := []toolSection{}
+			for _, result := range mergeResults(results, uint64(limit)) {
+				sections = append(sections, toolSection{
+					IncidentID: result.IncidentID,
+					Section:    result.Section,
+					Service:    result.Service,
+					Severity:   result.Severity,
+					Date:       result.Date,
+					Score:      result.Score,
+					Text:       truncateUTF8(result.Text, toolTextLimit),
+				})
+			}
+			return map[string]interface{}{"results": sections}, nil
+		},
+	}
+}
+
+func (r *RAGService) postmortemTool(route Route) AgentTool {
+	return AgentTool{
+		ToolSpec: ToolSpec{
+			Name:        "get_postmortem",
+			Description: "Fetch the full postmortem of a past incident: every section, with its service, severity and date.",
+			Parameters: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"incident_id": {Type: "string", Description: "The past incident's ID, e.g. INC-2024-007"},
+				},
+				Required: []string{"incident_id"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			incidentID := stringArg(args, "incident_id")
+			if incidentID == "" {
+				return nil, fmt.Errorf("incident_id is required")
+			}
+
+			for _, collection := range route.Collections {
+				found, err := r.qdrant.IncidentSections(ctx, collection, incidentID)
+				if err != nil {
+					return nil, err
+				}
+				if len(found) == 0 {
+					continue
+				}
+
+				sections := make([]toolSection, 0, len(found))
+				for _, result := range found {
+					sections = append(sections, toolSection{Section: result.Section, Text: result.Text})
+				}
+				return map[string]interface{}{
+					"incident_id": incidentID,
+					"service":     found[0].Service,
+					"severity":    found[0].Severity,
+					"date":        found[0].Date,
+					"sections":    sections,
+				}, nil
+			}
+			return nil, fmt.Errorf("no postmortem found for %s", incidentID)
+		},
+	}
+}
+
+// incidentLogTool reads the log of the incident being triaged only, so the
+// model can't be steered into reading other incidents in the account
+func (r *RAGService) incidentLogTool(incident IncidentData) AgentTool {
+	return AgentTool{
+		ToolSpec: ToolSpec{
+			Name:        "get_incident_log",
+			Description: "Fetch the most important log entries of the incident being triaged, newest first: triggers, acknowledgements, escalations, notes and status changes.",
+			Parameters: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"limit": {Type: "integer", Description: "Most entries to return, 1 to 100; default 25"},
+				},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			limit := intArg(args, "limit", defaultToolLogLimit, 1, toolMaxLogEntries)
+
+			entries, err := r.PagerDuty(incident.Tenant).ListLogEntries(ctx, incident.ID, limit)
+			if err != nil {
+				return nil, err
+			}
+			for i := range entries {
+				entries[i].Summary = truncateUTF8(entries[i].Summary, toolTextLimit)
+			}
+			return map[string]interface{}{"incident_id": incident.ID, "log_entries": entries}, nil
+		},
+	}
+}
+
+func (r *RAGService) changeEventsTool(incident IncidentData) AgentTool {
+	return AgentTool{
+		ToolSpec: ToolSpec{
+			Name:        "list_change_events",
+			Description: "List recent change events sent to PagerDuty, such as deploys and config changes, newest first.",
+			Parameters: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"hours":   {Type: "integer", Description: "How far back to look, 1 to 168 hours; default 24"},
+					"service": {Type: "string", Description: "Only changes to services whose name contains this"},
+				},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			hours := intArg(args, "hours", defaultToolChangeAge, 1, toolMaxChangeHours)
+			service := strings.ToLower(stringArg(args, "service"))
+
+			until := time.Now()
+			events, err := r.PagerDuty(incident.Tenant).ListChangeEvents(ctx, until.Add(-time.Duration(hours)*time.Hour), until)
+			if err != nil {
+				return nil, err
+			}
+
+			matched := []ChangeEvent{}
+			for _, event := range events {
+				if service == "" || changesService(event, service) {
+					event.Summary = truncateUTF8(event.Summary, toolTextLimit)
+					matched = append(matched, event)
+				}
+			}
+			sort.SliceStable(matched, func(i, j int) bool {
+				return matched[i].Timestamp > matched[j].Timestamp
+			})
+			total := len(matched)
+			if total > toolMaxChangeEvents {
+				matched = matched[:toolMaxChangeEvents]
+			}
+			return map[string]interface{}{"total": total, "change_events": matched}, nil
+		},
+	}
+}
+
+// changesService reports whether a change event names a service containing
+// service, which is lower case
+func changesService(event ChangeEvent, service string) bool {
+	for _, ref := range event.Services {
+		if strings.Contains(strings.ToLower(ref.Summary), service) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringArg reads a string argument of a tool call; anything else is ""
+func stringArg(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return strings.TrimSpace(s)
+}
+
+// intArg reads a whole number argument, clamped to [min, max]. JSON numbers
+// arrive as float64; a missing or malformed one is def.
+func intArg(args map[string]interface{}, name string, def, min, max int) int {
+	n := def
+	switch v := args[name].(type) {
+	case float64:
+		n = int(v)
+	case int:
+		n = v
+	}
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Prometheus Alertmanager webhook payload structures (version 4)
+type AlertmanagerPayload struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []Alert           `json:"alerts"`
+}
+
+type Alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// serviceLabels are checked in order for the name of the affected service
+var serviceLabels = []string{"service", "app", "job", "namespace"}
+
+// FiringAlerts returns only the alerts that are still firing
+func (p AlertmanagerPayload) FiringAlerts() []Alert {
+	var firing []Alert
+	for _, alert := range p.Alerts {
+		if alert.Status != "resolved" {
+			firing = append(firing, alert)
+		}
+	}
+	return firing
+}
+
+// ToIncident folds the whole alert group into one incident, so a group of N
+// alerts is enriched once. The ID is derived from the group key, which stays
+// stable across Alertmanager's repeat notifications for the same group.
+func (p AlertmanagerPayload) ToIncident() IncidentData {
+	firing := p.FiringAlerts()
+
+	labels := p.CommonLabels
+	annotations := p.CommonAnnotations
+	if len(firing) == 1 {
+		labels = firing[0].Labels
+		annotations = firing[0].Annotations
+	}
+
+	title := firstNonEmpty(annotations["summary"], annotations["title"], labels["alertname"], p.GroupLabels["alertname"])
+	if title == "" {
+		title = "Alertmanager alert group"
+	}
+	if len(firing) > 1 {
+		title = fmt.Sprintf("[%d alerts] %s", len(firing), title)
+	}
+
+	var desc strings.Builder
+	desc.WriteString(firstNonEmpty(annotations["description"], annotations["message"]))
+	if len(firing) > 1 {
+		for _, alert := range firing {
+			desc.WriteString("\n- ")
+			desc.WriteString(firstNonEmpty(alert.Annotations["summary"], alert.Labels["alertname"]))
+			if extra := distinctLabels(alert.Labels, p.CommonLabels); extra != "" {
+				desc.WriteString(" (" + extra + ")")
+			}
+		}
+	}
+
+	service := ""
+	for _, key := range serviceLabels {
+		if service = labels[key]; service != "" {
+			break
+		}
+	}
+
+	return IncidentData{
+		ID:          "am-" + shortHash(p.GroupKey),
+		Title:       title,
+		Description: strings.TrimSpace(desc.String()),
+		Service:     service,
+		Urgency:     severityToUrgency(labels["severity"]),
+	}
+}
+
+// severityToUrgency maps common Prometheus severity labels onto PagerDuty urgency
+func severityToUrgency(severity string) string {
+	switch strings.ToLower(severity) {
+	case "critical", "page", "error", "high":
+		return "high"
+	default:
+		return "low"
+	}
+}
+
+// distinctLabels renders the labels of an alert that aren't shared by the group
+func distinctLabels(labels, common map[string]string) string {
+	var parts []string
+	for key, value := range labels {
+		if _, shared := common[key]; !shared {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
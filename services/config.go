@@ -0,0 +1,614 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is loaded when CONFIG_FILE is unset and the file exists
+const defaultConfigFile = "config.yaml"
+
+// Config is every setting the service reads. It is loaded once at startup:
+// defaults, then the YAML file named by CONFIG_FILE (or ./config.yaml), then
+// environment variables. Every variable can also be given as <NAME>_FILE,
+// holding the path of a file with the value, for mounted secrets.
+type Config struct {
+	Port string `yaml:"port" env:"PORT"`
+
+	// HTTPTimeout bounds each call to Qdrant, PagerDuty, Opsgenie and note webhooks
+	HTTPTimeout time.Duration `yaml:"http_timeout" env:"HTTP_TIMEOUT"`
+
+	Gemini    GeminiConfig    `yaml:"gemini"`
+	Qdrant    QdrantConfig    `yaml:"qdrant"`
+	PagerDuty PagerDutyConfig `yaml:"pagerduty"`
+	Opsgenie  OpsgenieConfig  `yaml:"opsgenie"`
+	Dedup     DedupConfig     `yaml:"dedup"`
+	// EmbeddingCache remembers query embeddings across incidents
+	EmbeddingCache EmbeddingCacheConfig `yaml:"embedding_cache"`
+	Jobs           JobsConfig           `yaml:"jobs"`
+	Sources        SourcesConfig        `yaml:"sources"`
+	Routing        RoutingConfig        `yaml:"routing"`
+
+	// PromptBudget caps the tokens a triage or postmortem prompt may use
+	PromptBudget PromptBudgetConfig `yaml:"prompt_budget"`
+	// Usage prices model calls and caps what a day of them may cost
+	Usage UsageConfig `yaml:"usage"`
+	// Agent sets the triage mode and bounds agent runs
+	Agent AgentConfig `yaml:"agent"`
+
+	// EmbeddingProvider and GenerativeProvider pick the default model APIs:
+	// gemini, or one of Providers. Routing rules can pick others.
+	EmbeddingProvider  string           `yaml:"embedding_provider" env:"EMBEDDING_PROVIDER"`
+	GenerativeProvider string           `yaml:"generative_provider" env:"GENERATIVE_PROVIDER"`
+	Providers          []ProviderConfig `yaml:"providers"`
+
+	// RateLimit caps events for the default tenant; Tenants adds more
+	// PagerDuty accounts, each with its own credentials and limits
+	RateLimit RateLimitConfig `yaml:"rate_limit" env:"RATE_LIMIT_"`
+	Tenants   []TenantConfig  `yaml:"tenants"`
+
+	// TriageAPITokens guard the operator endpoints (/api/triage, /api/replay)
+	TriageAPITokens []string `yaml:"triage_api_tokens" env:"TRIAGE_API_TOKEN"`
+}
+
+type GeminiConfig struct {
+	APIKey         string `yaml:"api_key" env:"GEMINI_API_KEY"`
+	Endpoint       string `yaml:"endpoint" env:"GEMINI_API_ENDPOINT"`
+	EmbeddingModel string `yaml:"embedding_model" env:"EMBEDDING_MODEL"`
+	// EmbeddingDimensions must match the vector size of the Qdrant collections
+	EmbeddingDimensions int           `yaml:"embedding_dimensions" env:"EMBEDDING_DIMENSIONS"`
+	GenerativeModel     string        `yaml:"generative_model" env:"GENERATIVE_MODEL"`
+	Temperature         float32       `yaml:"temperature" env:"GEMINI_TEMPERATURE"`
+	TopP                float32       `yaml:"top_p" env:"GEMINI_TOP_P"`
+	TopK                int32         `yaml:"top_k" env:"GEMINI_TOP_K"`
+	MaxOutputTokens     int32         `yaml:"max_output_tokens" env:"GEMINI_MAX_OUTPUT_TOKENS"`
+	Timeout             time.Duration `yaml:"timeout" env:"GEMINI_TIMEOUT"`
+	// FallbackModel answers when the generative model's answer is blocked or empty
+	FallbackModel string `yaml:"fallback_model" env:"GEMINI_FALLBACK_MODEL"`
+	// RequestsPerMinute and TokensPerMinute pace calls to stay inside the
+	// project's quota, shared by everything in the process; 0 is unlimited
+	RequestsPerMinute int `yaml:"requests_per_minute" env:"GEMINI_REQUESTS_PER_MINUTE"`
+	TokensPerMinute   int `yaml:"tokens_per_minute" env:"GEMINI_TOKENS_PER_MINUTE"`
+	// MaxRetries repeats calls failing with 429, 5xx or a timeout, backing
+	// off from RetryBase to RetryMax
+	MaxRetries int           `yaml:"max_retries" env:"GEMINI_MAX_RETRIES"`
+	RetryBase  time.Duration `yaml:"retry_base" env:"GEMINI_RETRY_BASE"`
+	RetryMax   time.Duration `yaml:"retry_max" env:"GEMINI_RETRY_MAX"`
+}
+
+type QdrantConfig struct {
+	URL        string `yaml:"url" env:"QDRANT_URL"`
+	APIKey     string `yaml:"api_key" env:"QDRANT_API_KEY"`
+	Collection string `yaml:"collection" env:"COLLECTION_NAME"`
+	// TopK is how many similar incident chunks are retrieved per query
+	TopK int `yaml:"top_k" env:"RETRIEVAL_TOP_K"`
+	// RelatedServices are searched along with the alert's own service;
+	// MaxAgeDays leaves out older incidents, 0 keeps them all. When no
+	// incident passes, every one is searched.
+	RelatedServices RelatedServices `yaml:"related_services" env:"RELATED_SERVICES"`
+	MaxAgeDays      int             `yaml:"max_age_days" env:"RETRIEVAL_MAX_AGE_DAYS"`
+}
+
+type PagerDutyConfig struct {
+	APIToken string `yaml:"api_token" env:"PAGERDUTY_API_TOKEN"`
+	Email    string `yaml:"email" env:"PAGERDUTY_EMAIL"`
+	APIURL   string `yaml:"api_url" env:"PAGERDUTY_API_URL"`
+	// WebhookSecrets holds every active signing secret while one is rotated
+	WebhookSecrets []string `yaml:"webhook_secrets" env:"PAGERDUTY_WEBHOOK_SECRETS,PAGERDUTY_WEBHOOK_SECRET"`
+}
+
+type OpsgenieConfig struct {
+	APIKey string `yaml:"api_key" env:"OPSGENIE_API_KEY"`
+	APIURL string `yaml:"api_url" env:"OPSGENIE_API_URL"`
+}
+
+type DedupConfig struct {
+	Store string        `yaml:"store" env:"DEDUP_STORE"`
+	File  string        `yaml:"file" env:"DEDUP_FILE"`
+	TTL   time.Duration `yaml:"ttl" env:"DEDUP_TTL"`
+}
+
+type EmbeddingCacheConfig struct {
+	Store string `yaml:"store" env:"EMBEDDING_CACHE"`
+	// Size caps the memory cache; the file cache is unbounded
+	Size int    `yaml:"size" env:"EMBEDDING_CACHE_SIZE"`
+	Dir  string `yaml:"dir" env:"EMBEDDING_CACHE_DIR"`
+}
+
+type PromptBudgetConfig struct {
+	Tokens int `yaml:"tokens" env:"PROMPT_TOKEN_BUDGET"`
+	// Counter is estimate, about four characters a token, or model to ask
+	// the generative provider's tokenizer (Gemini only)
+	Counter string `yaml:"counter" env:"PROMPT_TOKEN_COUNTER"`
+}
+
+type UsageConfig struct {
+	// Prices are USD per million prompt and completion tokens, by model
+	Prices ModelPrices `yaml:"prices" env:"MODEL_PRICES"`
+	// DailyBudget in USD switches triage to similar incidents only for the
+	// rest of the UTC day once spent; 0 is no cap
+	DailyBudget float64 `yaml:"daily_budget_usd" env:"DAILY_BUDGET_USD"`
+	// File keeps the day's spend across restarts; empty keeps it in memory
+	File string `yaml:"file" env:"USAGE_FILE"`
+}
+
+type AgentConfig struct {
+	// Mode is classic, one prompt over the retrieved incidents, or agent,
+	// where the model investigates with tools first (Gemini only). Routing
+	// rules can pick either.
+	Mode string `yaml:"mode" env:"TRIAGE_MODE"`
+	// MaxSteps caps the model turns of an agent run; Timeout bounds the run
+	MaxSteps int           `yaml:"max_steps" env:"AGENT_MAX_STEPS"`
+	Timeout  time.Duration `yaml:"timeout" env:"AGENT_TIMEOUT"`
+	// TranscriptDir keeps each run's tool calls as JSON for auditing; empty
+	// leaves them in the logs and API responses only
+	TranscriptDir string `yaml:"transcript_dir" env:"AGENT_TRANSCRIPT_DIR"`
+}
+
+type JobsConfig struct {
+	File        string        `yaml:"file" env:"JOB_QUEUE_FILE"`
+	MaxAttempts int           `yaml:"max_attempts" env:"JOB_MAX_ATTEMPTS"`
+	RetryBase   time.Duration `yaml:"retry_base" env:"JOB_RETRY_BASE"`
+	RetryMax    time.Duration `yaml:"retry_max" env:"JOB_RETRY_MAX"`
+	Workers     int           `yaml:"workers" env:"JOB_WORKERS"`
+	QueueDepth  int           `yaml:"queue_depth" env:"JOB_QUEUE_DEPTH"`
+	RetryAfter  time.Duration `yaml:"retry_after" env:"JOB_RETRY_AFTER"`
+	// DeadLetters caps the dead-letter list, dropping the oldest beyond it;
+	// DeadLetterTTL drops any older than that
+	DeadLetters   int           `yaml:"dead_letters" env:"JOB_DEAD_LETTERS"`
+	DeadLetterTTL time.Duration `yaml:"dead_letter_ttl" env:"JOB_DEAD_LETTER_TTL"`
+}
+
+// SourcesConfig holds the settings of each alert source route. The env tag
+// on each field is the prefix of that source's variables.
+type SourcesConfig struct {
+	Alertmanager SourceConfig `yaml:"alertmanager" env:"ALERTMANAGER_"`
+	Opsgenie     SourceConfig `yaml:"opsgenie" env:"OPSGENIE_"`
+	Grafana      SourceConfig `yaml:"grafana" env:"GRAFANA_"`
+	Datadog      SourceConfig `yaml:"datadog" env:"DATADOG_"`
+}
+
+// SourceConfig is one alert source's bearer tokens and note sink
+type SourceConfig struct {
+	Tokens []string `yaml:"tokens" env:"WEBHOOK_TOKEN,TOKEN"`
+	// Sink is log, webhook, pagerduty or opsgenie
+	Sink    string `yaml:"sink" env:"SINK"`
+	SinkURL string `yaml:"sink_url" env:"SINK_URL"`
+}
+
+// Source returns the settings for the named source route
+func (s SourcesConfig) Source(name string) SourceConfig {
+	switch name {
+	case "alertmanager":
+		return s.Alertmanager
+	case "opsgenie":
+		return s.Opsgenie
+	case "grafana":
+		return s.Grafana
+	case "datadog":
+		return s.Datadog
+	default:
+		return SourceConfig{}
+	}
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:        "8080",
+		HTTPTimeout: DefaultHTTPTimeout,
+		Gemini: GeminiConfig{
+			EmbeddingModel:      DefaultEmbeddingModel,
+			EmbeddingDimensions: DefaultEmbeddingDimensions,
+			GenerativeModel:     DefaultGenerativeModel,
+			Temperature:         DefaultTemperature,
+			TopP:                DefaultTopP,
+			TopK:                DefaultSamplingTopK,
+			MaxOutputTokens:     DefaultMaxOutputTokens,
+			Timeout:             DefaultGeminiTimeout,
+			MaxRetries:          DefaultGeminiMaxRetries,
+			RetryBase:           DefaultGeminiRetryBase,
+			RetryMax:            DefaultGeminiRetryMax,
+		},
+		Qdrant: QdrantConfig{
+			Collection: DefaultCollection,
+			TopK:       DefaultTopK,
+		},
+		PagerDuty: PagerDutyConfig{
+			APIURL: defaultPagerDutyAPIURL,
+		},
+		Opsgenie: OpsgenieConfig{
+			APIURL: defaultOpsgenieAPIURL,
+		},
+		Dedup: DedupConfig{
+			Store: "memory",
+			File:  filepath.Join(os.TempDir(), "incident-triage-dedup.json"),
+			TTL:   DefaultDedupTTL,
+		},
+		EmbeddingCache: EmbeddingCacheConfig{
+			Store: "memory",
+			Size:  DefaultEmbeddingCacheSize,
+			Dir:   filepath.Join(os.TempDir(), "incident-triage-embeddings"),
+		},
+		PromptBudget: PromptBudgetConfig{
+			Tokens:  DefaultPromptTokenBudget,
+			Counter: TokenCounterEstimate,
+		},
+		Agent: AgentConfig{
+			Mode:          TriageModeClassic,
+			MaxSteps:      DefaultAgentMaxSteps,
+			Timeout:       DefaultAgentTimeout,
+			TranscriptDir: "data/agent-transcripts",
+		},
+		Jobs: JobsConfig{
+			File:          "data/jobs.json",
+			MaxAttempts:   defaultJobMaxAttempts,
+			RetryBase:     defaultJobBaseBackoff,
+			RetryMax:      defaultJobMaxBackoff,
+			Workers:       defaultJobWorkers,
+			QueueDepth:    defaultJobQueueDepth,
+			RetryAfter:    defaultJobRetryAfter,
+			DeadLetters:   defaultJobDeadLetters,
+			DeadLetterTTL: defaultJobDeadLetterTTL,
+		},
+		EmbeddingProvider:  ProviderGemini,
+		GenerativeProvider: ProviderGemini,
+		Sources: SourcesConfig{
+			Alertmanager: SourceConfig{Sink: "log"},
+			Opsgenie:     SourceConfig{Sink: "opsgenie"},
+			Grafana:      SourceConfig{Sink: "log"},
+			Datadog:      SourceConfig{Sink: "log"},
+		},
+	}
+}
+
+// LoadConfig builds the configuration and validates it
+func LoadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyTenantEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyProviderEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Routing.loadFile(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+var (
+	requestConfigOnce sync.Once
+	requestConfig     *Config
+	requestConfigErr  error
+)
+
+// ConfigForRequest loads the configuration in an entrypoint without a startup
+// hook, such as a serverless function. It loads once per process, so a warm
+// Vercel instance keeps the result, or the error, until it is recycled. When
+// ok is false it has answered 500.
+func ConfigForRequest(w http.ResponseWriter) (cfg *Config, ok bool) {
+	requestConfigOnce.Do(func() {
+		requestConfig, requestConfigErr = LoadConfig()
+	})
+
+	cfg, err := requestConfig, requestConfigErr
+	if err != nil {
+		log.Printf("❌ Failed to load configuration: %v", err)
+		http.Error(w, "Service misconfigured", http.StatusInternalServerError)
+		return nil, false
+	}
+	return cfg, true
+}
+
+// Validate reports every missing or out-of-range setting at once
+func (c *Config) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	require := func(value, field, env string) {
+		if value == "" {
+			report("%s is required (set %s or %s_FILE)", field, env, env)
+		}
+	}
+	positive := func(ok bool, field string) {
+		if !ok {
+			report("%s must be greater than zero", field)
+		}
+	}
+
+	if c.usesProvider(ProviderGemini) {
+		require(c.Gemini.APIKey, "gemini.api_key", "GEMINI_API_KEY")
+	}
+	require(c.Qdrant.URL, "qdrant.url", "QDRANT_URL")
+	require(c.Qdrant.APIKey, "qdrant.api_key", "QDRANT_API_KEY")
+	require(c.PagerDuty.APIToken, "pagerduty.api_token", "PAGERDUTY_API_TOKEN")
+	require(c.PagerDuty.Email, "pagerduty.email", "PAGERDUTY_EMAIL")
+
+	if c.Gemini.Temperature < 0 || c.Gemini.Temperature > 2 {
+		report("gemini.temperature must be between 0 and 2, got %g", c.Gemini.Temperature)
+	}
+	if c.Gemini.TopP < 0 || c.Gemini.TopP > 1 {
+		report("gemini.top_p must be between 0 and 1, got %g", c.Gemini.TopP)
+	}
+	positive(c.Gemini.TopK > 0, "gemini.top_k")
+	positive(c.Gemini.EmbeddingDimensions > 0, "gemini.embedding_dimensions")
+	positive(c.Gemini.MaxOutputTokens > 0, "gemini.max_output_tokens")
+	positive(c.Gemini.Timeout > 0, "gemini.timeout")
+	positive(c.Gemini.RetryBase > 0, "gemini.retry_base")
+	positive(c.Gemini.RetryMax > 0, "gemini.retry_max")
+	if c.Gemini.MaxRetries < 0 {
+		report("gemini.max_retries must not be negative")
+	}
+	if c.Gemini.RequestsPerMinute < 0 || c.Gemini.TokensPerMinute < 0 {
+		report("gemini.requests_per_minute and gemini.tokens_per_minute must not be negative")
+	}
+	positive(c.Qdrant.TopK > 0, "qdrant.top_k")
+	if c.Qdrant.MaxAgeDays < 0 {
+		report("qdrant.max_age_days must not be negative")
+	}
+	positive(c.HTTPTimeout > 0, "http_timeout")
+	positive(c.Dedup.TTL > 0, "dedup.ttl")
+	positive(c.Jobs.MaxAttempts > 0, "jobs.max_attempts")
+	positive(c.Jobs.RetryBase > 0, "jobs.retry_base")
+	positive(c.Jobs.RetryMax > 0, "jobs.retry_max")
+	positive(c.Jobs.Workers > 0, "jobs.workers")
+	positive(c.Jobs.QueueDepth > 0, "jobs.queue_depth")
+	positive(c.Jobs.RetryAfter > 0, "jobs.retry_after")
+	positive(c.Jobs.DeadLetters > 0, "jobs.dead_letters")
+	positive(c.Jobs.DeadLetterTTL > 0, "jobs.dead_letter_ttl")
+
+	if c.Dedup.Store != "memory" && c.Dedup.Store != "file" {
+		report("dedup.store must be memory or file, got %q", c.Dedup.Store)
+	}
+	switch c.EmbeddingCache.Store {
+	case "memory", "file", "off":
+	default:
+		report("embedding_cache.store must be memory, file or off, got %q", c.EmbeddingCache.Store)
+	}
+	positive(c.EmbeddingCache.Size > 0, "embedding_cache.size")
+	positive(c.PromptBudget.Tokens > 0, "prompt_budget.tokens")
+	if c.PromptBudget.Counter != TokenCounterEstimate && c.PromptBudget.Counter != TokenCounterModel {
+		report("prompt_budget.counter must be estimate or model, got %q", c.PromptBudget.Counter)
+	}
+	if c.Usage.DailyBudget < 0 {
+		report("usage.daily_budget_usd must not be negative")
+	}
+	for model, price := range c.Usage.Prices {
+		if price.Input < 0 || price.Output < 0 {
+			report("usage.prices.%s must not be negative", model)
+		}
+	}
+	if err := validateTriageMode(c.Agent.Mode, false); err != nil {
+		report("agent.%v", err)
+	}
+	positive(c.Agent.MaxSteps > 0, "agent.max_steps")
+	positive(c.Agent.Timeout > 0, "agent.timeout")
+	c.validateAgentProviders(report)
+	for _, route := range SourceRoutes {
+		source := c.Sources.Source(route.Name)
+		if err := validateSinkKind(source); err != nil {
+			report("sources.%s.%v", route.Name, err)
+		}
+		if strings.EqualFold(source.Sink, "pagerduty") {
+			report("sources.%s.sink pagerduty can't take notes: %s incident IDs aren't PagerDuty incident IDs", route.Name, route.Name)
+		}
+	}
+
+	if c.RateLimit.EventsPerMinute < 0 || c.RateLimit.Burst < 0 {
+		report("rate_limit must not be negative")
+	}
+	c.validateTenants(report)
+	c.validateProviders(report)
+
+	if _, err := NewRuleSet(c.Routing); err != nil {
+		report("routing: %v", err)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// validateAgentProviders reports agent mode on a provider without function
+// calling, which only Gemini has
+func (c *Config) validateAgentProviders(report func(format string, args ...interface{})) {
+	if c.Agent.Mode == TriageModeAgent && c.GenerativeProvider != ProviderGemini {
+		report("agent.mode agent needs the gemini generative_provider, got %q", c.GenerativeProvider)
+	}
+	for i, rule := range c.Routing.Rules {
+		mode := firstNonEmpty(rule.Mode, c.Agent.Mode)
+		provider := firstNonEmpty(rule.Provider, c.GenerativeProvider)
+		if mode == TriageModeAgent && provider != ProviderGemini && (rule.Mode != "" || rule.Provider != "") {
+			report("routing.rules[%d]: agent mode needs the gemini provider, got %q", i, provider)
+		}
+	}
+}
+
+// RAGOptions returns the pipeline settings
+func (c *Config) RAGOptions() RAGOptions {
+	return RAGOptions{
+		GeminiAPIKey:        c.Gemini.APIKey,
+		GeminiEndpoint:      c.Gemini.Endpoint,
+		EmbeddingModel:      c.Gemini.EmbeddingModel,
+		EmbeddingDimensions: c.Gemini.EmbeddingDimensions,
+		EmbeddingCache:      c.EmbeddingCache,
+		EmbeddingProvider:   c.EmbeddingProvider,
+		GenerativeProvider:  c.GenerativeProvider,
+		Providers:           c.Providers,
+		GenerativeModel:     c.Gemini.GenerativeModel,
+		FallbackModel:       c.Gemini.FallbackModel,
+		Temperature:         &c.Gemini.Temperature,
+		TopP:                &c.Gemini.TopP,
+		SamplingTopK:        c.Gemini.TopK,
+		MaxOutputTokens:     c.Gemini.MaxOutputTokens,
+		GeminiTimeout:       c.Gemini.Timeout,
+		QdrantURL:           c.Qdrant.URL,
+		QdrantAPIKey:        c.Qdrant.APIKey,
+		Collection:          c.Qdrant.Collection,
+		TopK:                c.Qdrant.TopK,
+		RelatedServices:     c.Qdrant.RelatedServices,
+		MaxIncidentAgeDays:  c.Qdrant.MaxAgeDays,
+		PromptTokenBudget:   c.PromptBudget.Tokens,
+		PromptTokenCounter:  c.PromptBudget.Counter,
+		PagerDutyToken:      c.PagerDuty.APIToken,
+		PagerDutyEmail:      c.PagerDuty.Email,
+		PagerDutyURL:        c.PagerDuty.APIURL,
+		HTTPTimeout:         c.HTTPTimeout,
+		Tenants:             c.Tenants,
+		Routing:             c.Routing,
+		GeminiQuota: GeminiQuota{
+			RequestsPerMinute: c.Gemini.RequestsPerMinute,
+			TokensPerMinute:   c.Gemini.TokensPerMinute,
+		},
+		GeminiRetry: RetryPolicy{
+			MaxRetries: c.Gemini.MaxRetries,
+			Base:       c.Gemini.RetryBase,
+			Max:        c.Gemini.RetryMax,
+		},
+		Usage: c.Usage,
+		Agent: c.Agent,
+		NewSink: func(sink SourceConfig) (NoteSink, error) {
+			return NewNoteSink(c, sink)
+		},
+	}
+}
+
+// applyEnv overrides the fields of v from environment variables named by
+// their env tags. Struct fields' tags are prefixes for the fields inside
+// them; a tag may list alternative names, the first one set wins.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("env")
+		value := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			if err := applyEnv(value, prefix+tag); err != nil {
+				return err
+			}
+			continue
+		}
+		if tag == "" {
+			continue
+		}
+
+		for _, name := range strings.Split(tag, ",") {
+			name = prefix + name
+			raw, err := lookupEnv(name)
+			if err != nil {
+				return err
+			}
+			if raw == "" {
+				continue
+			}
+			if err := setField(value, raw); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns NAME, or the trimmed contents of the file at NAME_FILE
+func lookupEnv(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case []string:
+		field.Set(reflect.ValueOf(SplitSecrets(raw)))
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case int, int32:
+		n, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case float32:
+		f, err := strconv.ParseFloat(raw, 32)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case ModelPrices:
+		prices, err := ParseModelPrices(raw)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(prices))
+	case RelatedServices:
+		related, err := ParseRelatedServices(raw)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(related))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// DatadogPayload is the body of a Datadog monitor webhook. Datadog lets each
+// webhook define its own template; these fields match the template in the README.
+type DatadogPayload struct {
+	ID              string `json:"id"`
+	Title           string `json:"title"`
+	Body            string `json:"body"`
+	AlertID         string `json:"alert_id"`
+	AlertCycleKey   string `json:"alert_cycle_key"`
+	AggregKey       string `json:"aggreg_key"`
+	AlertTransition string `json:"alert_transition"`
+	AlertType       string `json:"alert_type"`
+	AlertPriority   string `json:"alert_priority"`
+	AlertTitle      string `json:"alert_title"`
+	AlertMetric     string `json:"alert_metric"`
+	AlertQuery      string `json:"alert_query"`
+	AlertStatus     string `json:"alert_status"`
+	Hostname        string `json:"hostname"`
+	Tags            string `json:"tags"`
+	Link            string `json:"link"`
+	Snapshot        string `json:"snapshot"`
+}
+
+// datadogTransitions maps the monitor transitions we handle to lifecycle events
+var datadogTransitions = map[string]string{
+	"Triggered":    EventIncidentTriggered,
+	"Re-Triggered": EventIncidentTriggered,
+	"Recovered":    EventIncidentResolved,
+}
+
+// ToEvent maps the webhook onto a lifecycle event. ok is false for warnings,
+// no-data and renotify transitions.
+func (p DatadogPayload) ToEvent() (event Event, ok bool) {
+	eventType, ok := datadogTransitions[p.AlertTransition]
+	if !ok {
+		return Event{}, false
+	}
+
+	// The alert cycle key is shared by a trigger and its recovery
+	id := "dd-" + shortHash(firstNonEmpty(p.AlertCycleKey, p.AlertID+"/"+p.AggregKey))
+
+	tags := p.TagMap()
+	urgency := severityToUrgency(p.AlertType)
+	if rank, known := priorityRank(p.AlertPriority); known && rank <= 2 {
+		urgency = "high"
+	}
+
+	details := map[string]string{}
+	setDetail(details, "monitor_url", p.Link)
+	setDetail(details, "snapshot_url", p.Snapshot)
+	setDetail(details, "metric", p.AlertMetric)
+	setDetail(details, "query", p.AlertQuery)
+	setDetail(details, "value", p.AlertStatus)
+	setDetail(details, "host", p.Hostname)
+	setDetail(details, "tags", p.Tags)
+	if len(details) == 0 {
+		details = nil
+	}
+
+	return Event{
+		ID:       p.ID,
+		Type:     eventType,
+		Priority: p.AlertPriority,
+		Incident: IncidentData{
+			ID:          id,
+			Title:       firstNonEmpty(p.AlertTitle, p.Title),
+			Description: p.Body,
+			Service:     firstNonEmpty(tags["service"], tags["app"], p.Hostname),
+			Urgency:     urgency,
+			Details:     details,
+		},
+	}, true
+}
+
+// TagMap splits the comma-separated "key:value" tag list; bare tags are skipped
+func (p DatadogPayload) TagMap() map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(p.Tags, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(tag), ":")
+		if found && key != "" {
+			if _, seen := tags[key]; !seen {
+				tags[key] = value
+			}
+		}
+	}
+	return tags
+}
+
+// DatadogSource handles Datadog monitor webhooks
+type DatadogSource struct {
+	BearerAuth
+}
+
+func (DatadogSource) Name() string { return "datadog" }
+
+func (DatadogSource) Parse(body []byte) (Event, bool, error) {
+	var payload DatadogPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, false, err
+	}
+	event, ok := payload.ToEvent()
+	return event, ok, nil
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultDedupTTL is how long event and incident IDs are remembered
+const DefaultDedupTTL = 24 * time.Hour
+
+// DedupStore remembers which webhook events and incidents were already handled
+// so PagerDuty's delivery retries don't produce duplicate enrichment notes.
+type DedupStore interface {
+	// Claim records key for the store's TTL and reports whether it was not already held
+	Claim(key string) (bool, error)
+	// Release forgets key so a later attempt can claim it again
+	Release(key string) error
+}
+
+// EventKey is the dedup key for a webhook delivery
+func EventKey(eventID string) string {
+	return "event:" + eventID
+}
+
+// IncidentKey is the dedup key for an incident's enrichment
+func IncidentKey(incidentID string) string {
+	return "incident:" + incidentID
+}
+
+// PostmortemKey is the dedup key for an incident's postmortem draft
+func PostmortemKey(incidentID string) string {
+	return "postmortem:" + incidentID
+}
+
+// PriorityKey is the dedup key for an incident having been seen at a
+// priority rank (P1 = 1)
+func PriorityKey(incidentID string, rank int) string {
+	return "priority:" + incidentID + ":P" + strconv.Itoa(rank)
+}
+
+// NewDedupStore builds the configured store: "memory", or "file" to persist
+// keys at cfg.File
+func NewDedupStore(cfg DedupConfig) (DedupStore, error) {
+	switch cfg.Store {
+	case "", "memory":
+		return NewMemoryDedupStore(cfg.TTL), nil
+	case "file":
+		return NewFileDedupStore(cfg.File, cfg.TTL), nil
+	default:
+		return nil, fmt.Errorf("unknown dedup store %q (expected memory or file)", cfg.Store)
+	}
+}
+
+// ClaimIncident claims the incident's enrichment slot and reports whether the
+// caller should go ahead. A forced replay always goes ahead.
+func ClaimIncident(store DedupStore, incidentID string, force bool) (bool, error) {
+	return claimSlot(store, IncidentKey(incidentID), force)
+}
+
+// ClaimPostmortem claims the incident's postmortem slot the same way, so a
+// redelivered or repeated resolve drafts one postmortem
+func ClaimPostmortem(store DedupStore, incidentID string, force bool) (bool, error) {
+	return claimSlot(store, PostmortemKey(incidentID), force)
+}
+
+// ReleaseDeadLetter returns a JobQueue.OnDeadLetter hook that frees the slot
+// a dead-lettered job's event claimed, so a later event or replay can try
+// again. Replays never claim a slot, so they release nothing.
+func ReleaseDeadLetter(store DedupStore) func(job Job) {
+	return func(job Job) {
+		if store == nil {
+			return
+		}
+		switch job.Kind {
+		case JobEnrich:
+			store.Release(IncidentKey(job.Incident.ID))
+		case JobPostmortem:
+			store.Release(PostmortemKey(job.Incident.ID))
+		}
+	}
+}
+
+func claimSlot(store DedupStore, key string, force bool) (bool, error) {
+	if store == nil {
+		return true, nil
+	}
+
+	claimed, err := store.Claim(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check dedup store: %w", err)
+	}
+
+	return claimed || force, nil
+}
+
+var (
+	dedupStoresMu sync.Mutex
+	dedupStores   = map[DedupConfig]DedupStore{}
+)
+
+// SharedDedupStore returns the process's store for cfg, built on first use,
+// so every handler in a warm Vercel instance sees the same keys. A store that
+// can't be created falls back to memory.
+func SharedDedupStore(cfg DedupConfig) DedupStore {
+	dedupStoresMu.Lock()
+	defer dedupStoresMu.Unlock()
+
+	store, ok := dedupStores[cfg]
+	if !ok {
+		var err error
+		if store, err = NewDedupStore(cfg); err != nil {
+			log.Printf("⚠️  [DEDUP] %v, using in-memory store", err)
+			store = NewMemoryDedupStore(cfg.TTL)
+		}
+		dedupStores[cfg] = store
+	}
+	return store
+}
+
+// MemoryDedupStore keeps keys in process memory
+type MemoryDedupStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	expires map[string]time.Time
+}
+
+func NewMemoryDedupStore(ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		ttl:     dedupTTL(ttl),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryDedupStore) Claim(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return claimKey(m.expires, key, m.ttl), nil
+}
+
+func (m *MemoryDedupStore) Release(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.expires, key)
+	return nil
+}
+
+// FileDedupStore persists keys as JSON so they survive restarts. Each call
+// re-reads and rewrites the file under a file lock, letting several
+// processes on one host share it.
+type FileDedupStore struct {
+	mu   sync.Mutex
+	path string
+	ttl  time.Duration
+}
+
+func NewFileDedupStore(path string, ttl time.Duration) *FileDedupStore {
+	return &FileDedupStore{path: path, ttl: dedupTTL(ttl)}
+}
+
+func (f *FileDedupStore) Claim(key string) (bool, error) {
+	var claimed bool
+	err := f.update(func(expires map[string]time.Time) {
+		claimed = claimKey(expires, key, f.ttl)
+	})
+	return claimed, err
+}
+
+func (f *FileDedupStore) Release(key string) error {
+	return f.update(func(expires map[string]time.Time) {
+		delete(expires, key)
+	})
+}
+
+// update applies change to the stored keys. The read, change and write happen
+// under both the in-process mutex and the file lock.
+func (f *FileDedupStore) update(change func(expires map[string]time.Time)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return withFileLock(f.path, func() error {
+		expires, err := f.load()
+		if err != nil {
+			return err
+		}
+
+		change(expires)
+		return f.save(expires)
+	})
+}
+
+func (f *FileDedupStore) load() (map[string]time.Time, error) {
+	expires := make(map[string]time.Time)
+
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return expires, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dedup file: %w", err)
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &expires); err != nil {
+			return nil, fmt.Errorf("failed to parse dedup file: %w", err)
+		}
+	}
+
+	return expires, nil
+}
+
+func (f *FileDedupStore) save(expires map[string]time.Time) error {
+	data, err := json.Marshal(expires)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dedup entries: %w", err)
+	}
+
+	return writeFileAtomic(f.path, data)
+}
+
+// dedupTTL falls back to DefaultDedupTTL when ttl is unset
+func dedupTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultDedupTTL
+	}
+	return ttl
+}
+
+// claimKey drops expired entries, then claims key if it isn't held
+func claimKey(expires map[string]time.Time, key string, ttl time.Duration) bool {
+	now := time.Now()
+	for k, exp := range expires {
+		if now.After(exp) {
+			delete(expires, k)
+		}
+	}
+
+	if _, held := expires[key]; held {
+		return false
+	}
+
+	expires[key] = now.Add(ttl)
+	return true
+}
+
+// writeFileAtomic replaces path with data via a temp file and rename. The
+// temp file's name is unique, so concurrent writers never share one.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	return nil
+}
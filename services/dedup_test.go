@@ -0,0 +1,228 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testDedupTTL = 50 * time.Millisecond
+
+var errTestDraft = errors.New("draft failed")
+
+// dedupStep is one call in a dedup scenario: claim or release key, or wait
+// for the TTL to pass
+type dedupStep struct {
+	op   string
+	key  string
+	want bool
+}
+
+func TestDedupStoreClaims(t *testing.T) {
+	stores := map[string]func(t *testing.T) DedupStore{
+		"memory": func(t *testing.T) DedupStore { return NewMemoryDedupStore(testDedupTTL) },
+		"file": func(t *testing.T) DedupStore {
+			return NewFileDedupStore(filepath.Join(t.TempDir(), "dedup.json"), testDedupTTL)
+		},
+	}
+
+	tests := []struct {
+		name  string
+		steps []dedupStep
+	}{
+		{
+			name: "first claim wins",
+			steps: []dedupStep{
+				{op: "claim", key: "event:1", want: true},
+				{op: "claim", key: "event:1", want: false},
+			},
+		},
+		{
+			name: "keys are independent",
+			steps: []dedupStep{
+				{op: "claim", key: "event:1", want: true},
+				{op: "claim", key: "incident:1", want: true},
+				{op: "claim", key: "postmortem:1", want: true},
+			},
+		},
+		{
+			name: "release frees the key",
+			steps: []dedupStep{
+				{op: "claim", key: "incident:1", want: true},
+				{op: "release", key: "incident:1"},
+				{op: "claim", key: "incident:1", want: true},
+				{op: "claim", key: "incident:1", want: false},
+			},
+		},
+		{
+			name: "releasing an unheld key is harmless",
+			steps: []dedupStep{
+				{op: "release", key: "incident:1"},
+				{op: "claim", key: "incident:1", want: true},
+			},
+		},
+		{
+			name: "claims expire after the TTL",
+			steps: []dedupStep{
+				{op: "claim", key: "event:1", want: true},
+				{op: "expire"},
+				{op: "claim", key: "event:1", want: true},
+				{op: "claim", key: "event:1", want: false},
+			},
+		},
+	}
+
+	for storeName, newStore := range stores {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				store := newStore(t)
+				for i, step := range tt.steps {
+					switch step.op {
+					case "claim":
+						got, err := store.Claim(step.key)
+						if err != nil {
+							t.Fatalf("step %d: Claim(%s): %v", i, step.key, err)
+						}
+						if got != step.want {
+							t.Fatalf("step %d: Claim(%s) = %v, want %v", i, step.key, got, step.want)
+						}
+					case "release":
+						if err := store.Release(step.key); err != nil {
+							t.Fatalf("step %d: Release(%s): %v", i, step.key, err)
+						}
+					case "expire":
+						time.Sleep(2 * testDedupTTL)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFileDedupStoreSharedAcrossInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+
+	first := NewFileDedupStore(path, time.Hour)
+	if claimed, err := first.Claim("event:1"); err != nil || !claimed {
+		t.Fatalf("first Claim = %v, %v; want true", claimed, err)
+	}
+
+	// A restarted process sees the claim
+	restarted := NewFileDedupStore(path, time.Hour)
+	if claimed, err := restarted.Claim("event:1"); err != nil || claimed {
+		t.Fatalf("Claim after restart = %v, %v; want false", claimed, err)
+	}
+
+	// Stores on one file race for a key and exactly one wins
+	const racers = 8
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		wins int
+	)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := NewFileDedupStore(path, time.Hour).Claim("event:2")
+			if err != nil {
+				t.Errorf("Claim: %v", err)
+				return
+			}
+			if claimed {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("%d of %d racing claims won, want 1", wins, racers)
+	}
+}
+
+func TestClaimIncident(t *testing.T) {
+	tests := []struct {
+		name  string
+		store bool
+		held  bool
+		force bool
+		want  bool
+	}{
+		{name: "no store", want: true},
+		{name: "new incident", store: true, want: true},
+		{name: "already enriched", store: true, held: true, want: false},
+		{name: "forced replay", store: true, held: true, force: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var store DedupStore
+			if tt.store {
+				store = NewMemoryDedupStore(time.Hour)
+				if tt.held {
+					store.Claim(IncidentKey("PINC1"))
+				}
+			}
+
+			got, err := ClaimIncident(store, "PINC1", tt.force)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ClaimIncident() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostmortemDraftActionDraftsOnce(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+		fail   bool
+		want   int
+	}{
+		{
+			name:   "repeated resolve",
+			events: []Event{{ID: "1"}, {ID: "2"}},
+			want:   1,
+		},
+		{
+			name:   "forced replay drafts again",
+			events: []Event{{ID: "1"}, {ID: "2", Force: true}},
+			want:   2,
+		},
+		{
+			name:   "failed draft is retried",
+			events: []Event{{ID: "1"}, {ID: "2"}},
+			fail:   true,
+			want:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drafts := 0
+			action := PostmortemDraftAction(func(IncidentData) error {
+				drafts++
+				if tt.fail {
+					return errTestDraft
+				}
+				return nil
+			}, NewMemoryDedupStore(time.Hour))
+
+			for _, event := range tt.events {
+				event.Type = EventIncidentResolved
+				event.Incident = IncidentData{ID: "am-1"}
+				action(event)
+			}
+			if drafts != tt.want {
+				t.Errorf("drafted %d times, want %d", drafts, tt.want)
+			}
+		})
+	}
+}
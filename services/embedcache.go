@@ -0,0 +1,271 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultEmbeddingCacheSize is how many embeddings the memory cache keeps
+const DefaultEmbeddingCacheSize = 1000
+
+// EmbeddingCache remembers embeddings so repeated alert titles don't pay for
+// a fresh one. Keys come from EmbeddingCacheKey.
+type EmbeddingCache interface {
+	Get(key string) ([]float32, bool)
+	Put(key string, embedding []float32) error
+	Stats() EmbeddingCacheStats
+}
+
+// EmbeddingCacheStats counts cache lookups
+type EmbeddingCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+// EmbeddingCacheKey identifies an embedding by model, task type and a hash of
+// the text with its whitespace collapsed
+func EmbeddingCacheKey(model, taskType, text string) string {
+	sum := sha256.Sum256([]byte(normalizeEmbeddingText(text)))
+	return model + "|" + taskType + "|" + hex.EncodeToString(sum[:])
+}
+
+func normalizeEmbeddingText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// NewEmbeddingCache builds the configured cache for one embedding model:
+// "memory", "file" to keep entries under cfg.Dir, or "off" for none. model
+// should include the output dimensionality (see Embedder.EmbeddingModel),
+// since either change makes the cached vectors useless.
+func NewEmbeddingCache(cfg EmbeddingCacheConfig, model string) (EmbeddingCache, error) {
+	switch cfg.Store {
+	case "off":
+		return nil, nil
+	case "", "memory":
+		return sharedMemoryEmbeddingCache(model, cfg.Size), nil
+	case "file":
+		return NewFileEmbeddingCache(cfg.Dir, model)
+	default:
+		return nil, fmt.Errorf("unknown embedding cache store %q (expected memory, file or off)", cfg.Store)
+	}
+}
+
+// counters tracks hits and misses for both cache kinds
+type counters struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func (c *counters) record(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+var (
+	memoryCachesMu sync.Mutex
+	memoryCaches   = map[string]*MemoryEmbeddingCache{}
+)
+
+// sharedMemoryEmbeddingCache returns the process's cache for model. Vercel
+// builds a pipeline per request, so a warm instance reuses its cache this way.
+func sharedMemoryEmbeddingCache(model string, size int) *MemoryEmbeddingCache {
+	memoryCachesMu.Lock()
+	defer memoryCachesMu.Unlock()
+
+	cache, ok := memoryCaches[model]
+	if !ok {
+		cache = NewMemoryEmbeddingCache(size)
+		memoryCaches[model] = cache
+	}
+	return cache
+}
+
+// CachingEmbedder answers repeated texts from its cache before asking the
+// embedder
+type CachingEmbedder struct {
+	Embedder
+	cache EmbeddingCache
+}
+
+// NewCachingEmbedder puts cache in front of embedder; a nil cache returns
+// embedder unchanged
+func NewCachingEmbedder(embedder Embedder, cache EmbeddingCache) Embedder {
+	if cache == nil {
+		return embedder
+	}
+	return &CachingEmbedder{Embedder: embedder, cache: cache}
+}
+
+func (c *CachingEmbedder) GenerateEmbedding(ctx context.Context, text, taskType string) ([]float32, error) {
+	key := EmbeddingCacheKey(c.EmbeddingModel(), taskType, text)
+	if embedding, ok := c.cache.Get(key); ok {
+		return embedding, nil
+	}
+
+	embedding, err := c.Embedder.GenerateEmbedding(ctx, text, taskType)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.cache.Put(key, embedding); err != nil {
+		log.Printf("⚠️  Failed to cache embedding: %v", err)
+	}
+	return embedding, nil
+}
+
+// CacheStats reports the cache's counters
+func (c *CachingEmbedder) CacheStats() EmbeddingCacheStats {
+	return c.cache.Stats()
+}
+
+// MemoryEmbeddingCache is an LRU of the most recently used embeddings
+type MemoryEmbeddingCache struct {
+	counters
+
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key       string
+	embedding []float32
+}
+
+func NewMemoryEmbeddingCache(size int) *MemoryEmbeddingCache {
+	if size <= 0 {
+		size = DefaultEmbeddingCacheSize
+	}
+	return &MemoryEmbeddingCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryEmbeddingCache) Get(key string) ([]float32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.entries[key]
+	m.record(ok)
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry).embedding, true
+}
+
+func (m *MemoryEmbeddingCache) Put(key string, embedding []float32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.entries[key]; ok {
+		elem.Value.(*memoryCacheEntry).embedding = embedding
+		m.order.MoveToFront(elem)
+		return nil
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryCacheEntry{key: key, embedding: embedding})
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+func (m *MemoryEmbeddingCache) Stats() EmbeddingCacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return EmbeddingCacheStats{Hits: m.hits.Load(), Misses: m.misses.Load(), Entries: m.order.Len()}
+}
+
+// FileEmbeddingCache keeps one JSON file per embedding under dir, so several
+// processes on one host share it and it survives restarts. A MODEL file
+// records which model the entries came from; opening the cache for another
+// model empties it.
+type FileEmbeddingCache struct {
+	counters
+	dir string
+}
+
+// embeddingModelFile names the model the cached entries belong to
+const embeddingModelFile = "MODEL"
+
+func NewFileEmbeddingCache(dir, model string) (*FileEmbeddingCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create embedding cache directory: %w", err)
+	}
+
+	markerPath := filepath.Join(dir, embeddingModelFile)
+	marker, err := os.ReadFile(markerPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read embedding cache model: %w", err)
+	}
+
+	if string(marker) != model {
+		entries, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list embedding cache: %w", err)
+		}
+		if len(entries) > 0 {
+			log.Printf("🧹 Embedding model changed to %s, evicting %d cached embedding(s)", model, len(entries))
+		}
+		for _, entry := range entries {
+			if err := os.Remove(entry); err != nil {
+				return nil, fmt.Errorf("failed to evict cached embedding: %w", err)
+			}
+		}
+		if err := writeFileAtomic(markerPath, []byte(model)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileEmbeddingCache{dir: dir}, nil
+}
+
+func (f *FileEmbeddingCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (f *FileEmbeddingCache) Get(key string) ([]float32, bool) {
+	var embedding []float32
+	data, err := os.ReadFile(f.path(key))
+	ok := err == nil && json.Unmarshal(data, &embedding) == nil
+	f.record(ok)
+	if !ok {
+		return nil, false
+	}
+	return embedding, true
+}
+
+func (f *FileEmbeddingCache) Put(key string, embedding []float32) error {
+	data, err := json.Marshal(embedding)
+	if err != nil {
+		return fmt.Errorf("failed to marshal embedding: %w", err)
+	}
+	return writeFileAtomic(f.path(key), data)
+}
+
+func (f *FileEmbeddingCache) Stats() EmbeddingCacheStats {
+	entries, _ := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	return EmbeddingCacheStats{Hits: f.hits.Load(), Misses: f.misses.Load(), Entries: len(entries)}
+}
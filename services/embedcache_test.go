@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testEmbeddingModel = "models/gemini-embedding-001@768"
+
+func TestFileEmbeddingCacheModelChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		wantKept  bool
+		wantEntry int
+	}{
+		{name: "same model", model: testEmbeddingModel, wantKept: true, wantEntry: 1},
+		{name: "new model", model: "models/text-embedding-005@768"},
+		{name: "new dimensions", model: "models/gemini-embedding-001@3072"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			key := EmbeddingCacheKey(testEmbeddingModel, TaskRetrievalQuery, "checkout errors")
+
+			cache, err := NewFileEmbeddingCache(dir, testEmbeddingModel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cache.Put(key, []float32{1, 2, 3}); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := NewFileEmbeddingCache(dir, tt.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := reopened.Get(key); ok != tt.wantKept {
+				t.Errorf("Get after reopening = %v, want %v", ok, tt.wantKept)
+			}
+			if got := reopened.Stats().Entries; got != tt.wantEntry {
+				t.Errorf("%d entries after reopening, want %d", got, tt.wantEntry)
+			}
+			marker, err := os.ReadFile(filepath.Join(dir, embeddingModelFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(marker) != tt.model {
+				t.Errorf("MODEL = %q, want %q", marker, tt.model)
+			}
+		})
+	}
+}
+
+func TestFileEmbeddingCacheFreshDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "embeddings")
+	cache, err := NewFileEmbeddingCache(dir, testEmbeddingModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cache.Stats().Entries; got != 0 {
+		t.Errorf("%d entries in a fresh cache, want 0", got)
+	}
+	if marker, err := os.ReadFile(filepath.Join(dir, embeddingModelFile)); err != nil || string(marker) != testEmbeddingModel {
+		t.Errorf("MODEL = %q, %v; want %q", marker, err, testEmbeddingModel)
+	}
+}
+
+// countingEmbedder embeds every text as its length and counts the calls
+type countingEmbedder struct {
+	model string
+	calls int
+}
+
+func (e *countingEmbedder) GenerateEmbedding(ctx context.Context, text, taskType string) ([]float32, error) {
+	e.calls++
+	return []float32{float32(len(text))}, nil
+}
+
+func (e *countingEmbedder) EmbeddingModel() string   { return e.model }
+func (e *countingEmbedder) EmbeddingDimensions() int { return 1 }
+
+func TestCachingEmbedder(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     string
+		second    string
+		taskType  string
+		newModel  string
+		wantCalls int
+	}{
+		{name: "repeated text", first: "checkout errors", second: "checkout errors", wantCalls: 1},
+		{name: "whitespace differs", first: "checkout errors", second: "  checkout\n errors ", wantCalls: 1},
+		{name: "other text", first: "checkout errors", second: "cart errors", wantCalls: 2},
+		{name: "other task type", first: "checkout errors", second: "checkout errors", taskType: TaskRetrievalDocument, wantCalls: 2},
+		{name: "model changed", first: "checkout errors", second: "checkout errors", newModel: "models/text-embedding-005@768", wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &countingEmbedder{model: testEmbeddingModel}
+			embedder := NewCachingEmbedder(inner, NewMemoryEmbeddingCache(10))
+
+			first, err := embedder.GenerateEmbedding(context.Background(), tt.first, TaskRetrievalQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.newModel != "" {
+				inner.model = tt.newModel
+			}
+			taskType := TaskRetrievalQuery
+			if tt.taskType != "" {
+				taskType = tt.taskType
+			}
+			second, err := embedder.GenerateEmbedding(context.Background(), tt.second, taskType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if inner.calls != tt.wantCalls {
+				t.Errorf("embedder called %d times, want %d", inner.calls, tt.wantCalls)
+			}
+			if tt.wantCalls == 1 && !reflect.DeepEqual(first, second) {
+				t.Errorf("cached embedding = %v, want %v", second, first)
+			}
+		})
+	}
+}
+
+func TestSharedMemoryEmbeddingCachePerModel(t *testing.T) {
+	cfg := EmbeddingCacheConfig{Store: "memory", Size: 10}
+	first, _ := NewEmbeddingCache(cfg, "models/test-shared@1")
+	again, _ := NewEmbeddingCache(cfg, "models/test-shared@1")
+	other, _ := NewEmbeddingCache(cfg, "models/test-shared@2")
+
+	if first != again {
+		t.Error("the same model got two caches, want one shared")
+	}
+	if first == other {
+		t.Error("a new model reused the old model's cache")
+	}
+}
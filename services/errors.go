@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+)
+
+// APIError is a non-success HTTP response from one of the backing APIs
+type APIError struct {
+	Service    string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s API returned status %d", e.Service, e.StatusCode)
+	}
+	return fmt.Sprintf("%s API returned status %d: %s", e.Service, e.StatusCode, e.Body)
+}
+
+// Ways a model can fail to finish an answer, whatever the provider
+const (
+	// FinishTruncated is an answer cut off at the output token limit
+	FinishTruncated = "truncated"
+	// FinishBlocked is a prompt or answer stopped by a safety filter
+	FinishBlocked = "blocked"
+	// FinishEmpty is a response with no text in it
+	FinishEmpty = "empty"
+	// FinishInvalid is a structured answer that failed validation even
+	// after the model was told what was wrong
+	FinishInvalid = "invalid"
+)
+
+// GenerationError is a model answer that didn't finish. Text holds whatever
+// was generated, which for a truncated answer is usually most of it.
+type GenerationError struct {
+	Service string
+	// Reason is FinishTruncated, FinishBlocked, FinishEmpty or FinishInvalid
+	Reason string
+	// Detail is the provider's own finish or block reason, e.g. SAFETY
+	Detail string
+	Text   string
+}
+
+func (e *GenerationError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s answer %s", e.Service, e.Reason)
+	}
+	return fmt.Sprintf("%s answer %s (%s)", e.Service, e.Reason, e.Detail)
+}
+
+// IsTransient reports whether err is worth retrying: rate limits, server-side
+// failures, timeouts and network errors from Gemini, Qdrant or PagerDuty.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return isTransientStatus(apiErr.StatusCode)
+	}
+
+	var gaxErr *apierror.APIError
+	if errors.As(err, &gaxErr) {
+		if code := gaxErr.HTTPCode(); code > 0 {
+			return isTransientStatus(code)
+		}
+		if status := gaxErr.GRPCStatus(); status != nil {
+			return isTransientCode(status.Code())
+		}
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isTransientStatus(googleErr.Code)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isTransientCode(code codes.Code) bool {
+	switch code {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded,
+		codes.Aborted, codes.Internal:
+		return true
+	}
+	return false
+}
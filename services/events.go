@@ -0,0 +1,243 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Incident lifecycle event types sent by PagerDuty v3 webhooks
+const (
+	EventIncidentTriggered       = "incident.triggered"
+	EventIncidentAcknowledged    = "incident.acknowledged"
+	EventIncidentReassigned      = "incident.reassigned"
+	EventIncidentEscalated       = "incident.escalated"
+	EventIncidentPriorityUpdated = "incident.priority_updated"
+	EventIncidentAnnotated       = "incident.annotated"
+	EventIncidentResolved        = "incident.resolved"
+)
+
+// LifecycleEvents lists every event type the default router acts on
+var LifecycleEvents = []string{
+	EventIncidentTriggered,
+	EventIncidentAcknowledged,
+	EventIncidentReassigned,
+	EventIncidentEscalated,
+	EventIncidentPriorityUpdated,
+	EventIncidentAnnotated,
+	EventIncidentResolved,
+}
+
+var ErrUnhandledEvent = errors.New("no action registered for event type")
+
+// Event is a source-independent incident lifecycle event
+type Event struct {
+	ID         string
+	Type       string
+	OccurredAt string
+	Agent      string
+	Incident   IncidentData
+	Priority   string
+	Assignees  []string
+	Note       string
+
+	// Force bypasses incident dedup. Only operator-authenticated callers
+	// set it; webhook requests never do.
+	Force bool
+
+	// DryRun asks for the note to be returned instead of posted
+	DryRun bool
+}
+
+// EventAction is run by the router for a single event type
+type EventAction func(event Event) error
+
+// IncidentFunc does AI work on an incident, either inline (RAGService.EnrichIncident)
+// or by handing it to a queue (JobQueue.Submit)
+type IncidentFunc func(incident IncidentData) error
+
+// EventRouter maps event types to the action that handles them
+type EventRouter struct {
+	actions map[string]EventAction
+}
+
+func NewEventRouter() *EventRouter {
+	return &EventRouter{
+		actions: make(map[string]EventAction),
+	}
+}
+
+// NewDefaultEventRouter wires the standard action for every lifecycle event.
+// Entrypoints can swap any of them out with Handle.
+func NewDefaultEventRouter(rag *RAGService, dedup DedupStore) *EventRouter {
+	router := NewEventRouter()
+	router.Handle(EventIncidentTriggered, EnrichAction(rag.EnrichIncident, dedup))
+	router.Handle(EventIncidentAcknowledged, LogAction)
+	router.Handle(EventIncidentReassigned, LogAction)
+	router.Handle(EventIncidentEscalated, LogAction)
+	router.Handle(EventIncidentPriorityUpdated, EnrichOnPriorityRaiseAction(rag.EnrichIncident, dedup))
+	router.Handle(EventIncidentAnnotated, LogAction)
+	router.Handle(EventIncidentResolved, PostmortemDraftAction(rag.DraftPostmortem, dedup))
+	return router
+}
+
+// NewAlertEventRouter handles the two events alert sources produce: enrich
+// when an alert fires and draft a postmortem when it resolves
+func NewAlertEventRouter(enrich, draft IncidentFunc, dedup DedupStore) *EventRouter {
+	router := NewEventRouter()
+	router.Handle(EventIncidentTriggered, EnrichAction(enrich, dedup))
+	router.Handle(EventIncidentResolved, PostmortemDraftAction(draft, dedup))
+	return router
+}
+
+// Handle registers action for eventType, replacing any previous action
+func (er *EventRouter) Handle(eventType string, action EventAction) {
+	er.actions[eventType] = action
+}
+
+// Handles reports whether an action is registered for eventType
+func (er *EventRouter) Handles(eventType string) bool {
+	_, ok := er.actions[eventType]
+	return ok
+}
+
+// Dispatch runs the action registered for the event's type
+func (er *EventRouter) Dispatch(event Event) error {
+	action, ok := er.actions[event.Type]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnhandledEvent, event.Type)
+	}
+	return action(event)
+}
+
+// IsLifecycleEvent reports whether eventType is one of LifecycleEvents
+func IsLifecycleEvent(eventType string) bool {
+	for _, known := range LifecycleEvents {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// LogAction records the event without doing anything else
+func LogAction(event Event) error {
+	details := ""
+	if event.Agent != "" {
+		details += " by " + event.Agent
+	}
+	if len(event.Assignees) > 0 {
+		details += " -> " + strings.Join(event.Assignees, ", ")
+	}
+	if event.Priority != "" {
+		details += " (priority " + event.Priority + ")"
+	}
+	TenantLogger(event.Incident.Tenant).Printf("📌 %s: %s%s", event.Type, event.Incident.ID, details)
+	return nil
+}
+
+// EnrichAction enriches the incident once, unless the event is a forced replay
+func EnrichAction(enrich IncidentFunc, dedup DedupStore) EventAction {
+	return func(event Event) error {
+		proceed, err := ClaimIncident(dedup, event.Incident.ID, event.Force)
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			TenantLogger(event.Incident.Tenant).Printf("⏭️  Incident %s already enriched, skipping", event.Incident.ID)
+			return nil
+		}
+
+		if err := enrich(event.Incident); err != nil {
+			if dedup != nil {
+				dedup.Release(IncidentKey(event.Incident.ID))
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// PostmortemDraftAction posts a postmortem draft once the incident is
+// resolved, unless one was already drafted and the event isn't a forced replay
+func PostmortemDraftAction(draft IncidentFunc, dedup DedupStore) EventAction {
+	return func(event Event) error {
+		proceed, err := ClaimPostmortem(dedup, event.Incident.ID, event.Force)
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			TenantLogger(event.Incident.Tenant).Printf("⏭️  Postmortem for incident %s already drafted, skipping", event.Incident.ID)
+			return nil
+		}
+
+		if err := draft(event.Incident); err != nil {
+			if dedup != nil {
+				dedup.Release(PostmortemKey(event.Incident.ID))
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// priorityReenrichThreshold is the lowest priority (P1 = 1) that triggers
+// re-enrichment when the incident's previous priority is unknown
+const priorityReenrichThreshold = 2
+
+// lowestPriorityRank is the least urgent priority PagerDuty ships (P5)
+const lowestPriorityRank = 5
+
+// EnrichOnPriorityRaiseAction re-runs enrichment when an incident's priority goes
+// up. The priorities seen are kept in the dedup store, so repeats and
+// lowerings are a no-op wherever the router was built.
+func EnrichOnPriorityRaiseAction(enrich IncidentFunc, dedup DedupStore) EventAction {
+	return func(event Event) error {
+		rank, ok := priorityRank(event.Priority)
+		if !ok {
+			return LogAction(event)
+		}
+
+		// Seeing the incident at rank claims that priority and every less
+		// urgent one, so only a more urgent priority finds its key free
+		fresh, err := claimSlot(dedup, PriorityKey(event.Incident.ID, rank), false)
+		if err != nil {
+			return err
+		}
+		known := !fresh
+		for lower := rank + 1; lower <= lowestPriorityRank; lower++ {
+			claimed, err := claimSlot(dedup, PriorityKey(event.Incident.ID, lower), false)
+			if err != nil {
+				return err
+			}
+			known = !claimed
+		}
+
+		raised := fresh && (known || rank <= priorityReenrichThreshold)
+		if !raised {
+			return LogAction(event)
+		}
+
+		TenantLogger(event.Incident.Tenant).Printf("⬆️  Priority raised to %s on %s, re-running enrichment", event.Priority, event.Incident.ID)
+		if err := enrich(event.Incident); err != nil {
+			if dedup != nil {
+				dedup.Release(PriorityKey(event.Incident.ID, rank))
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// priorityRank turns "P1".."P5" into 1..5 (lower is more urgent)
+func priorityRank(priority string) (int, bool) {
+	p := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(priority)), "P")
+	rank, err := strconv.Atoi(p)
+	if err != nil || rank < 1 {
+		return 0, false
+	}
+	return rank, true
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnrichOnPriorityRaise(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []string
+		want       []bool
+	}{
+		{name: "first seen urgent", priorities: []string{"P1"}, want: []bool{true}},
+		{name: "first seen low", priorities: []string{"P3"}, want: []bool{false}},
+		{name: "raise", priorities: []string{"P4", "P3", "P1"}, want: []bool{false, true, true}},
+		{name: "repeat", priorities: []string{"P2", "P2"}, want: []bool{true, false}},
+		{name: "lower", priorities: []string{"P1", "P2", "P3"}, want: []bool{true, false, false}},
+		{name: "lower then raise back", priorities: []string{"P2", "P4", "P2"}, want: []bool{true, false, false}},
+		{name: "no priority", priorities: []string{""}, want: []bool{false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryDedupStore(time.Hour)
+
+			for i, priority := range tt.priorities {
+				// Vercel builds a router per request; only the store is shared
+				enriched := false
+				router := NewEventRouter()
+				router.Handle(EventIncidentPriorityUpdated, EnrichOnPriorityRaiseAction(func(IncidentData) error {
+					enriched = true
+					return nil
+				}, store))
+
+				event := Event{Type: EventIncidentPriorityUpdated, Priority: priority, Incident: IncidentData{ID: "PINC1"}}
+				if err := router.Dispatch(event); err != nil {
+					t.Fatal(err)
+				}
+				if enriched != tt.want[i] {
+					t.Errorf("event %d (%q): enriched = %v, want %v", i, priority, enriched, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEnrichOnPriorityRaiseRetriesFailedEnrichment(t *testing.T) {
+	store := NewMemoryDedupStore(time.Hour)
+	calls := 0
+	action := EnrichOnPriorityRaiseAction(func(IncidentData) error {
+		calls++
+		if calls == 1 {
+			return errTestDraft
+		}
+		return nil
+	}, store)
+
+	event := Event{Type: EventIncidentPriorityUpdated, Priority: "P1", Incident: IncidentData{ID: "PINC1"}}
+	if err := action(event); err == nil {
+		t.Fatal("first enrichment succeeded, want its error")
+	}
+	if err := action(event); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("enriched %d times, want a retry after the failure", calls)
+	}
+}
@@ -1,104 +1,711 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
 )
 
+// defaultGeminiEndpoint is the REST base URL embeddings are sent to
+const defaultGeminiEndpoint = "https://generativelanguage.googleapis.com"
+
 type GeminiService struct {
-	client *genai.Client
-	ctx    context.Context
+	client     *genai.Client
+	ctx        context.Context
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+
+	embeddingModel      string
+	embeddingDimensions int
+	generativeModel     string
+	temperature         float32
+	topP                float32
+	topK                int32
+	maxOutputTokens     int32
+	timeout             time.Duration
+
+	// limiter and retry govern every call, embedding or generation
+	limiter *callLimiter
+	retry   RetryPolicy
+
+	// meter records each call's tokens and logger tags retries with the
+	// tenant; see RAGService.metered
+	meter  *UsageMeter
+	logger *log.Logger
 }
 
-func NewGeminiService() (*GeminiService, error) {
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
+// NewGeminiService creates a client for the models named in opts
+func NewGeminiService(opts RAGOptions) (*GeminiService, error) {
+	if opts.GeminiAPIKey == "" {
 		return nil, fmt.Errorf("GEMINI_API_KEY is required")
 	}
+	opts = opts.withDefaults()
+
+	clientOpts := []option.ClientOption{option.WithAPIKey(opts.GeminiAPIKey)}
+	if opts.GeminiEndpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(opts.GeminiEndpoint))
+	}
 
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	client, err := genai.NewClient(ctx, clientOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
 	}
 
+	baseURL := defaultGeminiEndpoint
+	if opts.GeminiEndpoint != "" {
+		baseURL = strings.TrimSuffix(opts.GeminiEndpoint, "/")
+	}
+
 	return &GeminiService{
-		client: client,
-		ctx:    ctx,
+		client:              client,
+		ctx:                 ctx,
+		apiKey:              opts.GeminiAPIKey,
+		baseURL:             baseURL,
+		httpClient:          &http.Client{},
+		embeddingModel:      opts.EmbeddingModel,
+		embeddingDimensions: opts.EmbeddingDimensions,
+		generativeModel:     opts.GenerativeModel,
+		temperature:         *opts.Temperature,
+		topP:                *opts.TopP,
+		topK:                opts.SamplingTopK,
+		maxOutputTokens:     opts.MaxOutputTokens,
+		timeout:             opts.GeminiTimeout,
+		limiter:             sharedGeminiLimiter(opts.GeminiAPIKey, opts.GeminiQuota),
+		retry:               opts.GeminiRetry,
+		logger:              log.Default(),
 	}, nil
 }
 
-// GenerateEmbedding creates a vector embedding for the given text
-func (g *GeminiService) GenerateEmbedding(text string, taskType string) ([]float32, error) {
-	embeddingModel := os.Getenv("EMBEDDING_MODEL")
-	if embeddingModel == "" {
-		embeddingModel = "models/text-embedding-004"
-	}
+// Embedding task types understood by the Gemini embedContent API
+const (
+	TaskRetrievalQuery     = "RETRIEVAL_QUERY"
+	TaskRetrievalDocument  = "RETRIEVAL_DOCUMENT"
+	TaskSemanticSimilarity = "SEMANTIC_SIMILARITY"
+	TaskClassification     = "CLASSIFICATION"
+	TaskClustering         = "CLUSTERING"
+)
+
+// MaxEmbeddingBatch is the most texts batchEmbedContents accepts per call
+const MaxEmbeddingBatch = 100
+
+// embedContentRequest is the REST body for models/*:embedContent. The Go SDK
+// can't send outputDimensionality, so embeddings call the API directly.
+type embedContentRequest struct {
+	Model                string       `json:"model"`
+	Content              embedContent `json:"content"`
+	TaskType             string       `json:"taskType,omitempty"`
+	Title                string       `json:"title,omitempty"`
+	OutputDimensionality int          `json:"outputDimensionality,omitempty"`
+}
+
+type embedContent struct {
+	Parts []embedPart `json:"parts"`
+}
+
+type embedPart struct {
+	Text string `json:"text"`
+}
+
+type embeddingValues struct {
+	Values []float32 `json:"values"`
+}
+
+type embedContentResponse struct {
+	Embedding embeddingValues `json:"embedding"`
+}
+
+type batchEmbedRequest struct {
+	Requests []embedContentRequest `json:"requests"`
+}
+
+type batchEmbedResponse struct {
+	Embeddings []embeddingValues `json:"embeddings"`
+}
+
+// EmbeddingFailure is one input GenerateEmbeddings could not embed
+type EmbeddingFailure struct {
+	Index int
+	Err   error
+}
+
+// BatchEmbeddingError lists the inputs of a GenerateEmbeddings call that
+// failed; the others were embedded
+type BatchEmbeddingError struct {
+	Total    int
+	Failures []EmbeddingFailure
+}
+
+func (e *BatchEmbeddingError) Error() string {
+	return fmt.Sprintf("%d of %d embeddings failed, first at index %d: %v",
+		len(e.Failures), e.Total, e.Failures[0].Index, e.Failures[0].Err)
+}
 
-	em := g.client.EmbeddingModel(embeddingModel)
+// Unwrap exposes each failure's cause to errors.Is and errors.As
+func (e *BatchEmbeddingError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, failure := range e.Failures {
+		errs[i] = failure.Err
+	}
+	return errs
+}
 
-	// Set task type for better embeddings
-	var task genai.TaskType
+// normalizeTaskType sends an unknown task type as RETRIEVAL_QUERY
+func normalizeTaskType(taskType string) string {
 	switch taskType {
-	case "RETRIEVAL_QUERY":
-		task = genai.TaskTypeRetrievalQuery
-	case "RETRIEVAL_DOCUMENT":
-		task = genai.TaskTypeRetrievalDocument
-	default:
-		task = genai.TaskTypeRetrievalQuery
+	case TaskRetrievalQuery, TaskRetrievalDocument, TaskSemanticSimilarity, TaskClassification, TaskClustering:
+		return taskType
 	}
+	return TaskRetrievalQuery
+}
 
-	res, err := em.EmbedContent(g.ctx, genai.Text(text))
+// GenerateEmbedding creates a vector embedding for the given text. An
+// unknown taskType is sent as RETRIEVAL_QUERY.
+func (g *GeminiService) GenerateEmbedding(ctx context.Context, text string, taskType string) ([]float32, error) {
+	return g.embedOne(ctx, g.embedRequest(text, normalizeTaskType(taskType), ""))
+}
+
+// GenerateDocumentEmbedding embeds a document the way ingest_incidents.py
+// does: as RETRIEVAL_DOCUMENT, with its title
+func (g *GeminiService) GenerateDocumentEmbedding(title, text string) ([]float32, error) {
+	return g.embedOne(g.ctx, g.embedRequest(text, TaskRetrievalDocument, title))
+}
+
+// GenerateEmbeddings embeds texts through batchEmbedContents, MaxEmbeddingBatch
+// at a time. The result lines up with texts; when some fail their entries
+// are nil and the error is a *BatchEmbeddingError naming them.
+func (g *GeminiService) GenerateEmbeddings(ctx context.Context, texts []string, taskType string) ([][]float32, error) {
+	taskType = normalizeTaskType(taskType)
+	embeddings := make([][]float32, len(texts))
+	batchErr := &BatchEmbeddingError{Total: len(texts)}
+
+	for start := 0; start < len(texts); start += MaxEmbeddingBatch {
+		end := start + MaxEmbeddingBatch
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		batch := batchEmbedRequest{Requests: make([]embedContentRequest, 0, end-start)}
+		tokens := 0
+		for _, text := range texts[start:end] {
+			batch.Requests = append(batch.Requests, g.embedRequest(text, taskType, ""))
+			tokens += EstimateTokens(text)
+		}
+
+		var resp batchEmbedResponse
+		err := g.postEmbedding(ctx, "batchEmbedContents", tokens, batch, &resp)
+		if err == nil && len(resp.Embeddings) != end-start {
+			err = fmt.Errorf("batch returned %d embeddings for %d texts", len(resp.Embeddings), end-start)
+		}
+		if err != nil {
+			for i := start; i < end; i++ {
+				batchErr.Failures = append(batchErr.Failures, EmbeddingFailure{Index: i, Err: err})
+			}
+			continue
+		}
+
+		for i, embedding := range resp.Embeddings {
+			if err := g.checkDimensions(embedding.Values); err != nil {
+				batchErr.Failures = append(batchErr.Failures, EmbeddingFailure{Index: start + i, Err: err})
+				continue
+			}
+			embeddings[start+i] = embedding.Values
+		}
+	}
+
+	if len(batchErr.Failures) > 0 {
+		return embeddings, batchErr
+	}
+	return embeddings, nil
+}
+
+// EmbeddingModel identifies the embedding model and size
+func (g *GeminiService) EmbeddingModel() string {
+	return embeddingFingerprint(g.embeddingModel, g.embeddingDimensions)
+}
+
+// EmbeddingDimensions is the vector size every embedding is requested at
+func (g *GeminiService) EmbeddingDimensions() int {
+	return g.embeddingDimensions
+}
+
+func (g *GeminiService) embedRequest(text, taskType, title string) embedContentRequest {
+	return embedContentRequest{
+		Model:                g.embeddingModelPath(),
+		Content:              embedContent{Parts: []embedPart{{Text: text}}},
+		TaskType:             taskType,
+		Title:                title,
+		OutputDimensionality: g.embeddingDimensions,
+	}
+}
+
+func (g *GeminiService) embedOne(ctx context.Context, embedReq embedContentRequest) ([]float32, error) {
+	var resp embedContentResponse
+	if err := g.postEmbedding(ctx, "embedContent", EstimateTokens(embedReq.Content.Parts[0].Text), embedReq, &resp); err != nil {
+		return nil, err
+	}
+	if err := g.checkDimensions(resp.Embedding.Values); err != nil {
+		return nil, err
+	}
+	return resp.Embedding.Values, nil
+}
+
+// embeddingModelPath is the model as the REST API names it, e.g. models/x
+func (g *GeminiService) embeddingModelPath() string {
+	return modelPath(g.embeddingModel)
+}
+
+func modelPath(model string) string {
+	if strings.HasPrefix(model, "models/") {
+		return model
+	}
+	return "models/" + model
+}
+
+// embeddingFingerprint names the vectors a model produces; cached embeddings
+// are only reused while it stays the same
+func embeddingFingerprint(model string, dimensions int) string {
+	return fmt.Sprintf("%s@%d", modelPath(model), dimensions)
+}
+
+func (g *GeminiService) checkDimensions(values []float32) error {
+	return checkEmbeddingSize(values, g.embeddingDimensions)
+}
+
+// postEmbedding calls the embedding model's REST method, bounded by the
+// Gemini timeout
+func (g *GeminiService) postEmbedding(ctx context.Context, method string, tokens int, body, out interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal embedding request: %w", err)
+	}
+
+	err = g.retry.call(ctx, g.logger, "Gemini", g.limiter, g.timeout, tokens, func(ctx context.Context) error {
+		return g.postEmbeddingOnce(ctx, method, jsonData, out)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The embedding API reports no usage, so the estimate is what's recorded
+	g.meter.Record(g.embeddingModel, tokens, 0, true)
+	return nil
+}
+
+func (g *GeminiService) postEmbeddingOnce(ctx context.Context, method string, jsonData []byte, out interface{}) error {
+	return g.postModel(ctx, g.embeddingModelPath(), method, "generate embedding", jsonData, out)
+}
+
+// postModel sends one REST call to a model method, such as embedContent;
+// action names it in errors
+func (g *GeminiService) postModel(ctx context.Context, model, method, action string, jsonData []byte, out interface{}) error {
+	url := fmt.Sprintf("%s/v1beta/%s:%s", g.baseURL, model, method)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", g.apiKey)
 
-	// Note: TaskType and OutputDimensionality may not be supported in older SDK versions
-	// If needed, use the REST API directly or update SDK
-	_ = task // Suppress unused variable warning for now
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", action, err)
+	}
+	defer resp.Body.Close()
 
-	return res.Embedding.Values, nil
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to %s: %w", action, &APIError{Service: "Gemini", StatusCode: resp.StatusCode, Body: string(respBody)})
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+	return nil
 }
 
 // GenerateContext uses Gemini to generate AI triage context
 func (g *GeminiService) GenerateContext(prompt string) (string, error) {
-	generativeModel := os.Getenv("GENERATIVE_MODEL")
-	if generativeModel == "" {
-		generativeModel = "gemini-2.0-flash-exp"
+	return g.GenerateContextWithModel(g.generativeModel, prompt)
+}
+
+// Generate completes prompt with model, or the default model when empty
+func (g *GeminiService) Generate(model, prompt string) (string, error) {
+	if model == "" {
+		model = g.generativeModel
+	}
+	return g.GenerateContextWithModel(model, prompt)
+}
+
+// GenerateContextWithModel generates with the named model instead of the default
+func (g *GeminiService) GenerateContextWithModel(modelName, prompt string) (string, error) {
+	return g.generate(modelName, g.client.GenerativeModel(modelName), prompt)
+}
+
+// GenerateJSON generates a JSON document held to schema by the API
+func (g *GeminiService) GenerateJSON(modelName, prompt string, schema *Schema) (string, error) {
+	if modelName == "" {
+		modelName = g.generativeModel
+	}
+	model := g.client.GenerativeModel(modelName)
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = schema.genai()
+	return g.generate(modelName, model, prompt)
+}
+
+// CountTokens measures text with the model's tokenizer
+func (g *GeminiService) CountTokens(modelName, text string) (int, error) {
+	if modelName == "" {
+		modelName = g.generativeModel
+	}
+
+	var resp *genai.CountTokensResponse
+	err := g.retry.call(g.ctx, g.logger, "Gemini", g.limiter, g.timeout, 0, func(ctx context.Context) error {
+		var err error
+		resp, err = g.client.GenerativeModel(modelName).CountTokens(ctx, genai.Text(text))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count tokens: %w", err)
 	}
+	return int(resp.TotalTokens), nil
+}
 
-	model := g.client.GenerativeModel(generativeModel)
+// genai converts the schema to the SDK's form
+func (s *Schema) genai() *genai.Schema {
+	if s == nil {
+		return nil
+	}
 
+	types := map[string]genai.Type{
+		"object":  genai.TypeObject,
+		"array":   genai.TypeArray,
+		"string":  genai.TypeString,
+		"number":  genai.TypeNumber,
+		"integer": genai.TypeInteger,
+		"boolean": genai.TypeBoolean,
+	}
+	schema := &genai.Schema{
+		Type:        types[s.Type],
+		Description: s.Description,
+		Enum:        s.Enum,
+		Items:       s.Items.genai(),
+		Required:    s.Required,
+	}
+	if len(s.Enum) > 0 {
+		schema.Format = "enum"
+	}
+	if len(s.Properties) > 0 {
+		schema.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for name, property := range s.Properties {
+			schema.Properties[name] = property.genai()
+		}
+	}
+	return schema
+}
+
+// configure sets the sampling settings on model
+func (g *GeminiService) configure(model *genai.GenerativeModel) {
 	// Configure model for concise responses
-	model.SetTemperature(0.7)
-	model.SetTopP(0.95)
-	model.SetTopK(40)
-	model.SetMaxOutputTokens(1024)
+	model.SetTemperature(g.temperature)
+	model.SetTopP(g.topP)
+	model.SetTopK(g.topK)
+	model.SetMaxOutputTokens(g.maxOutputTokens)
+}
+
+func (g *GeminiService) generate(modelName string, model *genai.GenerativeModel, prompt string) (string, error) {
+	g.configure(model)
 
-	resp, err := model.GenerateContent(g.ctx, genai.Text(prompt))
+	// The output limit counts against the tokens-per-minute quota up front
+	var resp *genai.GenerateContentResponse
+	tokens := EstimateTokens(prompt) + int(g.maxOutputTokens)
+	err := g.retry.call(g.ctx, g.logger, "Gemini", g.limiter, g.timeout, tokens, func(ctx context.Context) error {
+		var err error
+		resp, err = model.GenerateContent(ctx, genai.Text(prompt))
+		return err
+	})
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		// The SDK drops the usage of a blocked response, but the prompt is
+		// still billed
+		g.meter.Record(modelName, EstimateTokens(prompt), 0, true)
+		return "", &GenerationError{Service: "Gemini", Reason: FinishBlocked, Detail: blockReason(blocked)}
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to generate content: %w", err)
 	}
 
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return "", fmt.Errorf("no content generated")
+	if usage := resp.UsageMetadata; usage != nil {
+		g.meter.Record(modelName, int(usage.PromptTokenCount), int(usage.CandidatesTokenCount), false)
+	} else {
+		g.meter.Record(modelName, EstimateTokens(prompt), 0, true)
+	}
+
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return "", &GenerationError{Service: "Gemini", Reason: FinishEmpty}
 	}
+	candidate := resp.Candidates[0]
 
 	// Extract text from response
 	result := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
+	for _, part := range candidate.Content.Parts {
 		if txt, ok := part.(genai.Text); ok {
 			result += string(txt)
 		}
 	}
 
+	switch reason := candidate.FinishReason; {
+	case reason == genai.FinishReasonMaxTokens:
+		return "", &GenerationError{Service: "Gemini", Reason: FinishTruncated, Detail: "MAX_TOKENS", Text: result}
+	case hasBlockedRating(candidate.SafetyRatings):
+		return "", &GenerationError{Service: "Gemini", Reason: FinishBlocked, Detail: finishReasonName(reason), Text: result}
+	case strings.TrimSpace(result) == "":
+		// Block reasons newer than the SDK (BLOCKLIST, SPII, ...) arrive as
+		// an unspecified finish reason with no text
+		return "", &GenerationError{Service: "Gemini", Reason: FinishEmpty, Detail: finishReasonName(reason)}
+	}
+
 	return result, nil
 }
 
+// generateContentRequest is the REST body for models/*:generateContent. The
+// SDK only sends a multi-turn conversation as a streamed chat, so function
+// calling calls the API directly.
+type generateContentRequest struct {
+	Contents         []geminiContent        `json:"contents"`
+	Tools            []geminiTool           `json:"tools,omitempty"`
+	ToolConfig       *geminiToolConfig      `json:"toolConfig,omitempty"`
+	GenerationConfig geminiGenerationConfig `json:"generationConfig"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiFunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Parameters  *Schema `json:"parameters,omitempty"`
+}
+
+type geminiToolConfig struct {
+	FunctionCallingConfig geminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type geminiFunctionCallingConfig struct {
+	Mode string `json:"mode"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature     float32 `json:"temperature"`
+	TopP            float32 `json:"topP"`
+	TopK            int32   `json:"topK"`
+	MaxOutputTokens int32   `json:"maxOutputTokens"`
+	CandidateCount  int32   `json:"candidateCount"`
+}
+
+type generateContentResponse struct {
+	Candidates []struct {
+		Content       *geminiContent `json:"content"`
+		FinishReason  string         `json:"finishReason"`
+		SafetyRatings []struct {
+			Blocked bool `json:"blocked"`
+		} `json:"safetyRatings"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// CallTools sends an agent conversation with the tools declared as functions
+func (g *GeminiService) CallTools(ctx context.Context, req ToolRequest) (AgentMessage, error) {
+	modelName := req.Model
+	if modelName == "" {
+		modelName = g.generativeModel
+	}
+
+	body := generateContentRequest{
+		GenerationConfig: geminiGenerationConfig{
+			Temperature:     g.temperature,
+			TopP:            g.topP,
+			TopK:            g.topK,
+			MaxOutputTokens: g.maxOutputTokens,
+			CandidateCount:  1,
+		},
+	}
+	var tokens int
+	body.Contents, tokens = geminiHistory(req.Conversation)
+
+	tool := geminiTool{FunctionDeclarations: make([]geminiFunctionDeclaration, 0, len(req.Tools))}
+	for _, spec := range req.Tools {
+		tool.FunctionDeclarations = append(tool.FunctionDeclarations, geminiFunctionDeclaration{
+			Name:        spec.Name,
+			Description: spec.Description,
+			Parameters:  spec.Parameters,
+		})
+	}
+	body.Tools = []geminiTool{tool}
+	if req.Final {
+		body.ToolConfig = &geminiToolConfig{FunctionCallingConfig: geminiFunctionCallingConfig{Mode: "NONE"}}
+	}
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return AgentMessage{}, fmt.Errorf("failed to marshal generation request: %w", err)
+	}
+
+	var resp generateContentResponse
+	err = g.retry.call(ctx, g.logger, "Gemini", g.limiter, g.timeout, tokens+int(g.maxOutputTokens), func(ctx context.Context) error {
+		resp = generateContentResponse{}
+		return g.postModel(ctx, modelPath(modelName), "generateContent", "generate content", jsonData, &resp)
+	})
+	if err != nil {
+		return AgentMessage{}, err
+	}
+
+	if usage := resp.UsageMetadata; usage != nil {
+		g.meter.Record(modelName, usage.PromptTokenCount, usage.CandidatesTokenCount, false)
+	} else {
+		g.meter.Record(modelName, tokens, 0, true)
+	}
+
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		return AgentMessage{}, &GenerationError{Service: "Gemini", Reason: FinishBlocked, Detail: "prompt " + resp.PromptFeedback.BlockReason}
+	}
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return AgentMessage{}, &GenerationError{Service: "Gemini", Reason: FinishEmpty}
+	}
+	candidate := resp.Candidates[0]
+
+	msg := AgentMessage{Role: AgentRoleModel}
+	for _, part := range candidate.Content.Parts {
+		msg.Text += part.Text
+		if part.FunctionCall != nil {
+			msg.Calls = append(msg.Calls, ToolCall{Name: part.FunctionCall.Name, Args: part.FunctionCall.Args})
+		}
+	}
+
+	blocked := candidate.FinishReason == "SAFETY" || candidate.FinishReason == "RECITATION"
+	for _, rating := range candidate.SafetyRatings {
+		blocked = blocked || rating.Blocked
+	}
+	switch {
+	case blocked:
+		return AgentMessage{}, &GenerationError{Service: "Gemini", Reason: FinishBlocked, Detail: candidate.FinishReason, Text: msg.Text}
+	case len(msg.Calls) > 0:
+		return msg, nil
+	case candidate.FinishReason == "MAX_TOKENS":
+		return AgentMessage{}, &GenerationError{Service: "Gemini", Reason: FinishTruncated, Detail: "MAX_TOKENS", Text: msg.Text}
+	case strings.TrimSpace(msg.Text) == "":
+		return AgentMessage{}, &GenerationError{Service: "Gemini", Reason: FinishEmpty, Detail: candidate.FinishReason}
+	}
+	return msg, nil
+}
+
+// geminiHistory converts an agent conversation to Gemini contents. Tool
+// results go back as function responses in a user turn. It also estimates
+// the conversation's tokens, for the rate limiter.
+func geminiHistory(conversation []AgentMessage) ([]geminiContent, int) {
+	history := make([]geminiContent, 0, len(conversation))
+	tokens := 0
+	for _, msg := range conversation {
+		content := geminiContent{Role: "user"}
+		if msg.Role == AgentRoleModel {
+			content.Role = "model"
+		}
+		if msg.Text != "" {
+			content.Parts = append(content.Parts, geminiPart{Text: msg.Text})
+			tokens += EstimateTokens(msg.Text)
+		}
+		for _, call := range msg.Calls {
+			content.Parts = append(content.Parts, geminiPart{FunctionCall: &geminiFunctionCall{Name: call.Name, Args: call.Args}})
+		}
+		for _, result := range msg.Results {
+			response := map[string]interface{}{"error": result.Error}
+			if result.Error == "" {
+				var output interface{}
+				_ = json.Unmarshal(result.Output, &output)
+				response = map[string]interface{}{"result": output}
+			}
+			content.Parts = append(content.Parts, geminiPart{FunctionResponse: &geminiFunctionResponse{Name: result.Name, Response: response}})
+			tokens += EstimateTokens(string(result.Output))
+		}
+		history = append(history, content)
+	}
+	return history, tokens
+}
+
+// blockReason names what stopped a blocked prompt or candidate
+func blockReason(err *genai.BlockedError) string {
+	if err.PromptFeedback != nil {
+		return "prompt " + strings.ToUpper(strings.TrimPrefix(err.PromptFeedback.BlockReason.String(), "BlockReason"))
+	}
+	if err.Candidate != nil {
+		return finishReasonName(err.Candidate.FinishReason)
+	}
+	return ""
+}
+
+// finishReasonName spells a finish reason the way the API does
+func finishReasonName(reason genai.FinishReason) string {
+	names := map[genai.FinishReason]string{
+		genai.FinishReasonStop:       "STOP",
+		genai.FinishReasonMaxTokens:  "MAX_TOKENS",
+		genai.FinishReasonSafety:     "SAFETY",
+		genai.FinishReasonRecitation: "RECITATION",
+		genai.FinishReasonOther:      "OTHER",
+	}
+	return names[reason]
+}
+
+func hasBlockedRating(ratings []*genai.SafetyRating) bool {
+	for _, rating := range ratings {
+		if rating != nil && rating.Blocked {
+			return true
+		}
+	}
+	return false
+}
+
 func (g *GeminiService) Close() {
 	g.client.Close()
 }
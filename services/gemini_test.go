@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// embeddingStub answers batchEmbedContents with one vector per input whose
+// first value is the input's number, so tests can check the order
+type embeddingStub struct {
+	mu      sync.Mutex
+	batches []int
+	// failBatch answers that batch, counted from 0, with a 400
+	failBatch int
+	// shortBatch returns one embedding too few for that batch
+	shortBatch int
+	// wrongSize returns a vector of the wrong size for that input
+	wrongSize int
+}
+
+func (s *embeddingStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, ":batchEmbedContents") {
+		http.NotFound(w, r)
+		return
+	}
+	var req batchEmbedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	batch := len(s.batches)
+	s.batches = append(s.batches, len(req.Requests))
+	s.mu.Unlock()
+
+	if batch == s.failBatch {
+		http.Error(w, "bad batch", http.StatusBadRequest)
+		return
+	}
+	var resp batchEmbedResponse
+	for _, embedReq := range req.Requests {
+		n, _ := strconv.Atoi(strings.TrimPrefix(embedReq.Content.Parts[0].Text, "text "))
+		values := []float32{float32(n), 0, 0}
+		if n == s.wrongSize {
+			values = values[:2]
+		}
+		resp.Embeddings = append(resp.Embeddings, embeddingValues{Values: values})
+	}
+	if batch == s.shortBatch {
+		resp.Embeddings = resp.Embeddings[1:]
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestGenerateEmbeddings(t *testing.T) {
+	tests := []struct {
+		name        string
+		texts       int
+		stub        *embeddingStub
+		wantBatches []int
+		wantFailed  []int
+	}{
+		{
+			name:        "single batch",
+			texts:       3,
+			stub:        &embeddingStub{failBatch: -1, shortBatch: -1, wrongSize: -1},
+			wantBatches: []int{3},
+		},
+		{
+			name:        "chunked at the batch limit",
+			texts:       2*MaxEmbeddingBatch + 50,
+			stub:        &embeddingStub{failBatch: -1, shortBatch: -1, wrongSize: -1},
+			wantBatches: []int{MaxEmbeddingBatch, MaxEmbeddingBatch, 50},
+		},
+		{
+			name:        "exactly the batch limit",
+			texts:       MaxEmbeddingBatch,
+			stub:        &embeddingStub{failBatch: -1, shortBatch: -1, wrongSize: -1},
+			wantBatches: []int{MaxEmbeddingBatch},
+		},
+		{
+			name:        "failed batch",
+			texts:       MaxEmbeddingBatch + 10,
+			stub:        &embeddingStub{failBatch: 1, shortBatch: -1, wrongSize: -1},
+			wantBatches: []int{MaxEmbeddingBatch, 10},
+			wantFailed:  indexRange(MaxEmbeddingBatch, MaxEmbeddingBatch+10),
+		},
+		{
+			name:        "short batch",
+			texts:       MaxEmbeddingBatch + 10,
+			stub:        &embeddingStub{failBatch: -1, shortBatch: 0, wrongSize: -1},
+			wantBatches: []int{MaxEmbeddingBatch, 10},
+			wantFailed:  indexRange(0, MaxEmbeddingBatch),
+		},
+		{
+			name:        "wrong size",
+			texts:       MaxEmbeddingBatch + 10,
+			stub:        &embeddingStub{failBatch: -1, shortBatch: -1, wrongSize: 104},
+			wantBatches: []int{MaxEmbeddingBatch, 10},
+			wantFailed:  []int{104},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.stub)
+			defer server.Close()
+
+			gemini, err := NewGeminiService(RAGOptions{
+				GeminiAPIKey:        "test-key",
+				GeminiEndpoint:      server.URL,
+				EmbeddingDimensions: 3,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gemini.Close()
+
+			texts := make([]string, tt.texts)
+			for i := range texts {
+				texts[i] = "text " + strconv.Itoa(i)
+			}
+			embeddings, err := gemini.GenerateEmbeddings(context.Background(), texts, TaskRetrievalDocument)
+
+			if !reflect.DeepEqual(tt.stub.batches, tt.wantBatches) {
+				t.Errorf("batches = %v, want %v", tt.stub.batches, tt.wantBatches)
+			}
+			if len(embeddings) != tt.texts {
+				t.Fatalf("got %d embeddings for %d texts", len(embeddings), tt.texts)
+			}
+
+			var failed []int
+			if err != nil {
+				var batchErr *BatchEmbeddingError
+				if !errors.As(err, &batchErr) {
+					t.Fatalf("err = %v, want a *BatchEmbeddingError", err)
+				}
+				if batchErr.Total != tt.texts {
+					t.Errorf("Total = %d, want %d", batchErr.Total, tt.texts)
+				}
+				for _, failure := range batchErr.Failures {
+					failed = append(failed, failure.Index)
+				}
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("failed indices = %v, want %v", failed, tt.wantFailed)
+			}
+
+			// Every embedding that didn't fail is the one for its own text
+			for i, embedding := range embeddings {
+				if containsInt(tt.wantFailed, i) {
+					if embedding != nil {
+						t.Errorf("embedding %d = %v, want nil for a failed input", i, embedding)
+					}
+					continue
+				}
+				if len(embedding) == 0 || embedding[0] != float32(i) {
+					t.Errorf("embedding %d = %v, want the one for text %d", i, embedding, i)
+				}
+			}
+		})
+	}
+}
+
+func indexRange(from, to int) []int {
+	var indices []int
+	for i := from; i < to; i++ {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// generationRun calls one provider for one note, recovering from answers the
+// model didn't finish. degraded collects what the final text is missing, for
+// the marker at the top of the note.
+type generationRun struct {
+	// provider names generator in errors
+	provider  string
+	generator Generator
+	model     string
+	// fallback answers when model's answer is blocked or empty
+	fallback string
+	degraded []string
+	logger   *log.Logger
+}
+
+func (r *RAGService) generationRun(route Route) *generationRun {
+	return &generationRun{
+		provider:  route.Provider,
+		generator: r.providers.generators[route.Provider],
+		model:     route.GenerativeModel,
+		fallback:  r.providers.fallbacks[route.Provider],
+		logger:    r.logger,
+	}
+}
+
+// text generates free text. A truncated answer is continued from where it
+// stopped; one still truncated after that is kept and marked degraded.
+func (g *generationRun) text(prompt string) (string, error) {
+	text, err := g.recover(prompt, nil)
+
+	var genErr *GenerationError
+	if !errors.As(err, &genErr) || genErr.Reason != FinishTruncated {
+		return text, err
+	}
+
+	g.logger.Printf("⚠️  Answer truncated, asking the model to continue: %v", err)
+	partial := genErr.Text
+	more, err := g.recover(continuePrompt(prompt, partial), nil)
+	if err != nil {
+		if errors.As(err, &genErr) && genErr.Reason == FinishTruncated {
+			more = genErr.Text
+		}
+		g.logger.Printf("⚠️  Keeping truncated answer: %v", err)
+		g.degrade("answer cut off at the output token limit")
+	}
+	return partial + more, nil
+}
+
+// json generates a document matching schema. Half a JSON document is of no
+// use, so a truncated answer is asked for again, more briefly, and fails if
+// it is still truncated.
+func (g *generationRun) json(prompt string, schema *Schema) (string, error) {
+	text, err := g.recover(prompt, schema)
+
+	var genErr *GenerationError
+	if !errors.As(err, &genErr) || genErr.Reason != FinishTruncated {
+		return text, err
+	}
+
+	g.logger.Printf("⚠️  Answer truncated, asking again for a shorter one: %v", err)
+	return g.recover(prompt+"\n\nYour previous answer was cut off at the length limit. Answer again, more briefly.", schema)
+}
+
+// recover generates with the run's model, and asks the fallback model when
+// that answer is blocked or empty. Truncated answers are left to the caller.
+func (g *generationRun) recover(prompt string, schema *Schema) (string, error) {
+	text, err := g.generate(g.model, prompt, schema)
+
+	var genErr *GenerationError
+	if !errors.As(err, &genErr) || genErr.Reason == FinishTruncated {
+		return text, err
+	}
+	if g.fallback == "" || g.fallback == g.model {
+		return "", err
+	}
+
+	g.logger.Printf("⚠️  %v, retrying with fallback model %s", err, g.fallback)
+	text, err = g.generate(g.fallback, prompt, schema)
+	if err != nil {
+		return "", fmt.Errorf("fallback model %s: %w", g.fallback, err)
+	}
+	g.degrade(fmt.Sprintf("answered by fallback model %s after %v", g.fallback, genErr))
+	return text, nil
+}
+
+func (g *generationRun) generate(model, prompt string, schema *Schema) (string, error) {
+	if schema != nil {
+		return g.generator.(StructuredGenerator).GenerateJSON(model, prompt, schema)
+	}
+	return g.generator.Generate(model, prompt)
+}
+
+func (g *generationRun) degrade(reason string) {
+	if !containsString(g.degraded, reason) {
+		g.degraded = append(g.degraded, reason)
+	}
+}
+
+// continuePrompt asks the model to pick up a truncated answer where it stopped
+func continuePrompt(prompt, partial string) string {
+	return fmt.Sprintf("%s\n\nYour answer so far, cut off at the length limit:\n%s\n\nContinue exactly where it stops, without repeating any of it.", prompt, partial)
+}
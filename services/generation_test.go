@@ -0,0 +1,188 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+// generatorReply is one scripted answer
+type generatorReply struct {
+	text   string
+	reason string
+}
+
+// scriptedGenerator answers each call with the next reply and records the
+// model and prompt it was asked with. A reply with a reason fails with a
+// GenerationError carrying its text.
+type scriptedGenerator struct {
+	replies []generatorReply
+	models  []string
+	prompts []string
+}
+
+func (s *scriptedGenerator) Generate(model, prompt string) (string, error) {
+	s.models = append(s.models, model)
+	s.prompts = append(s.prompts, prompt)
+	if len(s.replies) == 0 {
+		return "", errors.New("no reply scripted")
+	}
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	if reply.reason != "" {
+		return "", &GenerationError{Service: "Gemini", Reason: reply.reason, Text: reply.text}
+	}
+	return reply.text, nil
+}
+
+func (s *scriptedGenerator) GenerateJSON(model, prompt string, schema *Schema) (string, error) {
+	return s.Generate(model, prompt)
+}
+
+func TestGenerationRunText(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallback     string
+		replies      []generatorReply
+		want         string
+		wantErr      string
+		wantModels   []string
+		wantDegraded []string
+	}{
+		{
+			name:       "complete answer",
+			replies:    []generatorReply{{text: "Roll back."}},
+			want:       "Roll back.",
+			wantModels: []string{"primary"},
+		},
+		{
+			name:       "truncated answer is continued",
+			replies:    []generatorReply{{text: "Roll ", reason: FinishTruncated}, {text: "back."}},
+			want:       "Roll back.",
+			wantModels: []string{"primary", "primary"},
+		},
+		{
+			name:         "still truncated is kept and degraded",
+			replies:      []generatorReply{{text: "Roll ", reason: FinishTruncated}, {text: "ba", reason: FinishTruncated}},
+			want:         "Roll ba",
+			wantModels:   []string{"primary", "primary"},
+			wantDegraded: []string{"answer cut off at the output token limit"},
+		},
+		{
+			name:         "blocked answer goes to the fallback",
+			fallback:     "backup",
+			replies:      []generatorReply{{reason: FinishBlocked}, {text: "Roll back."}},
+			want:         "Roll back.",
+			wantModels:   []string{"primary", "backup"},
+			wantDegraded: []string{"answered by fallback model backup after Gemini answer blocked"},
+		},
+		{
+			name:       "empty answer without a fallback",
+			replies:    []generatorReply{{reason: FinishEmpty}},
+			wantErr:    "Gemini answer empty",
+			wantModels: []string{"primary"},
+		},
+		{
+			name:       "fallback that is the same model",
+			fallback:   "primary",
+			replies:    []generatorReply{{reason: FinishBlocked}},
+			wantErr:    "Gemini answer blocked",
+			wantModels: []string{"primary"},
+		},
+		{
+			name:       "fallback fails too",
+			fallback:   "backup",
+			replies:    []generatorReply{{reason: FinishBlocked}, {reason: FinishEmpty}},
+			wantErr:    "fallback model backup: Gemini answer empty",
+			wantModels: []string{"primary", "backup"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generator := &scriptedGenerator{replies: tt.replies}
+			run := &generationRun{provider: ProviderGemini, generator: generator, model: "primary", fallback: tt.fallback, logger: log.Default()}
+
+			got, err := run.text("triage this")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if strings.Join(generator.models, ",") != strings.Join(tt.wantModels, ",") {
+				t.Errorf("models asked = %v, want %v", generator.models, tt.wantModels)
+			}
+			if strings.Join(run.degraded, "|") != strings.Join(tt.wantDegraded, "|") {
+				t.Errorf("degraded = %q, want %q", run.degraded, tt.wantDegraded)
+			}
+		})
+	}
+}
+
+func TestGenerationRunContinuePrompt(t *testing.T) {
+	generator := &scriptedGenerator{replies: []generatorReply{{text: "Roll ", reason: FinishTruncated}, {text: "back."}}}
+	run := &generationRun{provider: ProviderGemini, generator: generator, logger: log.Default()}
+
+	if _, err := run.text("triage this"); err != nil {
+		t.Fatal(err)
+	}
+	if prompt := generator.prompts[1]; !strings.Contains(prompt, "triage this") || !strings.Contains(prompt, "cut off at the length limit:\nRoll ") {
+		t.Errorf("continuation prompt doesn't carry the prompt and partial answer:\n%s", prompt)
+	}
+}
+
+func TestGenerationRunJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []generatorReply
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "complete answer",
+			replies: []generatorReply{{text: `{"a": 1}`}},
+			want:    `{"a": 1}`,
+		},
+		{
+			name:    "truncated answer is asked for again",
+			replies: []generatorReply{{text: `{"a": `, reason: FinishTruncated}, {text: `{"a": 1}`}},
+			want:    `{"a": 1}`,
+		},
+		{
+			name:    "truncated twice fails",
+			replies: []generatorReply{{text: `{"a": `, reason: FinishTruncated}, {text: `{"a`, reason: FinishTruncated}},
+			wantErr: "Gemini answer truncated",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generator := &scriptedGenerator{replies: tt.replies}
+			run := &generationRun{provider: ProviderGemini, generator: generator, logger: log.Default()}
+
+			got, err := run.json("triage this", TriageNoteSchema)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("json = %q, want %q", got, tt.want)
+			}
+			// Half a document is useless, so a retry starts over more briefly
+			if len(generator.prompts) == 2 && !strings.Contains(generator.prompts[1], "Answer again, more briefly.") {
+				t.Errorf("retry prompt = %q, want it to ask for a shorter answer", generator.prompts[1])
+			}
+		})
+	}
+}
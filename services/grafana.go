@@ -0,0 +1,118 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Grafana unified alerting webhook payload structures. The payload is a
+// superset of Alertmanager's, with per-alert dashboard links and query values.
+type GrafanaPayload struct {
+	AlertmanagerPayload
+	Alerts  []GrafanaAlert `json:"alerts"`
+	OrgID   int64          `json:"orgId"`
+	Title   string         `json:"title"`
+	State   string         `json:"state"`
+	Message string         `json:"message"`
+}
+
+type GrafanaAlert struct {
+	Alert
+	DashboardURL string             `json:"dashboardURL"`
+	PanelURL     string             `json:"panelURL"`
+	SilenceURL   string             `json:"silenceURL"`
+	Values       map[string]float64 `json:"values"`
+	ValueString  string             `json:"valueString"`
+}
+
+// FiringAlerts returns only the alerts that are still firing
+func (p GrafanaPayload) FiringAlerts() []GrafanaAlert {
+	var firing []GrafanaAlert
+	for _, alert := range p.Alerts {
+		if alert.Status != "resolved" {
+			firing = append(firing, alert)
+		}
+	}
+	return firing
+}
+
+// ToIncident maps the group the same way as Alertmanager, then keeps the
+// dashboard and panel links and the query values that fired as details
+func (p GrafanaPayload) ToIncident() IncidentData {
+	am := p.AlertmanagerPayload
+	am.Alerts = make([]Alert, len(p.Alerts))
+	for i, alert := range p.Alerts {
+		am.Alerts[i] = alert.Alert
+	}
+
+	incident := am.ToIncident()
+	incident.ID = "grafana-" + shortHash(p.GroupKey)
+
+	firing := p.FiringAlerts()
+	if len(firing) == 0 {
+		return incident
+	}
+
+	details := map[string]string{}
+	first := firing[0]
+	setDetail(details, "dashboard_url", first.DashboardURL)
+	setDetail(details, "panel_url", first.PanelURL)
+	setDetail(details, "alert_rule_url", first.GeneratorURL)
+
+	var values []string
+	for _, alert := range firing {
+		if v := formatAlertValues(alert.Values); v != "" {
+			values = append(values, firstNonEmpty(alert.Labels["alertname"], alert.Fingerprint)+": "+v)
+		}
+	}
+	setDetail(details, "values", strings.Join(values, "; "))
+
+	if len(details) > 0 {
+		incident.Details = details
+	}
+	return incident
+}
+
+// formatAlertValues renders query values as "A=1.5, B=22" in ref ID order
+func formatAlertValues(values map[string]float64) string {
+	refs := make([]string, 0, len(values))
+	for ref := range values {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	parts := make([]string, len(refs))
+	for i, ref := range refs {
+		parts[i] = fmt.Sprintf("%s=%g", ref, values[ref])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setDetail records a detail only when it has a value
+func setDetail(details map[string]string, key, value string) {
+	if value != "" {
+		details[key] = value
+	}
+}
+
+// GrafanaSource handles Grafana unified alerting webhook contact points
+type GrafanaSource struct {
+	BearerAuth
+}
+
+func (GrafanaSource) Name() string { return "grafana" }
+
+// Parse folds the group into one triggered event; resolved notifications
+// carry nothing to triage
+func (GrafanaSource) Parse(body []byte) (Event, bool, error) {
+	var payload GrafanaPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, false, err
+	}
+	if len(payload.FiringAlerts()) == 0 {
+		return Event{}, false, nil
+	}
+	return Event{Type: EventIncidentTriggered, Incident: payload.ToIncident()}, true, nil
+}
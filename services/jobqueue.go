@@ -0,0 +1,483 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// JobKind says what a job does with its incident
+type JobKind string
+
+const (
+	JobEnrich     JobKind = "enrich"
+	JobPostmortem JobKind = "postmortem"
+	// JobReplay re-enriches a PagerDuty incident from its current details
+	JobReplay JobKind = "replay"
+)
+
+const (
+	defaultJobMaxAttempts = 5
+	defaultJobBaseBackoff = 2 * time.Second
+	defaultJobMaxBackoff  = 5 * time.Minute
+	defaultJobQueueDepth  = 100
+	defaultJobWorkers     = 4
+	defaultJobRetryAfter  = 30 * time.Second
+
+	defaultJobDeadLetters   = 500
+	defaultJobDeadLetterTTL = 7 * 24 * time.Hour
+
+	// succeededJobRetention is how long finished jobs stay in the queue file
+	succeededJobRetention = 24 * time.Hour
+)
+
+// ErrQueueFull is returned by Enqueue when MaxDepth jobs are already pending
+var ErrQueueFull = errors.New("job queue is full")
+
+// Job is one piece of AI work (enrichment or postmortem draft) for one incident
+type Job struct {
+	ID            string       `json:"id"`
+	Kind          JobKind      `json:"kind"`
+	Sink          string       `json:"sink,omitempty"`
+	Incident      IncidentData `json:"incident"`
+	Status        JobStatus    `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `json:"last_error,omitempty"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+	// Usage is what the job's model calls cost, summed over every attempt
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// JobHandler does the work for a job and reports what its model calls cost,
+// even when it fails; transient errors are retried
+type JobHandler func(job Job) (*Usage, error)
+
+// QueueStats is a point-in-time view of the queue and its workers
+type QueueStats struct {
+	Depth       int     `json:"depth"`
+	Capacity    int     `json:"capacity"`
+	Workers     int     `json:"workers"`
+	Busy        int     `json:"busy"`
+	Utilisation float64 `json:"utilisation"`
+	DeadLetters int     `json:"dead_letters"`
+	// TenantDepth is the queued and running jobs per tenant
+	TenantDepth map[string]int `json:"tenant_depth"`
+}
+
+// JobQueue is a file-backed queue of AI jobs worked by a fixed pool of
+// workers. Every state change is written to disk, so jobs that were queued or
+// running when the process died are picked up again by the next Run.
+type JobQueue struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Workers is the size of the pool Run starts
+	Workers int
+	// MaxDepth bounds queued plus running jobs; Enqueue fails with ErrQueueFull beyond it
+	MaxDepth int
+	// RetryAfter is what callers should tell clients to wait when the queue is full
+	RetryAfter time.Duration
+
+	// MaxDeadLetters caps the dead-letter list; the oldest are dropped first
+	MaxDeadLetters int
+	// DeadLetterTTL is how long a dead letter is kept
+	DeadLetterTTL time.Duration
+
+	// OnDeadLetter is called when a job fails for good
+	OnDeadLetter func(job Job)
+
+	mu          sync.Mutex
+	path        string
+	jobs        []*Job
+	deadLetters []*Job
+	seq         int
+	wake        chan struct{}
+	busy        int
+}
+
+type jobQueueFile struct {
+	Jobs        []*Job `json:"jobs"`
+	DeadLetters []*Job `json:"dead_letters"`
+}
+
+// NewJobQueueFromConfig opens the queue file with the configured retry and
+// worker pool settings
+func NewJobQueueFromConfig(cfg JobsConfig) (*JobQueue, error) {
+	q, err := NewJobQueue(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	q.MaxAttempts = cfg.MaxAttempts
+	q.BaseBackoff = cfg.RetryBase
+	q.MaxBackoff = cfg.RetryMax
+	q.Workers = cfg.Workers
+	q.MaxDepth = cfg.QueueDepth
+	q.RetryAfter = cfg.RetryAfter
+	q.MaxDeadLetters = cfg.DeadLetters
+	q.DeadLetterTTL = cfg.DeadLetterTTL
+
+	return q, nil
+}
+
+// NewJobQueue loads the queue stored at path, creating it if needed
+func NewJobQueue(path string) (*JobQueue, error) {
+	q := &JobQueue{
+		MaxAttempts:    defaultJobMaxAttempts,
+		BaseBackoff:    defaultJobBaseBackoff,
+		MaxBackoff:     defaultJobMaxBackoff,
+		Workers:        defaultJobWorkers,
+		MaxDepth:       defaultJobQueueDepth,
+		RetryAfter:     defaultJobRetryAfter,
+		MaxDeadLetters: defaultJobDeadLetters,
+		DeadLetterTTL:  defaultJobDeadLetterTTL,
+		path:           path,
+		wake:           make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read job queue: %w", err)
+	}
+	if len(data) > 0 {
+		var stored jobQueueFile
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("failed to parse job queue: %w", err)
+		}
+		q.jobs = stored.Jobs
+		q.deadLetters = stored.DeadLetters
+	}
+
+	// A job still marked running was interrupted by a crash or restart
+	for _, job := range q.jobs {
+		if job.Kind == "" {
+			job.Kind = JobEnrich
+		}
+		if job.Status == JobRunning {
+			job.Status = JobQueued
+			job.NextAttemptAt = time.Now()
+		}
+	}
+
+	return q, q.save()
+}
+
+// Enqueue adds a job of kind for incident, or fails with ErrQueueFull. sink
+// names the note sink the job's output goes to; the worker resolves it, and
+// an empty name means PagerDuty.
+func (q *JobQueue) Enqueue(kind JobKind, sink string, incident IncidentData) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.MaxDepth > 0 && q.depth() >= q.MaxDepth {
+		return Job{}, ErrQueueFull
+	}
+
+	now := time.Now()
+	q.seq++
+	job := &Job{
+		ID:            fmt.Sprintf("job-%d-%d", now.UnixNano(), q.seq),
+		Kind:          kind,
+		Sink:          sink,
+		Incident:      incident,
+		Status:        JobQueued,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	q.jobs = append(q.jobs, job)
+
+	if err := q.save(); err != nil {
+		q.jobs = q.jobs[:len(q.jobs)-1]
+		return Job{}, err
+	}
+
+	q.signal()
+	return *job, nil
+}
+
+// Submit enqueues an enrichment; it is an IncidentFunc so event actions can
+// hand work to the queue instead of running it inline
+func (q *JobQueue) Submit(incident IncidentData) error {
+	_, err := q.Enqueue(JobEnrich, "", incident)
+	return err
+}
+
+// SubmitTo returns an IncidentFunc that enqueues jobs of kind for the named sink
+func (q *JobQueue) SubmitTo(kind JobKind, sink string) IncidentFunc {
+	return func(incident IncidentData) error {
+		_, err := q.Enqueue(kind, sink, incident)
+		return err
+	}
+}
+
+// SubmitPostmortem enqueues a postmortem draft
+func (q *JobQueue) SubmitPostmortem(incident IncidentData) error {
+	_, err := q.Enqueue(JobPostmortem, "", incident)
+	return err
+}
+
+// Run works due jobs with a pool of Workers goroutines until ctx is cancelled
+func (q *JobQueue) Run(ctx context.Context, handler JobHandler) {
+	workers := q.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, handler)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *JobQueue) work(ctx context.Context, handler JobHandler) {
+	for {
+		job, wait := q.next()
+		if job == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-q.wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		// Let an idle worker look for the next due job while this one runs
+		q.signal()
+		usage, err := handler(job.snapshot())
+		q.finish(job, usage, err)
+	}
+}
+
+// Stats reports queue depth and worker utilisation
+func (q *JobQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QueueStats{
+		Depth:       q.depth(),
+		Capacity:    q.MaxDepth,
+		Workers:     q.Workers,
+		Busy:        q.busy,
+		DeadLetters: len(q.deadLetters),
+		TenantDepth: make(map[string]int),
+	}
+	for _, job := range q.jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			tenant := job.Incident.Tenant
+			if tenant == "" {
+				tenant = DefaultTenant
+			}
+			stats.TenantDepth[tenant]++
+		}
+	}
+	if q.Workers > 0 {
+		stats.Utilisation = float64(q.busy) / float64(q.Workers)
+	}
+	return stats
+}
+
+// Jobs returns a copy of every job still in the queue
+func (q *JobQueue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return snapshots(q.jobs)
+}
+
+// DeadLetters returns a copy of the jobs that exhausted their retries
+func (q *JobQueue) DeadLetters() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return snapshots(q.deadLetters)
+}
+
+// next claims the oldest due job, or reports how long until one is due
+func (q *JobQueue) next() (*Job, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Minute
+	var due *Job
+	for _, job := range q.jobs {
+		if job.Status != JobQueued {
+			continue
+		}
+		if until := job.NextAttemptAt.Sub(now); until > 0 {
+			if until < wait {
+				wait = until
+			}
+			continue
+		}
+		if due == nil || job.CreatedAt.Before(due.CreatedAt) {
+			due = job
+		}
+	}
+
+	if due == nil {
+		return nil, wait
+	}
+
+	due.Status = JobRunning
+	due.Attempts++
+	q.busy++
+	due.UpdatedAt = now
+	if err := q.save(); err != nil {
+		log.Printf("⚠️  Failed to persist job queue: %v", err)
+	}
+
+	return due, 0
+}
+
+// finish records the outcome and usage of a job run and schedules a retry if needed
+func (q *JobQueue) finish(job *Job, usage *Usage, err error) {
+	q.mu.Lock()
+
+	now := time.Now()
+	job.UpdatedAt = now
+	job.Usage = addUsage(job.Usage, usage)
+	q.busy--
+	var dead *Job
+
+	switch {
+	case err == nil:
+		job.Status = JobSucceeded
+		job.LastError = ""
+	case IsTransient(err) && job.Attempts < q.MaxAttempts:
+		job.Status = JobQueued
+		job.LastError = err.Error()
+		job.NextAttemptAt = now.Add(q.backoff(job.Attempts))
+		TenantLogger(job.Incident.Tenant).Printf("🔁 Job %s (incident %s) failed, retry %d/%d at %s: %v",
+			job.ID, job.Incident.ID, job.Attempts, q.MaxAttempts-1, job.NextAttemptAt.Format(time.RFC3339), err)
+	default:
+		job.Status = JobFailed
+		job.LastError = err.Error()
+		q.removeJob(job)
+		q.deadLetters = append(q.deadLetters, job)
+		dead = job
+		TenantLogger(job.Incident.Tenant).Printf("💀 Job %s (incident %s) moved to dead letters after %d attempt(s): %v",
+			job.ID, job.Incident.ID, job.Attempts, err)
+	}
+
+	q.pruneSucceeded(now)
+	q.pruneDeadLetters(now)
+	if err := q.save(); err != nil {
+		log.Printf("⚠️  Failed to persist job queue: %v", err)
+	}
+
+	q.mu.Unlock()
+
+	if dead != nil && q.OnDeadLetter != nil {
+		q.OnDeadLetter(dead.snapshot())
+	}
+}
+
+// backoff doubles from BaseBackoff per attempt, capped at MaxBackoff
+func (q *JobQueue) backoff(attempt int) time.Duration {
+	return jitteredBackoff(q.BaseBackoff, q.MaxBackoff, attempt)
+}
+
+// depth counts queued and running jobs; callers hold q.mu
+func (q *JobQueue) depth() int {
+	n := 0
+	for _, job := range q.jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			n++
+		}
+	}
+	return n
+}
+
+func (q *JobQueue) removeJob(target *Job) {
+	for i, job := range q.jobs {
+		if job == target {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *JobQueue) pruneSucceeded(now time.Time) {
+	kept := q.jobs[:0]
+	for _, job := range q.jobs {
+		if job.Status == JobSucceeded && now.Sub(job.UpdatedAt) > succeededJobRetention {
+			continue
+		}
+		kept = append(kept, job)
+	}
+	q.jobs = kept
+}
+
+// pruneDeadLetters drops dead letters older than DeadLetterTTL, then the
+// oldest beyond MaxDeadLetters, so the queue file stops growing
+func (q *JobQueue) pruneDeadLetters(now time.Time) {
+	kept := q.deadLetters[:0]
+	for _, job := range q.deadLetters {
+		if q.DeadLetterTTL > 0 && now.Sub(job.UpdatedAt) > q.DeadLetterTTL {
+			continue
+		}
+		kept = append(kept, job)
+	}
+	if q.MaxDeadLetters > 0 && len(kept) > q.MaxDeadLetters {
+		kept = append(kept[:0], kept[len(kept)-q.MaxDeadLetters:]...)
+	}
+	q.deadLetters = kept
+}
+
+// save writes the queue to disk; callers hold q.mu
+func (q *JobQueue) save() error {
+	data, err := json.MarshalIndent(jobQueueFile{Jobs: q.jobs, DeadLetters: q.deadLetters}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal job queue: %w", err)
+	}
+	return writeFileAtomic(q.path, data)
+}
+
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (j *Job) snapshot() Job {
+	return *j
+}
+
+func snapshots(jobs []*Job) []Job {
+	out := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		out = append(out, job.snapshot())
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].CreatedAt.Before(out[k].CreatedAt) })
+	return out
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	errTestTransient = &APIError{Service: "Gemini", StatusCode: http.StatusServiceUnavailable}
+	errTestPermanent = errors.New("prompt template failed")
+)
+
+func newTestJobQueue(t *testing.T, path string) *JobQueue {
+	t.Helper()
+	q, err := NewJobQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MaxAttempts = 3
+	q.BaseBackoff = time.Millisecond
+	q.MaxBackoff = time.Millisecond
+	return q
+}
+
+// runDue works the queue's due jobs one at a time, answering each attempt
+// with the next of results, until nothing is queued
+func runDue(t *testing.T, q *JobQueue, results []error) {
+	t.Helper()
+	for attempt := 0; q.Stats().Depth > 0; {
+		job, wait := q.next()
+		if job == nil {
+			time.Sleep(wait)
+			continue
+		}
+		if attempt >= len(results) {
+			t.Fatalf("job %s ran %d times, more than the %d results given", job.ID, attempt+1, len(results))
+		}
+		q.finish(job, nil, results[attempt])
+		attempt++
+	}
+}
+
+func TestJobQueueTransitions(t *testing.T) {
+	tests := []struct {
+		name         string
+		results      []error
+		wantStatus   JobStatus
+		wantAttempts int
+		wantDead     bool
+		wantError    string
+	}{
+		{
+			name:         "succeeds first time",
+			results:      []error{nil},
+			wantStatus:   JobSucceeded,
+			wantAttempts: 1,
+		},
+		{
+			name:         "transient error is retried",
+			results:      []error{errTestTransient, errTestTransient, nil},
+			wantStatus:   JobSucceeded,
+			wantAttempts: 3,
+		},
+		{
+			name:         "permanent error dead-letters at once",
+			results:      []error{errTestPermanent},
+			wantStatus:   JobFailed,
+			wantAttempts: 1,
+			wantDead:     true,
+			wantError:    errTestPermanent.Error(),
+		},
+		{
+			name:         "transient error dead-letters when out of attempts",
+			results:      []error{errTestTransient, errTestTransient, errTestTransient},
+			wantStatus:   JobFailed,
+			wantAttempts: 3,
+			wantDead:     true,
+			wantError:    errTestTransient.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestJobQueue(t, filepath.Join(t.TempDir(), "jobs.json"))
+			var dead []Job
+			q.OnDeadLetter = func(job Job) { dead = append(dead, job) }
+
+			if _, err := q.Enqueue(JobEnrich, "", IncidentData{ID: "PINC1"}); err != nil {
+				t.Fatal(err)
+			}
+			runDue(t, q, tt.results)
+
+			var job Job
+			switch jobs, deadLetters := q.Jobs(), q.DeadLetters(); {
+			case tt.wantDead && len(deadLetters) == 1 && len(jobs) == 0:
+				job = deadLetters[0]
+			case !tt.wantDead && len(jobs) == 1 && len(deadLetters) == 0:
+				job = jobs[0]
+			default:
+				t.Fatalf("got %d jobs and %d dead letters, want the job dead-lettered: %v", len(jobs), len(deadLetters), tt.wantDead)
+			}
+
+			if job.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", job.Status, tt.wantStatus)
+			}
+			if job.Attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", job.Attempts, tt.wantAttempts)
+			}
+			if job.LastError != tt.wantError {
+				t.Errorf("last error = %q, want %q", job.LastError, tt.wantError)
+			}
+			if tt.wantDead != (len(dead) == 1) {
+				t.Errorf("OnDeadLetter called %d times, want dead-lettered: %v", len(dead), tt.wantDead)
+			}
+		})
+	}
+}
+
+func TestJobQueueBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "first retry", attempt: 1, min: time.Second, max: 1200 * time.Millisecond},
+		{name: "doubles", attempt: 3, min: 4 * time.Second, max: 4800 * time.Millisecond},
+		{name: "capped", attempt: 10, min: 10 * time.Second, max: 12 * time.Second},
+	}
+
+	q := &JobQueue{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				if got := q.backoff(tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestJobQueueSchedulesRetry(t *testing.T) {
+	q := newTestJobQueue(t, filepath.Join(t.TempDir(), "jobs.json"))
+	q.BaseBackoff = time.Hour
+	q.MaxBackoff = time.Hour
+
+	q.Enqueue(JobEnrich, "", IncidentData{ID: "PINC1"})
+	job, _ := q.next()
+	q.finish(job, nil, errTestTransient)
+
+	// The retry isn't due until the backoff has passed
+	if due, wait := q.next(); due != nil || wait <= 0 {
+		t.Fatalf("next() = %v, %v; want no job due yet", due, wait)
+	}
+	jobs := q.Jobs()
+	if len(jobs) != 1 || jobs[0].Status != JobQueued {
+		t.Fatalf("jobs = %+v, want one queued", jobs)
+	}
+	if until := time.Until(jobs[0].NextAttemptAt); until < 50*time.Minute {
+		t.Errorf("next attempt in %v, want about an hour", until)
+	}
+}
+
+func TestJobQueueRecordsUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	q := newTestJobQueue(t, path)
+	q.Enqueue(JobEnrich, "", IncidentData{ID: "PINC1"})
+
+	// A failed attempt's calls count toward the job as well as the retry's
+	attempts := []struct {
+		usage *Usage
+		err   error
+	}{
+		{usage: &Usage{PromptTokens: 100, CostUSD: 0.01, Models: []ModelUsage{{Model: "gemini-2.0-flash", Calls: 1, PromptTokens: 100, CostUSD: 0.01}}}, err: errTestTransient},
+		{usage: nil, err: errTestTransient},
+		{usage: &Usage{PromptTokens: 150, CompletionTokens: 40, CostUSD: 0.02, Models: []ModelUsage{
+			{Model: "gemini-2.0-flash", Calls: 1, PromptTokens: 120, CompletionTokens: 40, CostUSD: 0.015},
+			{Model: "gemini-embedding-001", Calls: 1, PromptTokens: 30, CostUSD: 0.005},
+		}}},
+	}
+	for _, attempt := range attempts {
+		job, wait := q.next()
+		for job == nil {
+			time.Sleep(wait)
+			job, wait = q.next()
+		}
+		q.finish(job, attempt.usage, attempt.err)
+	}
+
+	want := &Usage{PromptTokens: 250, CompletionTokens: 40, CostUSD: 0.03, Models: []ModelUsage{
+		{Model: "gemini-2.0-flash", Calls: 2, PromptTokens: 220, CompletionTokens: 40, CostUSD: 0.025},
+		{Model: "gemini-embedding-001", Calls: 1, PromptTokens: 30, CostUSD: 0.005},
+	}}
+	restarted := newTestJobQueue(t, path)
+	for name, queue := range map[string]*JobQueue{"running": q, "restarted": restarted} {
+		jobs := queue.Jobs()
+		if len(jobs) != 1 || jobs[0].Status != JobSucceeded {
+			t.Fatalf("%s: jobs = %+v, want one succeeded", name, jobs)
+		}
+		got := jobs[0].Usage
+		if got == nil || got.PromptTokens != want.PromptTokens || got.CompletionTokens != want.CompletionTokens ||
+			math.Abs(got.CostUSD-want.CostUSD) > 1e-9 || len(got.Models) != len(want.Models) {
+			t.Fatalf("%s: usage = %+v, want %+v", name, got, want)
+		}
+		for i, model := range got.Models {
+			if model.Model != want.Models[i].Model || model.Calls != want.Models[i].Calls || model.PromptTokens != want.Models[i].PromptTokens {
+				t.Errorf("%s: model %d = %+v, want %+v", name, i, model, want.Models[i])
+			}
+		}
+	}
+}
+
+func TestJobQueueResumesAfterRestart(t *testing.T) {
+	tests := []struct {
+		name         string
+		interrupt    func(t *testing.T, q *JobQueue)
+		wantStatus   JobStatus
+		wantAttempts int
+		wantDead     int
+	}{
+		{
+			name:       "queued job",
+			interrupt:  func(t *testing.T, q *JobQueue) {},
+			wantStatus: JobQueued,
+		},
+		{
+			name: "running job is queued again",
+			interrupt: func(t *testing.T, q *JobQueue) {
+				if job, _ := q.next(); job == nil {
+					t.Fatal("no job to start")
+				}
+			},
+			wantStatus:   JobQueued,
+			wantAttempts: 1,
+		},
+		{
+			name: "dead letters are kept",
+			interrupt: func(t *testing.T, q *JobQueue) {
+				job, _ := q.next()
+				q.finish(job, nil, errTestPermanent)
+				q.Enqueue(JobPostmortem, "opsgenie", IncidentData{ID: "PINC1", Tenant: "acme"})
+			},
+			wantStatus: JobQueued,
+			wantDead:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jobs.json")
+			q := newTestJobQueue(t, path)
+			if _, err := q.Enqueue(JobPostmortem, "opsgenie", IncidentData{ID: "PINC1", Tenant: "acme"}); err != nil {
+				t.Fatal(err)
+			}
+			tt.interrupt(t, q)
+
+			restarted := newTestJobQueue(t, path)
+			if got := len(restarted.DeadLetters()); got != tt.wantDead {
+				t.Errorf("%d dead letters after restart, want %d", got, tt.wantDead)
+			}
+			jobs := restarted.Jobs()
+			if len(jobs) != 1 {
+				t.Fatalf("%d jobs after restart, want 1", len(jobs))
+			}
+			job := jobs[0]
+			if job.Status != tt.wantStatus || job.Attempts != tt.wantAttempts {
+				t.Errorf("job is %s after %d attempt(s), want %s after %d", job.Status, job.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			if job.Kind != JobPostmortem || job.Sink != "opsgenie" || job.Incident.Tenant != "acme" {
+				t.Errorf("job = %+v, want the postmortem for acme's opsgenie sink", job)
+			}
+
+			// The restarted queue works the job to completion
+			runDue(t, restarted, []error{nil})
+			if jobs := restarted.Jobs(); len(jobs) != 1 || jobs[0].Status != JobSucceeded {
+				t.Errorf("jobs after run = %+v, want one succeeded", jobs)
+			}
+		})
+	}
+}
+
+func TestJobQueuePrunesDeadLetters(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		ttl      time.Duration
+		age      time.Duration
+		wantDead []string
+	}{
+		{name: "under the cap", max: 5, ttl: time.Hour, wantDead: []string{"P1", "P2", "P3"}},
+		{name: "oldest dropped beyond the cap", max: 2, ttl: time.Hour, wantDead: []string{"P2", "P3"}},
+		{name: "expired dropped", max: 5, ttl: time.Hour, age: 2 * time.Hour, wantDead: []string{"P3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jobs.json")
+			q := newTestJobQueue(t, path)
+			q.MaxDeadLetters = tt.max
+			q.DeadLetterTTL = tt.ttl
+
+			for _, id := range []string{"P1", "P2", "P3"} {
+				// Age the earlier dead letters before the next one prunes them
+				for _, dead := range q.deadLetters {
+					dead.UpdatedAt = dead.UpdatedAt.Add(-tt.age)
+				}
+				q.Enqueue(JobEnrich, "", IncidentData{ID: id})
+				job, _ := q.next()
+				q.finish(job, nil, errTestPermanent)
+			}
+
+			// The pruned list is what the file keeps
+			for name, queue := range map[string]*JobQueue{"running": q, "restarted": newTestJobQueue(t, path)} {
+				var got []string
+				for _, job := range queue.DeadLetters() {
+					got = append(got, job.Incident.ID)
+				}
+				if !reflect.DeepEqual(got, tt.wantDead) {
+					t.Errorf("%s: dead letters = %v, want %v", name, got, tt.wantDead)
+				}
+			}
+		})
+	}
+}
+
+func TestJobQueueFull(t *testing.T) {
+	q := newTestJobQueue(t, filepath.Join(t.TempDir(), "jobs.json"))
+	q.MaxDepth = 2
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.Enqueue(JobEnrich, "", IncidentData{ID: "PINC1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.Enqueue(JobEnrich, "", IncidentData{ID: "PINC2"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue on a full queue = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestJobQueueDeadLetterReleasesClaim(t *testing.T) {
+	tests := []struct {
+		name           string
+		kind           JobKind
+		wantIncident   bool
+		wantPostmortem bool
+	}{
+		{name: "enrich", kind: JobEnrich, wantIncident: true},
+		{name: "postmortem", kind: JobPostmortem, wantPostmortem: true},
+		{name: "replay", kind: JobReplay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryDedupStore(time.Hour)
+			store.Claim(IncidentKey("PINC1"))
+			store.Claim(PostmortemKey("PINC1"))
+
+			q := newTestJobQueue(t, filepath.Join(t.TempDir(), "jobs.json"))
+			q.OnDeadLetter = ReleaseDeadLetter(store)
+			if _, err := q.Enqueue(tt.kind, "", IncidentData{ID: "PINC1"}); err != nil {
+				t.Fatal(err)
+			}
+			runDue(t, q, []error{errTestPermanent})
+
+			// A released key can be claimed again
+			if released, _ := store.Claim(IncidentKey("PINC1")); released != tt.wantIncident {
+				t.Errorf("enrichment claim released = %v, want %v", released, tt.wantIncident)
+			}
+			if released, _ := store.Claim(PostmortemKey("PINC1")); released != tt.wantPostmortem {
+				t.Errorf("postmortem claim released = %v, want %v", released, tt.wantPostmortem)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultOllamaURL is where a local Ollama listens
+const defaultOllamaURL = "http://localhost:11434"
+
+// OllamaService talks to an Ollama server's native API
+type OllamaService struct {
+	baseURL    string
+	header     http.Header
+	httpClient *http.Client
+	timeout    time.Duration
+
+	embeddingModel      string
+	embeddingDimensions int
+	generativeModel     string
+	options             ollamaOptions
+
+	// meter records each call's tokens; see RAGService.metered
+	meter *UsageMeter
+}
+
+type ollamaOptions struct {
+	Temperature float32 `json:"temperature"`
+	TopP        float32 `json:"top_p"`
+	TopK        int32   `json:"top_k"`
+	NumPredict  int32   `json:"num_predict"`
+}
+
+type ollamaEmbedRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+type ollamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	Stream  bool          `json:"stream"`
+	Options ollamaOptions `json:"options"`
+	// Format holds the answer to a JSON schema
+	Format *Schema `json:"format,omitempty"`
+}
+
+type ollamaGenerateResponse struct {
+	Response   string `json:"response"`
+	DoneReason string `json:"done_reason"`
+	// PromptEvalCount and EvalCount are the prompt and answer tokens
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// NewOllamaService creates a client for provider, sampling with the
+// generation settings in opts
+func NewOllamaService(provider ProviderConfig, opts RAGOptions) *OllamaService {
+	opts = opts.withDefaults()
+
+	baseURL := defaultOllamaURL
+	if provider.BaseURL != "" {
+		baseURL = strings.TrimSuffix(provider.BaseURL, "/")
+	}
+
+	// Ollama has no auth of its own; an API key is for a proxy in front of it
+	return &OllamaService{
+		baseURL:             baseURL,
+		header:              provider.authHeader(),
+		httpClient:          &http.Client{},
+		timeout:             opts.GeminiTimeout,
+		embeddingModel:      provider.EmbeddingModel,
+		embeddingDimensions: provider.EmbeddingDimensions,
+		generativeModel:     provider.GenerativeModel,
+		options: ollamaOptions{
+			Temperature: *opts.Temperature,
+			TopP:        *opts.TopP,
+			TopK:        opts.SamplingTopK,
+			NumPredict:  opts.MaxOutputTokens,
+		},
+	}
+}
+
+// GenerateEmbedding embeds text; Ollama has no task types
+func (o *OllamaService) GenerateEmbedding(ctx context.Context, text, taskType string) ([]float32, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	var resp ollamaEmbedResponse
+	embedReq := ollamaEmbedRequest{Model: o.embeddingModel, Input: text}
+	if err := postJSON(ctx, o.httpClient, "Ollama", o.baseURL+"/api/embed", o.header, embedReq, &resp); err != nil {
+		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	}
+	o.meter.Record(o.embeddingModel, resp.PromptEvalCount, 0, false)
+	if len(resp.Embeddings) == 0 {
+		return nil, fmt.Errorf("failed to generate embedding: no embedding returned")
+	}
+
+	values := resp.Embeddings[0]
+	if err := checkEmbeddingSize(values, o.embeddingDimensions); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// EmbeddingModel identifies the embedding model and size
+func (o *OllamaService) EmbeddingModel() string {
+	return fmt.Sprintf("%s@%d", o.embeddingModel, o.embeddingDimensions)
+}
+
+func (o *OllamaService) EmbeddingDimensions() int {
+	return o.embeddingDimensions
+}
+
+// Generate completes prompt without streaming
+func (o *OllamaService) Generate(model, prompt string) (string, error) {
+	return o.generate(model, prompt, nil)
+}
+
+// GenerateJSON passes schema as the structured output format
+func (o *OllamaService) GenerateJSON(model, prompt string, schema *Schema) (string, error) {
+	return o.generate(model, prompt, schema)
+}
+
+func (o *OllamaService) generate(model, prompt string, format *Schema) (string, error) {
+	if model == "" {
+		model = o.generativeModel
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	var resp ollamaGenerateResponse
+	genReq := ollamaGenerateRequest{Model: model, Prompt: prompt, Options: o.options, Format: format}
+	if err := postJSON(ctx, o.httpClient, "Ollama", o.baseURL+"/api/generate", o.header, genReq, &resp); err != nil {
+		return "", fmt.Errorf("failed to generate content: %w", err)
+	}
+	o.meter.Record(model, resp.PromptEvalCount, resp.EvalCount, false)
+	switch {
+	case resp.DoneReason == "length":
+		return "", &GenerationError{Service: "Ollama", Reason: FinishTruncated, Detail: resp.DoneReason, Text: resp.Response}
+	case strings.TrimSpace(resp.Response) == "":
+		return "", &GenerationError{Service: "Ollama", Reason: FinishEmpty, Detail: resp.DoneReason}
+	}
+
+	return resp.Response, nil
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAIService talks to any OpenAI-compatible API: OpenAI itself, vLLM,
+// LocalAI or Azure OpenAI
+type OpenAIService struct {
+	baseURL    string
+	header     http.Header
+	httpClient *http.Client
+	timeout    time.Duration
+
+	embeddingModel      string
+	embeddingDimensions int
+	generativeModel     string
+	temperature         float32
+	topP                float32
+	maxOutputTokens     int32
+
+	// meter records each call's tokens; see RAGService.metered
+	meter *UsageMeter
+}
+
+// openAIUsage is the token count every OpenAI-compatible response carries
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type openAIEmbeddingRequest struct {
+	Model      string `json:"model"`
+	Input      string `json:"input"`
+	Dimensions int    `json:"dimensions,omitempty"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage openAIUsage `json:"usage"`
+}
+
+type openAIChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model       string              `json:"model"`
+	Messages    []openAIChatMessage `json:"messages"`
+	Temperature float32             `json:"temperature"`
+	TopP        float32             `json:"top_p"`
+	MaxTokens   int32               `json:"max_tokens"`
+	// ResponseFormat holds the answer to a JSON schema
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema struct {
+		Name   string  `json:"name"`
+		Schema *Schema `json:"schema"`
+	} `json:"json_schema"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+			// Refusal is set instead of Content when the model declines
+			Refusal string `json:"refusal"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage openAIUsage `json:"usage"`
+}
+
+// NewOpenAIService creates a client for provider, sampling with the
+// generation settings in opts
+func NewOpenAIService(provider ProviderConfig, opts RAGOptions) *OpenAIService {
+	opts = opts.withDefaults()
+
+	return &OpenAIService{
+		baseURL:             strings.TrimSuffix(provider.BaseURL, "/"),
+		header:              provider.authHeader(),
+		httpClient:          &http.Client{},
+		timeout:             opts.GeminiTimeout,
+		embeddingModel:      provider.EmbeddingModel,
+		embeddingDimensions: provider.EmbeddingDimensions,
+		generativeModel:     provider.GenerativeModel,
+		temperature:         *opts.Temperature,
+		topP:                *opts.TopP,
+		maxOutputTokens:     opts.MaxOutputTokens,
+	}
+}
+
+// GenerateEmbedding embeds text; OpenAI-compatible APIs have no task types
+func (o *OpenAIService) GenerateEmbedding(ctx context.Context, text, taskType string) ([]float32, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	var resp openAIEmbeddingResponse
+	embedReq := openAIEmbeddingRequest{Model: o.embeddingModel, Input: text, Dimensions: o.embeddingDimensions}
+	if err := postJSON(ctx, o.httpClient, "OpenAI", o.baseURL+"/embeddings", o.header, embedReq, &resp); err != nil {
+		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	}
+	o.meter.Record(o.embeddingModel, resp.Usage.PromptTokens, 0, false)
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("failed to generate embedding: no embedding returned")
+	}
+
+	values := resp.Data[0].Embedding
+	if err := checkEmbeddingSize(values, o.embeddingDimensions); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// EmbeddingModel identifies the embedding model and size
+func (o *OpenAIService) EmbeddingModel() string {
+	return fmt.Sprintf("%s@%d", o.embeddingModel, o.embeddingDimensions)
+}
+
+func (o *OpenAIService) EmbeddingDimensions() int {
+	return o.embeddingDimensions
+}
+
+// Generate completes prompt as a single user message
+func (o *OpenAIService) Generate(model, prompt string) (string, error) {
+	return o.complete(model, prompt, nil)
+}
+
+// GenerateJSON asks for a json_schema response format
+func (o *OpenAIService) GenerateJSON(model, prompt string, schema *Schema) (string, error) {
+	format := &openAIResponseFormat{Type: "json_schema"}
+	format.JSONSchema.Name = "response"
+	format.JSONSchema.Schema = schema
+	return o.complete(model, prompt, format)
+}
+
+func (o *OpenAIService) complete(model, prompt string, format *openAIResponseFormat) (string, error) {
+	if model == "" {
+		model = o.generativeModel
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	chatReq := openAIChatRequest{
+		Model:          model,
+		Messages:       []openAIChatMessage{{Role: "user", Content: prompt}},
+		Temperature:    o.temperature,
+		TopP:           o.topP,
+		MaxTokens:      o.maxOutputTokens,
+		ResponseFormat: format,
+	}
+
+	var resp openAIChatResponse
+	if err := postJSON(ctx, o.httpClient, "OpenAI", o.baseURL+"/chat/completions", o.header, chatReq, &resp); err != nil {
+		return "", fmt.Errorf("failed to generate content: %w", err)
+	}
+	o.meter.Record(model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, false)
+	if len(resp.Choices) == 0 {
+		return "", &GenerationError{Service: "OpenAI", Reason: FinishEmpty}
+	}
+
+	choice := resp.Choices[0]
+	switch {
+	case choice.FinishReason == "length":
+		return "", &GenerationError{Service: "OpenAI", Reason: FinishTruncated, Detail: choice.FinishReason, Text: choice.Message.Content}
+	case choice.Message.Refusal != "":
+		return "", &GenerationError{Service: "OpenAI", Reason: FinishBlocked, Detail: "refusal: " + truncateUTF8(choice.Message.Refusal, 200)}
+	case choice.FinishReason == "content_filter":
+		return "", &GenerationError{Service: "OpenAI", Reason: FinishBlocked, Detail: choice.FinishReason, Text: choice.Message.Content}
+	case strings.TrimSpace(choice.Message.Content) == "":
+		return "", &GenerationError{Service: "OpenAI", Reason: FinishEmpty, Detail: choice.FinishReason}
+	}
+
+	return choice.Message.Content, nil
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultOpsgenieAPIURL = "https://api.opsgenie.com"
+
+// opsgenieMaxNoteLength is the Alert API's limit on note size
+const opsgenieMaxNoteLength = 25000
+
+// Opsgenie outgoing webhook payload structures
+type OpsgeniePayload struct {
+	Action string        `json:"action"`
+	Alert  OpsgenieAlert `json:"alert"`
+}
+
+type OpsgenieAlert struct {
+	AlertID     string            `json:"alertId"`
+	TinyID      string            `json:"tinyId"`
+	Alias       string            `json:"alias"`
+	Message     string            `json:"message"`
+	Description string            `json:"description"`
+	Entity      string            `json:"entity"`
+	Source      string            `json:"source"`
+	Priority    string            `json:"priority"`
+	Tags        []string          `json:"tags"`
+	Details     map[string]string `json:"details"`
+}
+
+// opsgenieActions maps the Opsgenie alert actions we handle to lifecycle events
+var opsgenieActions = map[string]string{
+	"Create": EventIncidentTriggered,
+	"Close":  EventIncidentResolved,
+}
+
+// ToEvent maps the webhook onto a lifecycle event. ok is false for alert
+// actions other than Create and Close.
+func (p OpsgeniePayload) ToEvent() (event Event, ok bool) {
+	eventType, ok := opsgenieActions[p.Action]
+	if !ok {
+		return Event{}, false
+	}
+
+	alert := p.Alert
+	urgency := "low"
+	if rank, known := priorityRank(alert.Priority); known && rank <= 2 {
+		urgency = "high"
+	}
+
+	details := map[string]string{}
+	for key, value := range alert.Details {
+		setDetail(details, key, value)
+	}
+	setDetail(details, "tags", strings.Join(alert.Tags, ", "))
+	if len(details) == 0 {
+		details = nil
+	}
+
+	return Event{
+		ID:       strings.ToLower(p.Action) + ":" + alert.AlertID,
+		Type:     eventType,
+		Priority: alert.Priority,
+		Incident: IncidentData{
+			ID:          alert.AlertID,
+			Title:       alert.Message,
+			Description: alert.Description,
+			Service:     firstNonEmpty(alert.Details["service"], alert.Entity, alert.Source),
+			Urgency:     urgency,
+			Details:     details,
+		},
+	}, true
+}
+
+// OpsgenieService posts notes to alerts through the Opsgenie Alert API
+type OpsgenieService struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewOpsgenieService uses the configured Alert API key and, for testing
+// against a stub, API URL (default https://api.opsgenie.com)
+func NewOpsgenieService(cfg *Config) (*OpsgenieService, error) {
+	if cfg.Opsgenie.APIKey == "" {
+		return nil, fmt.Errorf("OPSGENIE_API_KEY is required")
+	}
+
+	baseURL := cfg.Opsgenie.APIURL
+	if baseURL == "" {
+		baseURL = defaultOpsgenieAPIURL
+	}
+
+	return &OpsgenieService{
+		apiKey:     cfg.Opsgenie.APIKey,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: cfg.HTTPTimeout},
+	}, nil
+}
+
+// PostNote adds a note to an Opsgenie alert, identified by its alert ID
+func (o *OpsgenieService) PostNote(alertID, content string) error {
+	content = truncateUTF8(content, opsgenieMaxNoteLength)
+
+	jsonData, err := json.Marshal(map[string]string{
+		"note":   content,
+		"user":   "AI Triage",
+		"source": "incident-triage-rag-api",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/v2/alerts/%s/notes?identifierType=id", o.baseURL, url.PathEscape(alertID))
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+o.apiKey)
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post note: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The Alert API processes requests asynchronously and answers 202
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return &APIError{Service: "Opsgenie", StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
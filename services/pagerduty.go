@@ -2,27 +2,47 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const defaultPagerDutyAPIURL = "https://api.pagerduty.com"
+
 type PagerDutyService struct {
-	token string
-	email string
+	token      string
+	email      string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewPagerDutyService uses the configured REST API credentials
+func NewPagerDutyService(cfg *Config) *PagerDutyService {
+	return newPagerDutyService(cfg.PagerDuty.APIToken, cfg.PagerDuty.Email, cfg.PagerDuty.APIURL, cfg.HTTPTimeout)
 }
 
-func NewPagerDutyService() *PagerDutyService {
+func newPagerDutyService(token, email, baseURL string, timeout time.Duration) *PagerDutyService {
+	if baseURL == "" {
+		baseURL = defaultPagerDutyAPIURL
+	}
 	return &PagerDutyService{
-		token: os.Getenv("PAGERDUTY_API_TOKEN"),
-		email: os.Getenv("PAGERDUTY_EMAIL"),
+		token:      token,
+		email:      email,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: timeout},
 	}
 }
 
 // PostNote adds a note to a PagerDuty incident
 func (pd *PagerDutyService) PostNote(incidentID, content string) error {
-	url := fmt.Sprintf("https://api.pagerduty.com/incidents/%s/notes", incidentID)
+	endpoint := fmt.Sprintf("%s/incidents/%s/notes", pd.baseURL, incidentID)
 
 	payload := map[string]interface{}{
 		"note": map[string]string{
@@ -35,7 +55,7 @@ func (pd *PagerDutyService) PostNote(incidentID, content string) error {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -47,16 +67,176 @@ func (pd *PagerDutyService) PostNote(incidentID, content string) error {
 	req.Header.Set("From", pd.email)
 
 	// Make request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := pd.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to post note: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("PagerDuty API returned status %d", resp.StatusCode)
+		return &APIError{Service: "PagerDuty", StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// pagerDutyIncident is the subset of the REST API incident object used for replays
+type pagerDutyIncident struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Urgency     string    `json:"urgency"`
+	Service     Reference `json:"service"`
+	Body        struct {
+		Details string `json:"details"`
+	} `json:"body"`
+	FirstTriggerLogEntry struct {
+		Channel struct {
+			Details interface{} `json:"details"`
+		} `json:"channel"`
+	} `json:"first_trigger_log_entry"`
+}
+
+// Note is a note on a PagerDuty incident
+type Note struct {
+	ID        string `json:"id"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// GetIncident fetches an incident's current title, body and service
+func (pd *PagerDutyService) GetIncident(incidentID string) (IncidentData, error) {
+	var resp struct {
+		Incident pagerDutyIncident `json:"incident"`
+	}
+	path := fmt.Sprintf("/incidents/%s?include[]=first_trigger_log_entries", url.PathEscape(incidentID))
+	if err := pd.get(context.Background(), path, &resp); err != nil {
+		return IncidentData{}, fmt.Errorf("failed to fetch incident: %w", err)
+	}
+
+	incident := resp.Incident
+	// The body is on the incident when it was created through the REST API,
+	// otherwise on the trigger log entry
+	details := incident.Body.Details
+	if details == "" {
+		if text, ok := incident.FirstTriggerLogEntry.Channel.Details.(string); ok {
+			details = text
+		}
 	}
 
+	return IncidentData{
+		ID:          firstNonEmpty(incident.ID, incidentID),
+		Title:       incident.Title,
+		Description: firstNonEmpty(details, incident.Description),
+		Service:     incident.Service.Summary,
+		Urgency:     incident.Urgency,
+		Source:      SourcePagerDuty,
+	}, nil
+}
+
+// ListNotes returns an incident's notes, oldest first
+func (pd *PagerDutyService) ListNotes(incidentID string) ([]Note, error) {
+	var resp struct {
+		Notes []Note `json:"notes"`
+	}
+	if err := pd.get(context.Background(), fmt.Sprintf("/incidents/%s/notes", url.PathEscape(incidentID)), &resp); err != nil {
+		return nil, fmt.Errorf("failed to list notes: %w", err)
+	}
+	return resp.Notes, nil
+}
+
+// LogEntry is one entry of an incident's log: a trigger, acknowledgement,
+// escalation, note, status update, ...
+type LogEntry struct {
+	Type      string    `json:"type"`
+	CreatedAt string    `json:"created_at"`
+	Summary   string    `json:"summary"`
+	Agent     Reference `json:"agent"`
+}
+
+// ListLogEntries returns up to limit of an incident's most important log
+// entries, newest first
+func (pd *PagerDutyService) ListLogEntries(ctx context.Context, incidentID string, limit int) ([]LogEntry, error) {
+	var resp struct {
+		LogEntries []LogEntry `json:"log_entries"`
+	}
+	path := fmt.Sprintf("/incidents/%s/log_entries?is_overview=true&limit=%d", url.PathEscape(incidentID), limit)
+	if err := pd.get(ctx, path, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list log entries: %w", err)
+	}
+	return resp.LogEntries, nil
+}
+
+// ChangeEvent is a deploy, config change or other change sent to PagerDuty
+type ChangeEvent struct {
+	Summary   string      `json:"summary"`
+	Timestamp string      `json:"timestamp"`
+	Source    string      `json:"source,omitempty"`
+	Services  []Reference `json:"services"`
+	Links     []struct {
+		Href string `json:"href"`
+		Text string `json:"text"`
+	} `json:"links,omitempty"`
+}
+
+// Change events are listed a page at a time; an account can send many more
+// than one page in a day, and PagerDuty filters by service ID only
+const (
+	changeEventsPageSize = 100
+	maxChangeEventPages  = 10
+)
+
+// ListChangeEvents returns the account's change events between since and
+// until, paging through at most maxChangeEventPages pages
+func (pd *PagerDutyService) ListChangeEvents(ctx context.Context, since, until time.Time) ([]ChangeEvent, error) {
+	query := url.Values{}
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	query.Set("until", until.UTC().Format(time.RFC3339))
+	query.Set("limit", strconv.Itoa(changeEventsPageSize))
+
+	var events []ChangeEvent
+	for page := 0; page < maxChangeEventPages; page++ {
+		var resp struct {
+			ChangeEvents []ChangeEvent `json:"change_events"`
+			More         bool          `json:"more"`
+		}
+		query.Set("offset", strconv.Itoa(len(events)))
+		if err := pd.get(ctx, "/change_events?"+query.Encode(), &resp); err != nil {
+			return nil, fmt.Errorf("failed to list change events: %w", err)
+		}
+		events = append(events, resp.ChangeEvents...)
+		if !resp.More || len(resp.ChangeEvents) == 0 {
+			return events, nil
+		}
+	}
+
+	log.Printf("⚠️  Listed the first %d change events since %s, skipping the rest", len(events), since.UTC().Format(time.RFC3339))
+	return events, nil
+}
+
+// get sends an authenticated GET to the REST API and decodes the JSON response into out
+func (pd *PagerDutyService) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", pd.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	req.Header.Set("Authorization", fmt.Sprintf("Token token=%s", pd.token))
+
+	resp, err := pd.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{Service: "PagerDuty", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
 	return nil
 }
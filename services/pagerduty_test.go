@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// changeEventsStub serves total change events in pages the size the client
+// asks for
+func changeEventsStub(t *testing.T, total int) (*httptest.Server, *[]string) {
+	t.Helper()
+	var offsets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		offsets = append(offsets, query.Get("offset"))
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit == 0 {
+			t.Errorf("request without a limit: %s", r.URL)
+		}
+
+		var resp struct {
+			ChangeEvents []ChangeEvent `json:"change_events"`
+			More         bool          `json:"more"`
+		}
+		for i := offset; i < total && i < offset+limit; i++ {
+			resp.ChangeEvents = append(resp.ChangeEvents, ChangeEvent{Summary: "deploy " + strconv.Itoa(i)})
+		}
+		resp.More = offset+limit < total
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server, &offsets
+}
+
+func TestListChangeEventsPages(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      int
+		wantEvents int
+		wantPages  int
+	}{
+		{name: "none", total: 0, wantEvents: 0, wantPages: 1},
+		{name: "one page", total: 40, wantEvents: 40, wantPages: 1},
+		{name: "several pages", total: 250, wantEvents: 250, wantPages: 3},
+		{name: "capped", total: 5000, wantEvents: maxChangeEventPages * changeEventsPageSize, wantPages: maxChangeEventPages},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, offsets := changeEventsStub(t, tt.total)
+			pd := newPagerDutyService("token", "triage@example.com", server.URL, time.Second)
+
+			until := time.Now()
+			events, err := pd.ListChangeEvents(context.Background(), until.Add(-time.Hour), until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.wantEvents {
+				t.Errorf("got %d change events, want %d", len(events), tt.wantEvents)
+			}
+			if len(*offsets) != tt.wantPages {
+				t.Errorf("fetched pages at offsets %v, want %d pages", *offsets, tt.wantPages)
+			}
+			for i, event := range events {
+				if want := "deploy " + strconv.Itoa(i); event.Summary != want {
+					t.Fatalf("event %d = %q, want %q", i, event.Summary, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPagerDutyReadsStopWithContext(t *testing.T) {
+	server, _ := changeEventsStub(t, 10)
+	pd := newPagerDutyService("token", "triage@example.com", server.URL, time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	until := time.Now()
+	if _, err := pd.ListChangeEvents(ctx, until.Add(-time.Hour), until); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListChangeEvents with a cancelled context = %v, want context.Canceled", err)
+	}
+	if _, err := pd.ListLogEntries(ctx, "PINC1", 10); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListLogEntries with a cancelled context = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// DryRunHeader asks a webhook endpoint to return the note instead of posting it
+const DryRunHeader = "X-Dry-Run"
+
+// IsDryRun reports whether the request asked for ?dry_run=true or X-Dry-Run: true
+func IsDryRun(r *http.Request) bool {
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		value = r.Header.Get(DryRunHeader)
+	}
+	dryRun, _ := strconv.ParseBool(value)
+	return dryRun
+}
+
+// Preview runs the pipeline behind an event's action without posting the
+// note. ok is false for events whose action posts nothing.
+func (r *RAGService) Preview(event Event) (enrichment *Enrichment, ok bool, err error) {
+	switch event.Type {
+	case EventIncidentTriggered, EventIncidentPriorityUpdated:
+		enrichment, err = r.Enrich(event.Incident)
+	case EventIncidentResolved:
+		enrichment, err = r.Postmortem(event.Incident)
+	default:
+		return nil, false, nil
+	}
+	return enrichment, true, err
+}
+
+// ServeDryRun answers a dry-run request with the previewed enrichment as JSON
+func ServeDryRun(w http.ResponseWriter, rag *RAGService, event Event) {
+	logger := TenantLogger(event.Incident.Tenant)
+	logger.Printf("🧪 Dry run of %s for incident: %s - %s", event.Type, event.Incident.ID, event.Incident.Title)
+
+	enrichment, ok, err := rag.Preview(event)
+	if err != nil {
+		logger.Printf("❌ Dry run failed for incident %s: %v", event.Incident.ID, err)
+		http.Error(w, "Failed to preview enrichment", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "ignored",
+			"reason": "event posts no note",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(enrichment)
+}
+
+// AuthorizeOperator checks the operator bearer token (TRIAGE_API_TOKEN) on
+// operator endpoints (/api/triage, /api/replay, /api/jobs, dry runs) and writes 401 if
+// it doesn't match. They spend Gemini quota or show incident details, so they
+// stay closed until a token is set.
+func AuthorizeOperator(w http.ResponseWriter, r *http.Request, tokens []string) bool {
+	if err := VerifyBearerToken(r.Header.Get("Authorization"), tokens); err != nil {
+		log.Printf("🚫 Rejected %s request from %s: %v", r.URL.Path, r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// AuthorizeDryRun checks the operator token on a dry-run webhook request. The
+// flag sits outside the signed body and a dry run skips dedup and returns the
+// prompt and retrieved postmortems, so a signature alone isn't enough.
+func AuthorizeDryRun(w http.ResponseWriter, r *http.Request, tokens []string) bool {
+	return AuthorizeOperator(w, r, tokens)
+}
+
+// ReadTriageRequest authenticates a POST /api/triage request with the
+// operator tokens and decodes its incident. When ok is false the error
+// response has already been written.
+func ReadTriageRequest(w http.ResponseWriter, r *http.Request, tokens []string) (incident IncidentData, ok bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return IncidentData{}, false
+	}
+
+	if !AuthorizeOperator(w, r, tokens) {
+		return IncidentData{}, false
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSourceBodyBytes)).Decode(&incident); err != nil {
+		log.Printf("Failed to decode triage request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return IncidentData{}, false
+	}
+	if incident.Title == "" {
+		http.Error(w, "title is required", http.StatusBadRequest)
+		return IncidentData{}, false
+	}
+	if incident.ID == "" {
+		incident.ID = "preview"
+	}
+
+	return incident, true
+}
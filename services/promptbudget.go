@@ -0,0 +1,221 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultPromptTokenBudget keeps prompts well inside every supported model's
+// context window, and their cost predictable
+const DefaultPromptTokenBudget = 4000
+
+// How prompt sections are measured against the budget
+const (
+	// TokenCounterEstimate counts about four characters a token, locally
+	TokenCounterEstimate = "estimate"
+	// TokenCounterModel asks the generative provider, where it can count
+	TokenCounterModel = "model"
+)
+
+// TokenCounter is a Generator that can measure text in its model's tokens
+type TokenCounter interface {
+	CountTokens(model, text string) (int, error)
+}
+
+// EstimateTokens approximates a token count at four characters a token. That
+// errs high for English prose and is close for logs and stack traces.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// PromptSection is a piece of a prompt the assembler keeps or drops whole
+type PromptSection struct {
+	// Name identifies the section in the report, e.g. "INC-2024-007 timeline"
+	Name string
+	Text string
+	// Priority orders sections for the budget. Priority 0 is always kept;
+	// 1, 2, ... fill what's left in that order.
+	Priority int
+	// Trim lets a priority 0 section be shortened to fit, instead of
+	// pushing the prompt over budget
+	Trim bool
+}
+
+// PromptReport says how a prompt was fitted to its budget
+type PromptReport struct {
+	Budget int `json:"budget"`
+	// Tokens is the sum of the kept sections' counts
+	Tokens  int      `json:"tokens"`
+	Dropped []string `json:"dropped,omitempty"`
+	Trimmed []string `json:"trimmed,omitempty"`
+}
+
+// PromptAssembler fills a token budget with prompt sections in priority order
+type PromptAssembler struct {
+	Budget int
+	// Count measures text; nil uses EstimateTokens
+	Count func(text string) int
+}
+
+// Assemble keeps every priority 0 section, then adds the others by priority
+// while they fit. Sections that allow trimming are shortened to at most half
+// of what the fixed sections leave, so a long alert description can't crowd
+// out everything else. Kept sections stay in their original order.
+func (a *PromptAssembler) Assemble(sections []PromptSection) (string, *PromptReport) {
+	count := a.Count
+	if count == nil {
+		count = EstimateTokens
+	}
+	report := &PromptReport{Budget: a.Budget}
+	sections = append([]PromptSection(nil), sections...)
+
+	costs := make([]int, len(sections))
+	keep := make([]bool, len(sections))
+	for i, section := range sections {
+		costs[i] = count(section.Text)
+		if section.Priority == 0 && !section.Trim {
+			keep[i] = true
+			report.Tokens += costs[i]
+		}
+	}
+
+	// Trimmable sections share half of what the fixed ones leave, first come
+	// first served
+	limit := report.Tokens + (a.Budget-report.Tokens)/2
+	for i := range sections {
+		section := &sections[i]
+		if section.Priority != 0 || !section.Trim || section.Text == "" {
+			continue
+		}
+		remaining := limit - report.Tokens
+		if costs[i] > remaining {
+			section.Text, costs[i] = trimToTokens(section.Text, remaining, count)
+			if section.Text == "" {
+				report.Dropped = append(report.Dropped, section.Name)
+				continue
+			}
+			report.Trimmed = append(report.Trimmed, section.Name)
+		}
+		keep[i] = true
+		report.Tokens += costs[i]
+	}
+
+	order := make([]int, 0, len(sections))
+	for i, section := range sections {
+		if section.Priority > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		return sections[order[x]].Priority < sections[order[y]].Priority
+	})
+	for _, i := range order {
+		if report.Tokens+costs[i] > a.Budget {
+			report.Dropped = append(report.Dropped, sections[i].Name)
+			continue
+		}
+		keep[i] = true
+		report.Tokens += costs[i]
+	}
+
+	var sb strings.Builder
+	for i, section := range sections {
+		if keep[i] {
+			sb.WriteString(section.Text)
+		}
+	}
+	return sb.String(), report
+}
+
+// truncatedMarker ends a trimmed section
+const truncatedMarker = " [truncated]\n"
+
+// trimToTokens shortens text to fit tokens, cutting at a word boundary and
+// never inside a UTF-8 character. It returns "" when nothing useful fits.
+func trimToTokens(text string, tokens int, count func(string) int) (string, int) {
+	runes := []rune(text)
+	keep := tokens*4 - len(truncatedMarker)
+
+	// Counts from a real tokenizer aren't proportional to length, so shrink
+	// and re-measure a few times
+	for attempt := 0; attempt < 4 && keep > 0; attempt++ {
+		trimmed := cutAtSpace(runes, keep) + truncatedMarker
+		cost := count(trimmed)
+		if cost <= tokens {
+			return trimmed, cost
+		}
+		keep = keep * tokens / cost * 9 / 10
+	}
+	return "", 0
+}
+
+// cutAtSpace returns up to n runes of runes, backing up to the last space
+// when there is one in the second half
+func cutAtSpace(runes []rune, n int) string {
+	if n >= len(runes) {
+		return string(runes)
+	}
+	cut := n
+	for i := n; i > n/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace)
+}
+
+// sectionPriority fills the budget with root causes and resolutions first,
+// since they are what a triage note is built from
+func sectionPriority(section string) int {
+	switch section {
+	case "root_cause", "resolution":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// promptAssembler measures prompts for route's generator: with the model's
+// own tokenizer when configured and available, else the estimate
+func (r *RAGService) promptAssembler(route Route) *PromptAssembler {
+	assembler := &PromptAssembler{Budget: r.promptBudget}
+
+	counter, ok := r.providers.generators[route.Provider].(TokenCounter)
+	if r.tokenCounter != TokenCounterModel || !ok {
+		return assembler
+	}
+	assembler.Count = func(text string) int {
+		tokens, err := counter.CountTokens(route.GenerativeModel, text)
+		if err != nil {
+			r.logger.Printf("⚠️  Failed to count tokens, estimating instead: %v", err)
+			return EstimateTokens(text)
+		}
+		return tokens
+	}
+	return assembler
+}
+
+// logPromptReport notes what a prompt lost to its budget
+func logPromptReport(logger *log.Logger, incidentID string, report *PromptReport) {
+	if len(report.Dropped) == 0 && len(report.Trimmed) == 0 {
+		return
+	}
+	var parts []string
+	if len(report.Trimmed) > 0 {
+		parts = append(parts, "trimmed "+strings.Join(report.Trimmed, ", "))
+	}
+	if len(report.Dropped) > 0 {
+		parts = append(parts, "dropped "+strings.Join(report.Dropped, ", "))
+	}
+	logger.Printf("✂️  Prompt for incident %s fitted to %d tokens: %s", incidentID, report.Budget, strings.Join(parts, "; "))
+}
+
+// resultSectionName identifies a retrieved chunk in a PromptReport
+func resultSectionName(result SearchResult) string {
+	return fmt.Sprintf("%s %s", result.IncidentID, result.Section)
+}
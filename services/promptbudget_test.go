@@ -0,0 +1,157 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// byteCount makes one byte one token, so budgets are easy to reason about
+func byteCount(text string) int { return len(text) }
+
+func TestPromptAssemblerAssemble(t *testing.T) {
+	alert := PromptSection{Name: "alert", Text: strings.Repeat("a", 10)}
+	rootCause := PromptSection{Name: "INC-1 root_cause", Text: strings.Repeat("r", 20), Priority: 1}
+	timeline := PromptSection{Name: "INC-1 timeline", Text: strings.Repeat("t", 20), Priority: 2}
+	task := PromptSection{Name: "task", Text: strings.Repeat("k", 10)}
+
+	tests := []struct {
+		name       string
+		budget     int
+		sections   []PromptSection
+		want       string
+		wantTokens int
+		wantDrop   []string
+	}{
+		{
+			name:       "everything fits",
+			budget:     100,
+			sections:   []PromptSection{alert, timeline, rootCause, task},
+			want:       alert.Text + timeline.Text + rootCause.Text + task.Text,
+			wantTokens: 60,
+		},
+		{
+			name:       "higher priority first, original order kept",
+			budget:     40,
+			sections:   []PromptSection{alert, timeline, rootCause, task},
+			want:       alert.Text + rootCause.Text + task.Text,
+			wantTokens: 40,
+			wantDrop:   []string{"INC-1 timeline"},
+		},
+		{
+			name:   "a smaller lower priority section still fits",
+			budget: 35,
+			sections: []PromptSection{alert, rootCause, task,
+				{Name: "INC-2 summary", Text: "sssss", Priority: 2}},
+			want:       alert.Text + task.Text + "sssss",
+			wantTokens: 25,
+			wantDrop:   []string{"INC-1 root_cause"},
+		},
+		{
+			name:       "fixed sections are kept over budget",
+			budget:     5,
+			sections:   []PromptSection{alert, rootCause, task},
+			want:       alert.Text + task.Text,
+			wantTokens: 20,
+			wantDrop:   []string{"INC-1 root_cause"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := &PromptAssembler{Budget: tt.budget, Count: byteCount}
+			got, report := assembler.Assemble(tt.sections)
+			if got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+			if report.Tokens != tt.wantTokens || report.Budget != tt.budget {
+				t.Errorf("report = %+v, want %d of %d tokens", report, tt.wantTokens, tt.budget)
+			}
+			if !reflect.DeepEqual(report.Dropped, tt.wantDrop) {
+				t.Errorf("dropped = %v, want %v", report.Dropped, tt.wantDrop)
+			}
+			if len(report.Trimmed) != 0 {
+				t.Errorf("trimmed = %v, want none", report.Trimmed)
+			}
+		})
+	}
+}
+
+func TestPromptAssemblerTrimsLongSections(t *testing.T) {
+	description := PromptSection{Name: "description", Text: strings.Repeat("error rate spiked ", 20), Trim: true}
+	sections := []PromptSection{
+		{Name: "alert", Text: strings.Repeat("a", 10)},
+		description,
+		{Name: "INC-1 root_cause", Text: strings.Repeat("r", 20), Priority: 1},
+		{Name: "task", Text: strings.Repeat("k", 10)},
+	}
+
+	assembler := &PromptAssembler{Budget: 100, Count: byteCount}
+	got, report := assembler.Assemble(sections)
+
+	// The fixed sections take 20, so the description gets half of the other 80
+	if !reflect.DeepEqual(report.Trimmed, []string{"description"}) || len(report.Dropped) != 0 {
+		t.Fatalf("report = %+v, want only the description trimmed", report)
+	}
+	if report.Tokens > assembler.Budget {
+		t.Errorf("%d tokens, over the budget of %d", report.Tokens, assembler.Budget)
+	}
+	kept, _, marked := strings.Cut(strings.TrimPrefix(got, "aaaaaaaaaa"), truncatedMarker)
+	if !marked || !strings.HasPrefix(description.Text, kept+" ") {
+		t.Errorf("description isn't cut at a word and marked:\n%q", got)
+	}
+	if !strings.HasSuffix(got, strings.Repeat("r", 20)+strings.Repeat("k", 10)) {
+		t.Errorf("root cause and task aren't kept after the trimmed description:\n%q", got)
+	}
+}
+
+func TestTrimToTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		tokens   int
+		wantText bool
+	}{
+		{name: "ascii", text: strings.Repeat("connection refused ", 50), tokens: 20, wantText: true},
+		{name: "multibyte", text: strings.Repeat("接続が拒否されました ", 50), tokens: 20, wantText: true},
+		{name: "no words", text: strings.Repeat("x", 500), tokens: 20, wantText: true},
+		{name: "nothing fits", text: strings.Repeat("connection refused ", 50), tokens: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cost := trimToTokens(tt.text, tt.tokens, EstimateTokens)
+			if (got != "") != tt.wantText {
+				t.Fatalf("trimToTokens() = %q, want text: %v", got, tt.wantText)
+			}
+			if !tt.wantText {
+				return
+			}
+			if cost > tt.tokens || cost != EstimateTokens(got) {
+				t.Errorf("cost = %d (measured %d), want at most %d", cost, EstimateTokens(got), tt.tokens)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("trimmed text isn't valid UTF-8: %q", got)
+			}
+			if !strings.HasSuffix(got, truncatedMarker) {
+				t.Errorf("trimmed text = %q, want it to end with %q", got, truncatedMarker)
+			}
+		})
+	}
+}
+
+func TestSectionPriority(t *testing.T) {
+	tests := map[string]int{
+		"root_cause": 1,
+		"resolution": 1,
+		"summary":    2,
+		"timeline":   2,
+		"prevention": 2,
+	}
+	for section, want := range tests {
+		if got := sectionPriority(section); got != want {
+			t.Errorf("sectionPriority(%q) = %d, want %d", section, got, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Embedder turns text into the vectors searched in Qdrant
+type Embedder interface {
+	GenerateEmbedding(ctx context.Context, text, taskType string) ([]float32, error)
+	// EmbeddingModel identifies the vectors produced, model and size, e.g.
+	// models/gemini-embedding-001@3072
+	EmbeddingModel() string
+	// EmbeddingDimensions is the vector size, or 0 when it isn't configured
+	EmbeddingDimensions() int
+}
+
+// Generator writes triage notes and postmortem drafts
+type Generator interface {
+	// Generate completes prompt with model, or the default model when empty
+	Generate(model, prompt string) (string, error)
+}
+
+// Provider kinds. ProviderGemini is also the name of the provider built from
+// the top-level gemini settings.
+const (
+	ProviderGemini = "gemini"
+	ProviderOpenAI = "openai"
+	ProviderOllama = "ollama"
+)
+
+// ProviderConfig is a self-hosted or third-party model API that routes can
+// embed or generate with instead of Gemini
+type ProviderConfig struct {
+	Name string `yaml:"name"`
+	// Kind is openai for any OpenAI-compatible API (vLLM, LocalAI, Azure
+	// OpenAI) or ollama
+	Kind    string `yaml:"kind"`
+	BaseURL string `yaml:"base_url" env:"BASE_URL"`
+	APIKey  string `yaml:"api_key" env:"API_KEY"`
+	// APIKeyHeader sends the key as this header instead of a bearer token,
+	// e.g. api-key for Azure OpenAI
+	APIKeyHeader    string `yaml:"api_key_header"`
+	EmbeddingModel  string `yaml:"embedding_model" env:"EMBEDDING_MODEL"`
+	GenerativeModel string `yaml:"generative_model" env:"GENERATIVE_MODEL"`
+	// FallbackModel answers when the generative model's answer is blocked or empty
+	FallbackModel string `yaml:"fallback_model" env:"FALLBACK_MODEL"`
+	// EmbeddingDimensions is checked against the Qdrant collections and, for
+	// openai, sent as the requested size
+	EmbeddingDimensions int `yaml:"embedding_dimensions" env:"EMBEDDING_DIMENSIONS"`
+}
+
+// envPrefix is where a provider's environment overrides live, e.g.
+// PROVIDER_LOCAL_VLLM_API_KEY
+func (p ProviderConfig) envPrefix() string {
+	return "PROVIDER_" + strings.ToUpper(strings.ReplaceAll(p.Name, "-", "_")) + "_"
+}
+
+// authHeader carries the API key, if any
+func (p ProviderConfig) authHeader() http.Header {
+	header := http.Header{}
+	switch {
+	case p.APIKey == "":
+	case p.APIKeyHeader != "":
+		header.Set(p.APIKeyHeader, p.APIKey)
+	default:
+		header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+	return header
+}
+
+// applyProviderEnv applies each provider's PROVIDER_<NAME>_ overrides
+func (c *Config) applyProviderEnv() error {
+	for i := range c.Providers {
+		provider := &c.Providers[i]
+		if provider.Name == "" {
+			continue
+		}
+		if err := applyEnv(reflect.ValueOf(provider).Elem(), provider.envPrefix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usesProvider reports whether the defaults or any routing rule pick name
+func (c *Config) usesProvider(name string) bool {
+	return usesProvider(name, c.EmbeddingProvider, c.GenerativeProvider, c.Routing)
+}
+
+func usesProvider(name, embedding, generative string, routing RoutingConfig) bool {
+	if embedding == name || generative == name {
+		return true
+	}
+	for _, rule := range routing.Rules {
+		if rule.Provider == name || rule.EmbeddingProvider == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProviders reports each provider's problems, and references to
+// providers that don't exist, through report
+func (c *Config) validateProviders(report func(format string, args ...interface{})) {
+	known := map[string]ProviderConfig{ProviderGemini: {Name: ProviderGemini, Kind: ProviderGemini}}
+
+	for i, provider := range c.Providers {
+		field := fmt.Sprintf("providers[%d]", i)
+		switch {
+		case provider.Name == ProviderGemini:
+			report("%s.name %q is reserved for the gemini settings", field, ProviderGemini)
+		case !tenantNamePattern.MatchString(provider.Name):
+			report("%s.name %q must be lowercase letters, digits and dashes", field, provider.Name)
+		case known[provider.Name].Name != "":
+			report("%s.name %q is used twice", field, provider.Name)
+		default:
+			known[provider.Name] = provider
+		}
+
+		switch provider.Kind {
+		case ProviderOpenAI:
+			if provider.BaseURL == "" {
+				report("%s.base_url is required for the openai kind", field)
+			}
+		case ProviderOllama:
+		default:
+			report("%s.kind must be openai or ollama, got %q", field, provider.Kind)
+		}
+		if provider.EmbeddingDimensions < 0 {
+			report("%s.embedding_dimensions must not be negative", field)
+		}
+	}
+
+	embedder := func(name, where string) {
+		provider, ok := known[name]
+		switch {
+		case !ok:
+			report("%s: unknown provider %q", where, name)
+		case provider.Kind != ProviderGemini && provider.EmbeddingModel == "":
+			report("%s: provider %s has no embedding_model", where, name)
+		}
+	}
+	generator := func(name, where string, model string) {
+		provider, ok := known[name]
+		switch {
+		case !ok:
+			report("%s: unknown provider %q", where, name)
+		case provider.Kind != ProviderGemini && provider.GenerativeModel == "" && model == "":
+			report("%s: provider %s has no generative_model", where, name)
+		}
+	}
+
+	embedder(c.EmbeddingProvider, "embedding_provider")
+	generator(c.GenerativeProvider, "generative_provider", "")
+	for i, rule := range c.Routing.Rules {
+		where := fmt.Sprintf("routing.rules[%d]", i)
+		if rule.EmbeddingProvider != "" {
+			embedder(rule.EmbeddingProvider, where+".embedding_provider")
+		}
+		if rule.Provider != "" {
+			generator(rule.Provider, where+".provider", rule.GenerativeModel)
+		}
+	}
+}
+
+// providerSet holds the embedders and generators a RAGService can route to
+type providerSet struct {
+	embedders  map[string]Embedder
+	generators map[string]Generator
+	// fallbacks names each generator's fallback model, if it has one
+	fallbacks map[string]string
+	closers   []func()
+}
+
+// newProviderSet builds Gemini, if anything uses it, and every configured
+// provider. Embedders get the configured cache in front of them.
+func newProviderSet(opts RAGOptions) (*providerSet, error) {
+	set := &providerSet{
+		embedders:  make(map[string]Embedder),
+		generators: make(map[string]Generator),
+		fallbacks:  map[string]string{ProviderGemini: opts.FallbackModel},
+	}
+
+	if opts.Embedder != nil {
+		set.embedders[opts.EmbeddingProvider] = opts.Embedder
+	}
+	if opts.Generator != nil {
+		set.generators[opts.GenerativeProvider] = opts.Generator
+	}
+
+	// Replacements passed in opts stand in for the default providers
+	embedding, generative := opts.EmbeddingProvider, opts.GenerativeProvider
+	if opts.Embedder != nil {
+		embedding = ""
+	}
+	if opts.Generator != nil {
+		generative = ""
+	}
+
+	if usesProvider(ProviderGemini, embedding, generative, opts.Routing) {
+		gemini, err := NewGeminiService(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Gemini service: %w", err)
+		}
+		set.add(ProviderGemini, gemini, gemini)
+		set.closers = append(set.closers, gemini.Close)
+	}
+
+	for _, provider := range opts.Providers {
+		var client interface {
+			Embedder
+			Generator
+		}
+		switch provider.Kind {
+		case ProviderOpenAI:
+			client = NewOpenAIService(provider, opts)
+		case ProviderOllama:
+			client = NewOllamaService(provider, opts)
+		default:
+			set.Close()
+			return nil, fmt.Errorf("provider %s: unknown kind %q", provider.Name, provider.Kind)
+		}
+
+		// A provider without an embedding model only generates
+		var embedder Embedder
+		if provider.EmbeddingModel != "" {
+			embedder = client
+		}
+		set.add(provider.Name, embedder, client)
+		set.fallbacks[provider.Name] = provider.FallbackModel
+	}
+
+	for name, embedder := range set.embedders {
+		if name == opts.EmbeddingProvider && opts.Embedder != nil {
+			continue
+		}
+		cacheCfg := opts.EmbeddingCache
+		cacheCfg.Dir = filepath.Join(cacheCfg.Dir, name)
+		cache, err := NewEmbeddingCache(cacheCfg, embedder.EmbeddingModel())
+		if err != nil {
+			set.Close()
+			return nil, fmt.Errorf("failed to create %s embedding cache: %w", name, err)
+		}
+		set.embedders[name] = NewCachingEmbedder(embedder, cache)
+	}
+
+	return set, nil
+}
+
+// check confirms the default providers and every rule's providers exist
+func (s *providerSet) check(embedder, generator string, rules *RuleSet) error {
+	if _, ok := s.embedders[embedder]; !ok {
+		return fmt.Errorf("unknown embedding provider %q", embedder)
+	}
+	if _, ok := s.generators[generator]; !ok {
+		return fmt.Errorf("unknown generative provider %q", generator)
+	}
+	for _, rule := range rules.rules {
+		if _, ok := s.embedders[rule.EmbeddingProvider]; rule.EmbeddingProvider != "" && !ok {
+			return fmt.Errorf("%s: unknown embedding provider %q", rule.Name, rule.EmbeddingProvider)
+		}
+		if _, ok := s.generators[rule.Provider]; rule.Provider != "" && !ok {
+			return fmt.Errorf("%s: unknown provider %q", rule.Name, rule.Provider)
+		}
+	}
+	return nil
+}
+
+// add registers a provider unless a replacement was passed in RAGOptions
+func (s *providerSet) add(name string, embedder Embedder, generator Generator) {
+	if _, ok := s.embedders[name]; !ok && embedder != nil {
+		s.embedders[name] = embedder
+	}
+	if _, ok := s.generators[name]; !ok {
+		s.generators[name] = generator
+	}
+}
+
+func (s *providerSet) Close() {
+	for _, closeProvider := range s.closers {
+		closeProvider()
+	}
+}
+
+// postJSON sends body to url and decodes the JSON answer into out
+func postJSON(ctx context.Context, client *http.Client, service, url string, header http.Header, body, out interface{}) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s request: %w", service, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", service, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return &APIError{Service: service, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", service, err)
+	}
+	return nil
+}
+
+// checkEmbeddingSize fails an embedding whose size differs from the
+// configured one; dimensions 0 accepts any size
+func checkEmbeddingSize(values []float32, dimensions int) error {
+	if len(values) == 0 {
+		return fmt.Errorf("no embedding returned")
+	}
+	if dimensions > 0 && len(values) != dimensions {
+		return fmt.Errorf("embedding has %d dimensions, expected %d", len(values), dimensions)
+	}
+	return nil
+}
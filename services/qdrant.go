@@ -7,8 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 type QdrantService struct {
@@ -20,13 +21,13 @@ type QdrantService struct {
 }
 
 type SearchResult struct {
-	IncidentID string
-	Section    string
-	Service    string
-	Severity   string
-	Date       string
-	Text       string
-	Score      float32
+	IncidentID string  `json:"incident_id"`
+	Section    string  `json:"section"`
+	Service    string  `json:"service"`
+	Severity   string  `json:"severity"`
+	Date       string  `json:"date"`
+	Text       string  `json:"text"`
+	Score      float32 `json:"score"`
 }
 
 // Qdrant REST API structures
@@ -34,6 +35,7 @@ type searchRequest struct {
 	Vector      []float32 `json:"vector"`
 	Limit       int       `json:"limit"`
 	WithPayload bool      `json:"with_payload"`
+	Filter      *Filter   `json:"filter,omitempty"`
 }
 
 type searchResponse struct {
@@ -45,20 +47,16 @@ type searchResponse struct {
 	} `json:"result"`
 }
 
-func NewQdrantService() (*QdrantService, error) {
-	qdrantURL := os.Getenv("QDRANT_URL")
+// NewQdrantService creates a REST client for one collection
+func NewQdrantService(qdrantURL, qdrantAPIKey, collectionName string, timeout time.Duration) (*QdrantService, error) {
 	if qdrantURL == "" {
 		return nil, fmt.Errorf("QDRANT_URL is required")
 	}
-
-	qdrantAPIKey := os.Getenv("QDRANT_API_KEY")
 	if qdrantAPIKey == "" {
 		return nil, fmt.Errorf("QDRANT_API_KEY is required")
 	}
-
-	collectionName := os.Getenv("COLLECTION_NAME")
 	if collectionName == "" {
-		collectionName = "incident-knowledge-base"
+		collectionName = DefaultCollection
 	}
 
 	ctx := context.Background()
@@ -74,18 +72,27 @@ func NewQdrantService() (*QdrantService, error) {
 		apiKey:     qdrantAPIKey,
 		ctx:        ctx,
 		collection: collectionName,
-		httpClient: &http.Client{},
+		httpClient: &http.Client{Timeout: timeout},
 	}, nil
 }
 
-// SearchSimilarIncidents finds similar incidents using vector search
-func (q *QdrantService) SearchSimilarIncidents(embedding []float32, limit uint64) ([]SearchResult, error) {
+// SearchSimilarIncidents finds similar incidents using vector search,
+// among the points filter lets through; a nil filter searches them all
+func (q *QdrantService) SearchSimilarIncidents(embedding []float32, limit uint64, filter *Filter) ([]SearchResult, error) {
+	return q.SearchCollection(q.ctx, q.collection, embedding, limit, filter)
+}
+
+// SearchCollection runs the vector search against the named collection
+func (q *QdrantService) SearchCollection(ctx context.Context, collection string, embedding []float32, limit uint64, filter *Filter) ([]SearchResult, error) {
 	// Build search request
 	searchReq := searchRequest{
 		Vector:      embedding,
 		Limit:       int(limit),
 		WithPayload: true,
 	}
+	if !filter.IsEmpty() {
+		searchReq.Filter = filter
+	}
 
 	jsonData, err := json.Marshal(searchReq)
 	if err != nil {
@@ -93,8 +100,8 @@ func (q *QdrantService) SearchSimilarIncidents(embedding []float32, limit uint64
 	}
 
 	// Make HTTP request
-	url := fmt.Sprintf("%s/collections/%s/points/search", q.baseURL, q.collection)
-	req, err := http.NewRequestWithContext(q.ctx, "POST", url, bytes.NewBuffer(jsonData))
+	url := fmt.Sprintf("%s/collections/%s/points/search", q.baseURL, collection)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -110,7 +117,7 @@ func (q *QdrantService) SearchSimilarIncidents(embedding []float32, limit uint64
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("search failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("search failed: %w", &APIError{Service: "Qdrant", StatusCode: resp.StatusCode, Body: string(body)})
 	}
 
 	// Parse response
@@ -122,34 +129,163 @@ func (q *QdrantService) SearchSimilarIncidents(embedding []float32, limit uint64
 	// Convert to SearchResult
 	results := make([]SearchResult, 0, len(searchResp.Result))
 	for _, point := range searchResp.Result {
-		result := SearchResult{
-			Score: point.Score,
-		}
+		results = append(results, pointResult(point.Score, point.Payload))
+	}
 
-		// Extract payload fields
-		if val, ok := point.Payload["incident_id"].(string); ok {
-			result.IncidentID = val
-		}
-		if val, ok := point.Payload["section"].(string); ok {
-			result.Section = val
-		}
-		if val, ok := point.Payload["service"].(string); ok {
-			result.Service = val
-		}
-		if val, ok := point.Payload["severity"].(string); ok {
-			result.Severity = val
-		}
-		if val, ok := point.Payload["date"].(string); ok {
-			result.Date = val
-		}
-		if val, ok := point.Payload["text"].(string); ok {
-			result.Text = val
+	return results, nil
+}
+
+// scrollRequest asks POST /points/scroll for the points a filter lets through
+type scrollRequest struct {
+	Filter      *Filter `json:"filter"`
+	Limit       int     `json:"limit"`
+	WithPayload bool    `json:"with_payload"`
+	WithVector  bool    `json:"with_vector"`
+}
+
+// scrollResponse is a page of points from POST /points/scroll
+type scrollResponse struct {
+	Result struct {
+		Points []struct {
+			Payload map[string]interface{} `json:"payload"`
+		} `json:"points"`
+	} `json:"result"`
+}
+
+// IncidentSections returns every chunk stored for an incident, i.e. its full
+// postmortem, in the order ingest_incidents.py writes sections
+func (q *QdrantService) IncidentSections(ctx context.Context, collection, incidentID string) ([]SearchResult, error) {
+	scrollReq := scrollRequest{
+		Filter:      &Filter{Must: []Condition{MatchValue(PayloadIncidentID, incidentID)}},
+		Limit:       64,
+		WithPayload: true,
+	}
+
+	jsonData, err := json.Marshal(scrollReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal scroll request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/collections/%s/points/scroll", q.baseURL, collection)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api-key", q.apiKey)
+
+	resp, err := q.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch incident %s: %w", incidentID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to fetch incident %s: %w", incidentID, &APIError{Service: "Qdrant", StatusCode: resp.StatusCode, Body: string(body)})
+	}
+
+	var scrollResp scrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&scrollResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	sections := make([]SearchResult, 0, len(scrollResp.Result.Points))
+	for _, point := range scrollResp.Result.Points {
+		sections = append(sections, pointResult(0, point.Payload))
+	}
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sectionOrder(sections[i].Section) < sectionOrder(sections[j].Section)
+	})
+	return sections, nil
+}
+
+// ingestSections are the sections ingest_incidents.py stores, in its order
+var ingestSections = []string{"summary", "root_cause", "resolution", "prevention", "impact", "timeline"}
+
+func sectionOrder(section string) int {
+	for i, name := range ingestSections {
+		if name == section {
+			return i
 		}
+	}
+	return len(ingestSections)
+}
 
-		results = append(results, result)
+// pointResult reads a point's payload fields
+func pointResult(score float32, payload map[string]interface{}) SearchResult {
+	result := SearchResult{
+		Score: score,
 	}
 
-	return results, nil
+	// Extract payload fields
+	if val, ok := payload["incident_id"].(string); ok {
+		result.IncidentID = val
+	}
+	if val, ok := payload["section"].(string); ok {
+		result.Section = val
+	}
+	if val, ok := payload["service"].(string); ok {
+		result.Service = val
+	}
+	if val, ok := payload["severity"].(string); ok {
+		result.Severity = val
+	}
+	if val, ok := payload["date"].(string); ok {
+		result.Date = val
+	}
+	if val, ok := payload["text"].(string); ok {
+		result.Text = val
+	}
+
+	return result
+}
+
+// collectionResponse is the part of GET /collections/{name} describing the
+// collection's single unnamed vector
+type collectionResponse struct {
+	Result struct {
+		Config struct {
+			Params struct {
+				Vectors struct {
+					Size int `json:"size"`
+				} `json:"vectors"`
+			} `json:"params"`
+		} `json:"config"`
+	} `json:"result"`
+}
+
+// CollectionVectorSize returns the vector size the named collection was
+// created with
+func (q *QdrantService) CollectionVectorSize(collection string) (int, error) {
+	url := fmt.Sprintf("%s/collections/%s", q.baseURL, collection)
+	req, err := http.NewRequestWithContext(q.ctx, "GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("api-key", q.apiKey)
+
+	resp, err := q.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch collection %s: %w", collection, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("failed to fetch collection %s: %w", collection, &APIError{Service: "Qdrant", StatusCode: resp.StatusCode, Body: string(body)})
+	}
+
+	var collectionResp collectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&collectionResp); err != nil {
+		return 0, fmt.Errorf("failed to decode collection %s: %w", collection, err)
+	}
+
+	size := collectionResp.Result.Config.Params.Vectors.Size
+	if size == 0 {
+		return 0, fmt.Errorf("collection %s has no unnamed vector", collection)
+	}
+	return size, nil
 }
 
 func (q *QdrantService) Close() {
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload fields ingest_incidents.py stores on every point
+const (
+	PayloadIncidentID = "incident_id"
+	PayloadService    = "service"
+	PayloadSeverity   = "severity"
+	PayloadDate       = "date"
+)
+
+// Filter is a Qdrant payload filter. A point passes when every Must
+// condition holds, at least one Should condition holds (if there are any),
+// and no MustNot condition holds.
+type Filter struct {
+	Must    []Condition `json:"must,omitempty"`
+	Should  []Condition `json:"should,omitempty"`
+	MustNot []Condition `json:"must_not,omitempty"`
+}
+
+// Condition tests one payload field; build it with MatchValue, MatchAny or
+// DateRange
+type Condition struct {
+	Key   string     `json:"key"`
+	Match *Match     `json:"match,omitempty"`
+	Range *TimeRange `json:"range,omitempty"`
+}
+
+// Match is an exact keyword match against one value or any of several
+type Match struct {
+	Value string   `json:"value,omitempty"`
+	Any   []string `json:"any,omitempty"`
+}
+
+// TimeRange is a datetime range in RFC 3339; an empty bound is open
+type TimeRange struct {
+	GTE string `json:"gte,omitempty"`
+	LT  string `json:"lt,omitempty"`
+}
+
+// MatchValue holds when the field is exactly value
+func MatchValue(key, value string) Condition {
+	return Condition{Key: key, Match: &Match{Value: value}}
+}
+
+// MatchAny holds when the field is exactly one of values
+func MatchAny(key string, values ...string) Condition {
+	return Condition{Key: key, Match: &Match{Any: values}}
+}
+
+// DateRange holds when the field is a date or time from from, inclusive, to
+// to, exclusive. A zero bound is open.
+func DateRange(key string, from, to time.Time) Condition {
+	r := &TimeRange{}
+	if !from.IsZero() {
+		r.GTE = from.UTC().Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		r.LT = to.UTC().Format(time.RFC3339)
+	}
+	return Condition{Key: key, Range: r}
+}
+
+// IsEmpty reports whether the filter lets every point through
+func (f *Filter) IsEmpty() bool {
+	return f == nil || len(f.Must)+len(f.Should)+len(f.MustNot) == 0
+}
+
+// serviceNames spells a service the ways its payload may: as given, lower
+// case, and as serviceKey ("Checkout API" and "checkout-api")
+func serviceNames(service string) []string {
+	service = strings.TrimSpace(service)
+	return uniqueStrings([]string{service, strings.ToLower(service), serviceKey(service)})
+}
+
+// serviceKey is a service name in lower case with dashes for spaces
+func serviceKey(service string) string {
+	return strings.Join(strings.Fields(strings.ToLower(service)), "-")
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := values[:0]
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// RelatedServices maps a service to others whose incidents are relevant to
+// it, such as its dependencies. Relations hold both ways.
+type RelatedServices map[string][]string
+
+// ParseRelatedServices reads service=other|other entries separated by
+// commas, e.g. checkout-api=payments-api|cart-api
+func ParseRelatedServices(raw string) (RelatedServices, error) {
+	related := RelatedServices{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		service, others, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(service) == "" || strings.TrimSpace(others) == "" {
+			return nil, fmt.Errorf("related services %q is not service=other|other", entry)
+		}
+		for _, other := range strings.Split(others, "|") {
+			if other = strings.TrimSpace(other); other != "" {
+				related[strings.TrimSpace(service)] = append(related[strings.TrimSpace(service)], other)
+			}
+		}
+	}
+	return related, nil
+}
+
+// of returns service and the services related to it, in either direction,
+// under every spelling serviceNames gives
+func (r RelatedServices) of(service string) []string {
+	if strings.TrimSpace(service) == "" {
+		return nil
+	}
+
+	key := serviceKey(service)
+	group := map[string]bool{service: true}
+	for name, others := range r {
+		for _, other := range others {
+			switch key {
+			case serviceKey(name):
+				group[other] = true
+			case serviceKey(other):
+				group[name] = true
+			}
+		}
+	}
+
+	var members []string
+	for member := range group {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	var names []string
+	for _, member := range members {
+		names = append(names, serviceNames(member)...)
+	}
+	return uniqueStrings(names)
+}
+
+// ageFilter drops incidents older than the age horizon. It is nil when there
+// is none.
+func (r *RAGService) ageFilter() *Filter {
+	if r.maxIncidentAge <= 0 {
+		return nil
+	}
+	horizon := time.Now().UTC().AddDate(0, 0, -r.maxIncidentAge).Truncate(24 * time.Hour)
+	return &Filter{Must: []Condition{DateRange(PayloadDate, horizon, time.Time{})}}
+}
+
+// serviceFilter narrows the age filter to incidents of the alert's own or
+// related services. It is nil when the alert names no service.
+func (r *RAGService) serviceFilter(incident IncidentData) *Filter {
+	services := r.relatedServices.of(incident.Service)
+	if len(services) == 0 {
+		return nil
+	}
+	filter := &Filter{Must: []Condition{MatchAny(PayloadService, services...)}}
+	if age := r.ageFilter(); age != nil {
+		filter.Must = append(filter.Must, age.Must...)
+	}
+	return filter
+}
+
+// topUp appends the results of more not already in results, keeping their
+// order, until there are limit
+func topUp(results, more []SearchResult, limit uint64) []SearchResult {
+	seen := make(map[string]bool, len(results))
+	for _, result := range results {
+		seen[result.IncidentID+"|"+result.Section] = true
+	}
+	for _, result := range more {
+		if uint64(len(results)) >= limit {
+			break
+		}
+		if key := result.IncidentID + "|" + result.Section; !seen[key] {
+			seen[key] = true
+			results = append(results, result)
+		}
+	}
+	return results
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterJSON(t *testing.T) {
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 7, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{
+			name:   "match value",
+			filter: Filter{Must: []Condition{MatchValue(PayloadSeverity, "SEV1")}},
+			want:   `{"must":[{"key":"severity","match":{"value":"SEV1"}}]}`,
+		},
+		{
+			name:   "match any",
+			filter: Filter{Must: []Condition{MatchAny(PayloadService, "checkout-api", "payments-api")}},
+			want:   `{"must":[{"key":"service","match":{"any":["checkout-api","payments-api"]}}]}`,
+		},
+		{
+			name:   "date range in UTC",
+			filter: Filter{Must: []Condition{DateRange(PayloadDate, from, to)}},
+			want:   `{"must":[{"key":"date","range":{"gte":"2024-06-01T00:00:00Z","lt":"2024-07-01T10:00:00Z"}}]}`,
+		},
+		{
+			name:   "open-ended date range",
+			filter: Filter{Must: []Condition{DateRange(PayloadDate, from, time.Time{})}},
+			want:   `{"must":[{"key":"date","range":{"gte":"2024-06-01T00:00:00Z"}}]}`,
+		},
+		{
+			name: "should and must not",
+			filter: Filter{
+				Should:  []Condition{MatchValue(PayloadService, "cart-api")},
+				MustNot: []Condition{MatchValue(PayloadIncidentID, "INC-2024-001")},
+			},
+			want: `{"should":[{"key":"service","match":{"value":"cart-api"}}],"must_not":[{"key":"incident_id","match":{"value":"INC-2024-001"}}]}`,
+		},
+		{
+			name:   "empty",
+			filter: Filter{},
+			want:   `{}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("json = %s\nwant   %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	horizon := time.Now().UTC().AddDate(0, 0, -30).Truncate(24 * time.Hour).Format(time.RFC3339)
+	related := RelatedServices{"checkout-api": {"payments-api"}}
+
+	tests := []struct {
+		name        string
+		service     string
+		maxAge      int
+		wantService string
+		wantAge     string
+	}{
+		{
+			name:        "service only",
+			service:     "Checkout API",
+			wantService: `{"must":[{"key":"service","match":{"any":["Checkout API","checkout api","checkout-api","payments-api"]}}]}`,
+		},
+		{
+			name:        "related in reverse",
+			service:     "payments-api",
+			wantService: `{"must":[{"key":"service","match":{"any":["checkout-api","payments-api"]}}]}`,
+		},
+		{
+			name:        "service and age",
+			service:     "cart-api",
+			maxAge:      30,
+			wantService: `{"must":[{"key":"service","match":{"any":["cart-api"]}},{"key":"date","range":{"gte":"` + horizon + `"}}]}`,
+			wantAge:     `{"must":[{"key":"date","range":{"gte":"` + horizon + `"}}]}`,
+		},
+		{
+			name:    "age only",
+			maxAge:  30,
+			wantAge: `{"must":[{"key":"date","range":{"gte":"` + horizon + `"}}]}`,
+		},
+		{
+			name: "neither",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RAGService{relatedServices: related, maxIncidentAge: tt.maxAge}
+
+			if got := filterJSON(t, r.serviceFilter(IncidentData{Service: tt.service})); got != tt.wantService {
+				t.Errorf("serviceFilter = %s\nwant            %s", got, tt.wantService)
+			}
+			if got := filterJSON(t, r.ageFilter()); got != tt.wantAge {
+				t.Errorf("ageFilter = %s\nwant        %s", got, tt.wantAge)
+			}
+		})
+	}
+}
+
+// filterJSON marshals a filter; a nil filter is ""
+func filterJSON(t *testing.T, filter *Filter) string {
+	t.Helper()
+	if filter == nil {
+		return ""
+	}
+	data, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTopUp(t *testing.T) {
+	result := func(incidentID, section string) SearchResult {
+		return SearchResult{IncidentID: incidentID, Section: section}
+	}
+
+	tests := []struct {
+		name    string
+		results []SearchResult
+		more    []SearchResult
+		limit   uint64
+		want    []SearchResult
+	}{
+		{
+			name:    "preferred results stay first",
+			results: []SearchResult{result("INC-1", "root_cause")},
+			more:    []SearchResult{result("INC-9", "summary"), result("INC-8", "summary")},
+			limit:   3,
+			want:    []SearchResult{result("INC-1", "root_cause"), result("INC-9", "summary"), result("INC-8", "summary")},
+		},
+		{
+			name:    "duplicates are skipped",
+			results: []SearchResult{result("INC-1", "root_cause")},
+			more:    []SearchResult{result("INC-1", "root_cause"), result("INC-1", "resolution")},
+			limit:   3,
+			want:    []SearchResult{result("INC-1", "root_cause"), result("INC-1", "resolution")},
+		},
+		{
+			name:  "stops at the limit",
+			more:  []SearchResult{result("INC-9", "summary"), result("INC-8", "summary")},
+			limit: 1,
+			want:  []SearchResult{result("INC-9", "summary")},
+		},
+		{
+			name:    "already full",
+			results: []SearchResult{result("INC-1", "root_cause")},
+			more:    []SearchResult{result("INC-9", "summary")},
+			limit:   1,
+			want:    []SearchResult{result("INC-1", "root_cause")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := topUp(tt.results, tt.more, tt.limit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topUp() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRelatedServices(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    RelatedServices
+		wantErr bool
+	}{
+		{
+			name: "several",
+			raw:  "checkout-api=payments-api|cart-api, search=catalog",
+			want: RelatedServices{"checkout-api": {"payments-api", "cart-api"}, "search": {"catalog"}},
+		},
+		{
+			name: "empty",
+			raw:  "",
+			want: RelatedServices{},
+		},
+		{
+			name:    "no relations",
+			raw:     "checkout-api=",
+			wantErr: true,
+		},
+		{
+			name:    "no service",
+			raw:     "payments-api",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRelatedServices(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRelatedServices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
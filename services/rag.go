@@ -1,127 +1,853 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"strings"
+	"time"
 )
 
 type RAGService struct {
-	gemini    *GeminiService
+	providers *providerSet
+	// embedder and generator name the default providers
+	embedder  string
+	generator string
 	qdrant    *QdrantService
 	pagerduty *PagerDutyService
+	topK      uint64
+	rules     *RuleSet
+	// relatedServices and maxIncidentAge, in days, shape retrieval; see
+	// searchSimilar
+	relatedServices RelatedServices
+	maxIncidentAge  int
+	// promptBudget caps the built-in prompts, measured by tokenCounter
+	promptBudget int
+	tokenCounter string
+	newSink      func(SourceConfig) (NoteSink, error)
+
+	// prices turn each enrichment's tokens into a cost, counted in usage
+	prices ModelPrices
+	usage  *UsageLedger
+
+	// agent sets the default triage mode and bounds agent runs, which stop
+	// with ctx
+	agent AgentConfig
+	ctx   context.Context
+
+	// logger tags lines with the enrichment's tenant in the copies metered
+	// returns
+	logger *log.Logger
+
+	// tenants holds each extra PagerDuty account's client and collection
+	tenants map[string]tenantBackends
+}
+
+type tenantBackends struct {
+	pagerduty  *PagerDutyService
+	collection string
 }
 
 type IncidentData struct {
-	ID          string
-	Title       string
-	Description string
-	Service     string
-	Urgency     string
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Service     string `json:"service"`
+	Urgency     string `json:"urgency"`
+	// Tenant names the PagerDuty account the incident belongs to; empty is the default
+	Tenant string `json:"tenant,omitempty"`
+	// Source names the alert source the incident came from, e.g. pagerduty
+	// or alertmanager; empty when it was built by hand
+	Source string `json:"source,omitempty"`
+
+	// Details holds source-specific context such as dashboard links, monitor
+	// tags and the metric values that fired
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Pipeline defaults, shared by every entrypoint
+const (
+	DefaultEmbeddingModel = "models/gemini-embedding-001"
+	// DefaultEmbeddingDimensions matches EMBEDDING_DIMENSION in ingest_incidents.py
+	DefaultEmbeddingDimensions = 3072
+	DefaultGenerativeModel     = "gemini-2.0-flash-exp"
+	DefaultCollection          = "incident-knowledge-base"
+	DefaultTopK                = 3
+	DefaultTemperature         = 0.7
+	DefaultTopP                = 0.95
+	DefaultSamplingTopK        = 40
+	DefaultMaxOutputTokens     = 1024
+	DefaultGeminiTimeout       = 60 * time.Second
+	DefaultHTTPTimeout         = 15 * time.Second
+)
+
+// RAGOptions configures the enrichment pipeline. Empty fields fall back to
+// the defaults above.
+type RAGOptions struct {
+	GeminiAPIKey string
+	// GeminiEndpoint overrides the Gemini API base URL, e.g. to point at a stub
+	GeminiEndpoint string
+	EmbeddingModel string
+	// EmbeddingDimensions is the outputDimensionality requested for every embedding
+	EmbeddingDimensions int
+	// EmbeddingCache picks where query embeddings are cached; empty is memory
+	EmbeddingCache  EmbeddingCacheConfig
+	GenerativeModel string
+	// FallbackModel answers when Gemini's answer is blocked or empty
+	FallbackModel string
+	// Temperature and TopP are pointers because 0 is a valid setting; nil
+	// is the default
+	Temperature     *float32
+	TopP            *float32
+	SamplingTopK    int32
+	MaxOutputTokens int32
+	// GeminiTimeout bounds each embedding or generation call, whatever the provider
+	GeminiTimeout time.Duration
+	// GeminiQuota paces Gemini calls process-wide
+	GeminiQuota GeminiQuota
+	// GeminiRetry retries Gemini calls that fail with a rate limit, server
+	// error or timeout; the zero value means DefaultGeminiRetry
+	GeminiRetry RetryPolicy
+
+	// Context bounds every model call, so none outlives the request that
+	// built the pipeline; nil is context.Background()
+	Context context.Context
+
+	// EmbeddingProvider and GenerativeProvider name the default providers:
+	// gemini, or one of Providers
+	EmbeddingProvider  string
+	GenerativeProvider string
+	Providers          []ProviderConfig
+	// Embedder and Generator replace the default providers, e.g. with fakes
+	Embedder  Embedder
+	Generator Generator
+
+	QdrantURL    string
+	QdrantAPIKey string
+	Collection   string
+	TopK         int
+	// RelatedServices widens the same-service preference of retrieval to
+	// these services; MaxIncidentAgeDays drops older incidents, 0 keeps all.
+	// Retrieval falls back to every incident when nothing passes.
+	RelatedServices    RelatedServices
+	MaxIncidentAgeDays int
+
+	// PromptTokenBudget caps the built-in prompts; PromptTokenCounter is
+	// estimate or model
+	PromptTokenBudget  int
+	PromptTokenCounter string
+
+	// Usage prices model calls and sets the daily budget
+	Usage UsageConfig
+	// Agent picks classic or agent triage and bounds agent runs
+	Agent AgentConfig
+
+	PagerDutyToken string
+	PagerDutyEmail string
+	// PagerDutyURL overrides the REST API base URL (default https://api.pagerduty.com)
+	PagerDutyURL string
+
+	// HTTPTimeout bounds each Qdrant and PagerDuty request
+	HTTPTimeout time.Duration
+
+	// Tenants are PagerDuty accounts besides the default one
+	Tenants []TenantConfig
+
+	// Routing picks collections, models, prompts and sinks per alert
+	Routing RoutingConfig
+	// NewSink builds the sinks routing rules name; without it they are ignored
+	NewSink func(SourceConfig) (NoteSink, error)
+}
+
+// WithContext bounds every model call by ctx, e.g. the request a Vercel
+// function is serving
+func (o RAGOptions) WithContext(ctx context.Context) RAGOptions {
+	o.Context = ctx
+	return o
 }
 
-func NewRAGService() (*RAGService, error) {
-	gemini, err := NewGeminiService()
+// withDefaults fills in every unset field
+func (o RAGOptions) withDefaults() RAGOptions {
+	if o.EmbeddingModel == "" {
+		o.EmbeddingModel = DefaultEmbeddingModel
+	}
+	if o.EmbeddingProvider == "" {
+		o.EmbeddingProvider = ProviderGemini
+	}
+	if o.GenerativeProvider == "" {
+		o.GenerativeProvider = ProviderGemini
+	}
+	if o.EmbeddingDimensions == 0 {
+		o.EmbeddingDimensions = DefaultEmbeddingDimensions
+	}
+	if o.GenerativeModel == "" {
+		o.GenerativeModel = DefaultGenerativeModel
+	}
+	if o.Temperature == nil {
+		o.Temperature = float32Ptr(DefaultTemperature)
+	}
+	if o.TopP == nil {
+		o.TopP = float32Ptr(DefaultTopP)
+	}
+	if o.SamplingTopK == 0 {
+		o.SamplingTopK = DefaultSamplingTopK
+	}
+	if o.MaxOutputTokens == 0 {
+		o.MaxOutputTokens = DefaultMaxOutputTokens
+	}
+	if o.GeminiTimeout == 0 {
+		o.GeminiTimeout = DefaultGeminiTimeout
+	}
+	if o.GeminiRetry == (RetryPolicy{}) {
+		o.GeminiRetry = DefaultGeminiRetry
+	}
+	if o.HTTPTimeout == 0 {
+		o.HTTPTimeout = DefaultHTTPTimeout
+	}
+	if o.Collection == "" {
+		o.Collection = DefaultCollection
+	}
+	if o.TopK == 0 {
+		o.TopK = DefaultTopK
+	}
+	if o.PromptTokenBudget == 0 {
+		o.PromptTokenBudget = DefaultPromptTokenBudget
+	}
+	if o.PromptTokenCounter == "" {
+		o.PromptTokenCounter = TokenCounterEstimate
+	}
+	if o.PagerDutyURL == "" {
+		o.PagerDutyURL = defaultPagerDutyAPIURL
+	}
+	if o.Agent.Mode == "" {
+		o.Agent.Mode = TriageModeClassic
+	}
+	if o.Agent.MaxSteps == 0 {
+		o.Agent.MaxSteps = DefaultAgentMaxSteps
+	}
+	if o.Agent.Timeout == 0 {
+		o.Agent.Timeout = DefaultAgentTimeout
+	}
+	if o.Context == nil {
+		o.Context = context.Background()
+	}
+	return o
+}
+
+func float32Ptr(f float32) *float32 {
+	return &f
+}
+
+// NewRAGService builds the enrichment pipeline used by both the Vercel
+// functions and the local server
+func NewRAGService(opts RAGOptions) (*RAGService, error) {
+	opts = opts.withDefaults()
+
+	rules, err := NewRuleSet(opts.Routing)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Gemini service: %w", err)
+		return nil, fmt.Errorf("invalid routing rules: %w", err)
+	}
+
+	providers, err := newProviderSet(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := providers.check(opts.EmbeddingProvider, opts.GenerativeProvider, rules); err != nil {
+		providers.Close()
+		return nil, err
 	}
 
-	qdrant, err := NewQdrantService()
+	qdrant, err := NewQdrantService(opts.QdrantURL, opts.QdrantAPIKey, opts.Collection, opts.HTTPTimeout)
 	if err != nil {
+		providers.Close()
 		return nil, fmt.Errorf("failed to create Qdrant service: %w", err)
 	}
 
-	pagerduty := NewPagerDutyService()
+	tenants := make(map[string]tenantBackends, len(opts.Tenants))
+	for _, tenant := range opts.Tenants {
+		collection := tenant.Collection
+		if collection == "" {
+			collection = opts.Collection
+		}
+		tenants[tenant.Name] = tenantBackends{
+			pagerduty:  newPagerDutyService(tenant.PagerDuty.APIToken, tenant.PagerDuty.Email, tenant.PagerDuty.APIURL, opts.HTTPTimeout),
+			collection: collection,
+		}
+	}
 
 	return &RAGService{
-		gemini:    gemini,
-		qdrant:    qdrant,
-		pagerduty: pagerduty,
+		providers:    providers,
+		embedder:     opts.EmbeddingProvider,
+		generator:    opts.GenerativeProvider,
+		qdrant:       qdrant,
+		pagerduty:    newPagerDutyService(opts.PagerDutyToken, opts.PagerDutyEmail, opts.PagerDutyURL, opts.HTTPTimeout),
+		topK:         uint64(opts.TopK),
+		rules:        rules,
+		promptBudget: opts.PromptTokenBudget,
+		tokenCounter: opts.PromptTokenCounter,
+		newSink:      opts.NewSink,
+		prices:       opts.Usage.Prices,
+		usage:        sharedUsageLedger(opts.Usage),
+		agent:        opts.Agent,
+		ctx:          opts.Context,
+		logger:       log.Default(),
+		tenants:      tenants,
+
+		relatedServices: opts.RelatedServices,
+		maxIncidentAge:  opts.MaxIncidentAgeDays,
 	}, nil
 }
 
-// EnrichIncident performs the full RAG pipeline
+// PagerDuty returns the client for a tenant's account; an empty or unknown
+// tenant gets the default account
+func (r *RAGService) PagerDuty(tenant string) *PagerDutyService {
+	if backends, ok := r.tenants[tenant]; ok {
+		return backends.pagerduty
+	}
+	return r.pagerduty
+}
+
+// EmbeddingCacheStats reports each provider's query embedding cache; it is
+// empty when caching is off
+func (r *RAGService) EmbeddingCacheStats() map[string]EmbeddingCacheStats {
+	stats := make(map[string]EmbeddingCacheStats)
+	for name, embedder := range r.providers.embedders {
+		if cached, ok := embedder.(*CachingEmbedder); ok {
+			stats[name] = cached.CacheStats()
+		}
+	}
+	return stats
+}
+
+// collection returns the tenant's default Qdrant collection
+func (r *RAGService) collection(tenant string) string {
+	if backends, ok := r.tenants[tenant]; ok {
+		return backends.collection
+	}
+	return r.qdrant.collection
+}
+
+// CheckEmbeddingDimensions confirms every collection the pipeline searches
+// stores vectors of the size its embedder produces. A mismatch would make
+// every search fail, so it is worth catching at startup.
+func (r *RAGService) CheckEmbeddingDimensions() error {
+	targets := r.searchTargets()
+	collections := make([]string, 0, len(targets))
+	for collection := range targets {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	var problems []string
+	for _, collection := range collections {
+		size, err := r.qdrant.CollectionVectorSize(collection)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, name := range targets[collection] {
+			want := r.providers.embedders[name].EmbeddingDimensions()
+			if want > 0 && size != want {
+				problems = append(problems, fmt.Sprintf("collection %s stores %d-dimensional vectors but %s embeddings have %d (set embedding_dimensions)", collection, size, name, want))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("embedding dimensions don't match Qdrant:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// searchTargets maps every collection a tenant or routing rule can search to
+// the embedders that query it
+func (r *RAGService) searchTargets() map[string][]string {
+	targets := map[string][]string{}
+	add := func(embedder string, collections ...string) {
+		for _, collection := range collections {
+			if !containsString(targets[collection], embedder) {
+				targets[collection] = append(targets[collection], embedder)
+			}
+		}
+	}
+
+	defaults := []string{r.qdrant.collection}
+	for _, backends := range r.tenants {
+		defaults = append(defaults, backends.collection)
+	}
+	add(r.embedder, defaults...)
+
+	if r.rules != nil {
+		for _, rule := range r.rules.rules {
+			embedder := r.embedder
+			if rule.EmbeddingProvider != "" {
+				embedder = rule.EmbeddingProvider
+			}
+			if len(rule.Collections) > 0 {
+				add(embedder, rule.Collections...)
+			} else {
+				add(embedder, defaults...)
+			}
+		}
+	}
+	return targets
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Enrichment is everything the pipeline produced for one incident, so a
+// note can be previewed without posting it
+type Enrichment struct {
+	Incident IncidentData `json:"incident"`
+	// Rule is the routing rule that matched, if any
+	Rule    string         `json:"rule,omitempty"`
+	Results []SearchResult `json:"results"`
+	// Triage is the structured note, when the provider supports schemas
+	Triage *TriageNote `json:"triage,omitempty"`
+	// Degraded says what the note is missing when the model didn't finish
+	// its answer, e.g. it was cut off or came from the fallback model
+	Degraded []string `json:"degraded,omitempty"`
+	Prompt   string   `json:"prompt"`
+	// PromptReport says what the built-in prompt left out to fit its budget
+	PromptReport  *PromptReport `json:"prompt_report,omitempty"`
+	GeneratedText string        `json:"generated_text"`
+	Note          string        `json:"note"`
+	// Usage is the tokens every embedding and generation call used, priced
+	Usage *Usage `json:"usage,omitempty"`
+	// Agent is the transcript of an agent run's model turns and tool calls
+	Agent *AgentTranscript `json:"agent,omitempty"`
+}
+
+// EnrichIncident performs the full RAG pipeline and posts the note to the
+// incident's PagerDuty account
 func (r *RAGService) EnrichIncident(incident IncidentData) error {
-	// Step 1: Create search query from incident
-	searchQuery := fmt.Sprintf("%s %s", incident.Title, incident.Description)
+	_, err := r.EnrichIncidentTo(incident, r.PagerDuty(incident.Tenant))
+	return err
+}
 
-	// Step 2: Generate embedding
-	embedding, err := r.gemini.GenerateEmbedding(searchQuery, "RETRIEVAL_QUERY")
+// EnrichIncidentTo performs the full RAG pipeline and posts the note to sink.
+// It reports what the model calls cost, even when posting fails.
+func (r *RAGService) EnrichIncidentTo(incident IncidentData, sink NoteSink) (*Usage, error) {
+	enrichment, err := r.Enrich(incident)
 	if err != nil {
-		return fmt.Errorf("failed to generate embedding: %w", err)
+		return enrichment.usage(), err
 	}
 
-	// Step 3: Search for similar incidents
-	results, err := r.qdrant.SearchSimilarIncidents(embedding, 3)
+	sink, err = r.sinkFor(incident, sink)
 	if err != nil {
-		return fmt.Errorf("failed to search similar incidents: %w", err)
+		return enrichment.Usage, err
+	}
+	if err := sink.PostNote(incident.ID, enrichment.Note); err != nil {
+		return enrichment.Usage, fmt.Errorf("failed to post note: %w", err)
 	}
 
+	return enrichment.Usage, nil
+}
+
+// Enrich runs embedding, retrieval and generation and formats the triage
+// note, without posting it. Once the day's model budget is spent the note
+// lists the similar incidents only.
+func (r *RAGService) Enrich(incident IncidentData) (*Enrichment, error) {
+	meter := NewUsageMeter(r.prices)
+	enrichment, err := r.metered(meter, TenantLogger(incident.Tenant)).enrich(incident)
+	r.recordUsage(incident, meter, enrichment)
+	return enrichment, err
+}
+
+func (r *RAGService) enrich(incident IncidentData) (*Enrichment, error) {
+	route := r.route(incident)
+
+	// Step 1-3: Embed the incident and search for similar incidents
+	results, err := r.searchSimilar(incident, route)
+	if err != nil {
+		return nil, err
+	}
+
+	enrichment := &Enrichment{Incident: incident, Rule: route.Rule, Results: results}
 	if len(results) == 0 {
-		// No similar incidents found, post generic note
-		note := "================================\n       AI ENRICHMENT\n================================\n\nNo similar past incidents found in the knowledge base."
-		return r.pagerduty.PostNote(incident.ID, note)
+		// No similar incidents found, use a generic note
+		enrichment.Note = "================================\n       AI ENRICHMENT\n================================\n\nNo similar past incidents found in the knowledge base."
+		return enrichment, nil
+	}
+	if route.RetrievalOnly {
+		enrichment.Note = r.formatRetrievalNote(nil, results)
+		return enrichment, nil
+	}
+	if r.usage.OverBudget() {
+		r.logger.Printf("💸 Daily model budget spent, posting similar incidents only for incident %s", incident.ID)
+		enrichment.Degraded = []string{fmt.Sprintf("daily AI budget of $%.2f spent; showing similar incidents only", r.usage.Budget())}
+		enrichment.Note = r.formatRetrievalNote(enrichment.Degraded, results)
+		return enrichment, nil
+	}
+
+	// An agent run that fails still leaves the classic prompt to fall back on
+	if route.Mode == TriageModeAgent {
+		err := r.enrichWithAgent(route, enrichment)
+		if err == nil {
+			return enrichment, nil
+		}
+		r.logger.Printf("⚠️  Agent run for incident %s failed, falling back to the classic prompt: %v", incident.ID, err)
+		enrichment.Degraded = append(enrichment.Degraded, fmt.Sprintf("agent investigation failed (%v); answered with the classic prompt", err))
+	}
+
+	// The built-in prompt asks for a TriageNote when the provider can hold
+	// its answer to a schema; custom prompt templates get free text
+	_, ok := r.providers.generators[route.Provider].(StructuredGenerator)
+	if route.Prompt != nil {
+		ok = false
 	}
 
 	// Step 4: Build prompt for LLM
-	prompt := r.buildPrompt(incident, results)
+	enrichment.Prompt, enrichment.PromptReport, err = r.triagePrompt(route, incident, results, ok)
+	if err != nil {
+		return nil, err
+	}
+	if enrichment.PromptReport != nil {
+		logPromptReport(r.logger, incident.ID, enrichment.PromptReport)
+	}
 
 	// Step 5: Generate AI context
-	aiContext, err := r.gemini.GenerateContext(prompt)
+	run := r.generationRun(route)
+	if ok {
+		enrichment.Triage, enrichment.GeneratedText, err = generateTriageNote(run, enrichment.Prompt)
+	} else {
+		enrichment.GeneratedText, err = run.text(enrichment.Prompt)
+	}
+	enrichment.Degraded = append(enrichment.Degraded, run.degraded...)
+
+	// A blocked, unfinished or invalid answer still leaves the similar
+	// incidents worth posting
+	var genErr *GenerationError
+	if errors.As(err, &genErr) {
+		r.logger.Printf("⚠️  No usable answer for incident %s, posting similar incidents only: %v", incident.ID, err)
+		enrichment.Degraded = append(enrichment.Degraded, fmt.Sprintf("no AI answer: %v; showing similar incidents only", genErr))
+		enrichment.Note = r.formatRetrievalNote(enrichment.Degraded, results)
+		return enrichment, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate context: %w", err)
+	}
+
+	// Step 6: Format note
+	if enrichment.Triage != nil {
+		enrichment.Note = r.formatNote(enrichment.Degraded, enrichment.Triage.Render(), results)
+	} else {
+		enrichment.Note = r.formatNote(enrichment.Degraded, enrichment.GeneratedText, results)
+	}
+	return enrichment, nil
+}
+
+// DraftPostmortem generates a postmortem draft for a resolved incident, using
+// similar past incidents as a template, and posts it to the incident's
+// PagerDuty account
+func (r *RAGService) DraftPostmortem(incident IncidentData) error {
+	_, err := r.DraftPostmortemTo(incident, r.PagerDuty(incident.Tenant))
+	return err
+}
+
+// DraftPostmortemTo generates a postmortem draft and posts it to sink,
+// reporting what the model calls cost
+func (r *RAGService) DraftPostmortemTo(incident IncidentData, sink NoteSink) (*Usage, error) {
+	draft, err := r.Postmortem(incident)
 	if err != nil {
-		return fmt.Errorf("failed to generate context: %w", err)
+		return draft.usage(), err
 	}
 
-	// Step 6: Format and post note to PagerDuty
-	note := r.formatNote(aiContext, results)
-	err = r.pagerduty.PostNote(incident.ID, note)
+	sink, err = r.sinkFor(incident, sink)
 	if err != nil {
-		return fmt.Errorf("failed to post note: %w", err)
+		return draft.Usage, err
+	}
+	if err := sink.PostNote(incident.ID, draft.Note); err != nil {
+		return draft.Usage, fmt.Errorf("failed to post postmortem draft: %w", err)
 	}
 
-	return nil
+	return draft.Usage, nil
 }
 
-func (r *RAGService) buildPrompt(incident IncidentData, results []SearchResult) string {
+// Postmortem generates and formats a postmortem draft, without posting it.
+// It fails with ErrBudgetSpent once the day's model budget is spent.
+func (r *RAGService) Postmortem(incident IncidentData) (*Enrichment, error) {
+	if r.usage.OverBudget() {
+		return nil, fmt.Errorf("no postmortem draft for incident %s: %w", incident.ID, ErrBudgetSpent)
+	}
+
+	meter := NewUsageMeter(r.prices)
+	draft, err := r.metered(meter, TenantLogger(incident.Tenant)).postmortem(incident)
+	r.recordUsage(incident, meter, draft)
+	return draft, err
+}
+
+func (r *RAGService) postmortem(incident IncidentData) (*Enrichment, error) {
+	route := r.route(incident)
+
+	results, err := r.searchSimilar(incident, route)
+	if err != nil {
+		return nil, err
+	}
+
+	draft := &Enrichment{
+		Incident: incident,
+		Rule:     route.Rule,
+		Results:  results,
+	}
+	draft.Prompt, draft.PromptReport = r.buildPostmortemPrompt(route, incident, results)
+	logPromptReport(r.logger, incident.ID, draft.PromptReport)
+
+	run := r.generationRun(route)
+	draft.GeneratedText, err = run.text(draft.Prompt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate postmortem draft: %w", err)
+	}
+	draft.Degraded = run.degraded
+
 	var sb strings.Builder
+	sb.WriteString("================================\n")
+	sb.WriteString("     POSTMORTEM DRAFT (AI)\n")
+	sb.WriteString("================================\n\n")
+	writeDegraded(&sb, draft.Degraded)
+	sb.WriteString(draft.GeneratedText)
+	sb.WriteString("\n")
+	draft.Note = sb.String()
 
-	sb.WriteString("You are an expert SRE assistant helping with incident triage.\n\n")
-	sb.WriteString("NEW ALERT:\n")
-	sb.WriteString(fmt.Sprintf("Title: %s\n", incident.Title))
-	sb.WriteString(fmt.Sprintf("Description: %s\n", incident.Description))
-	sb.WriteString(fmt.Sprintf("Service: %s\n", incident.Service))
-	sb.WriteString(fmt.Sprintf("Urgency: %s\n\n", incident.Urgency))
+	return draft, nil
+}
 
-	sb.WriteString("SIMILAR PAST INCIDENTS:\n\n")
-	for idx, result := range results {
-		sb.WriteString(fmt.Sprintf("%d. %s (%s section, %.0f%% match)\n", idx+1, result.IncidentID, result.Section, result.Score*100))
-		sb.WriteString(fmt.Sprintf("   Service: %s | Severity: %s | Date: %s\n", result.Service, result.Severity, result.Date))
+// route picks the routing rule for an incident, filling in the defaults
+func (r *RAGService) route(incident IncidentData) Route {
+	return r.rules.Route(incident, Route{
+		Collections:       []string{r.collection(incident.Tenant)},
+		TopK:              r.topK,
+		EmbeddingProvider: r.embedder,
+		Provider:          r.generator,
+		Mode:              r.agent.Mode,
+	})
+}
 
-		// Truncate text to first 300 chars
-		text := result.Text
-		if len(text) > 300 {
-			text = text[:300] + "..."
+// sinkFor returns the sink the incident's routing rule names, or sink
+func (r *RAGService) sinkFor(incident IncidentData, sink NoteSink) (NoteSink, error) {
+	route := r.route(incident)
+	if strings.EqualFold(route.Sink.Sink, "pagerduty") {
+		if incident.Source != "" && incident.Source != SourcePagerDuty {
+			return nil, fmt.Errorf("rule %s sends notes to PagerDuty, but %s incident %s has no PagerDuty ID", route.Rule, incident.Source, incident.ID)
 		}
-		sb.WriteString(fmt.Sprintf("   Content: %s\n\n", text))
+		return r.PagerDuty(incident.Tenant), nil
+	}
+	if route.Sink.Sink == "" || r.newSink == nil {
+		return sink, nil
 	}
 
+	routed, err := r.newSink(route.Sink)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s sink for rule %s: %w", route.Sink.Sink, route.Rule, err)
+	}
+	return routed, nil
+}
+
+// searchSimilar embeds the incident and returns the closest past incidents
+// across the route's collections. Incidents of the same or related services
+// rank first, topped up with the closest of any service; only those within
+// the age horizon count, unless none do.
+func (r *RAGService) searchSimilar(incident IncidentData, route Route) ([]SearchResult, error) {
+	searchQuery := fmt.Sprintf("%s %s", incident.Title, incident.Description)
+
+	embedding, err := r.providers.embedders[route.EmbeddingProvider].GenerateEmbedding(r.ctx, searchQuery, TaskRetrievalQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	}
+
+	var results []SearchResult
+	if filter := r.serviceFilter(incident); filter != nil {
+		if results, err = r.searchCollections(route, embedding, filter); err != nil {
+			return nil, err
+		}
+	}
+	if uint64(len(results)) >= route.TopK {
+		return results, nil
+	}
+
+	age := r.ageFilter()
+	more, err := r.searchCollections(route, embedding, age)
+	if err == nil && len(more) == 0 && age != nil {
+		r.logger.Printf("🔎 No similar incidents within %d days for incident %s, searching them all", r.maxIncidentAge, incident.ID)
+		more, err = r.searchCollections(route, embedding, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return topUp(results, more, route.TopK), nil
+}
+
+// searchCollections runs one filtered search over the route's collections
+func (r *RAGService) searchCollections(route Route, embedding []float32, filter *Filter) ([]SearchResult, error) {
+	var results []SearchResult
+	for _, collection := range route.Collections {
+		found, err := r.qdrant.SearchCollection(r.ctx, collection, embedding, route.TopK, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search similar incidents in %s: %w", collection, err)
+		}
+		results = append(results, found...)
+	}
+
+	return mergeResults(results, route.TopK), nil
+}
+
+// generateTriageNote asks for a TriageNote, retrying once with the problem
+// spelled out when the answer doesn't validate. It returns the note and the
+// raw answer it came from.
+func generateTriageNote(run *generationRun, prompt string) (*TriageNote, string, error) {
+	text, err := run.json(prompt, TriageNoteSchema)
+	if err != nil {
+		return nil, "", err
+	}
+	note, err := ParseTriageNote(text)
+	if err == nil {
+		return note, text, nil
+	}
+
+	run.logger.Printf("⚠️  Retrying triage note generation: %v", err)
+	retryPrompt := fmt.Sprintf("%s\n\nYour previous answer was rejected (%v). Answer again with JSON matching the schema.", prompt, err)
+	text, err = run.json(retryPrompt, TriageNoteSchema)
+	if err != nil {
+		return nil, "", err
+	}
+	note, err = ParseTriageNote(text)
+	if err != nil {
+		return nil, text, &GenerationError{Service: run.provider, Reason: FinishInvalid, Detail: err.Error(), Text: text}
+	}
+	return note, text, nil
+}
+
+// triagePrompt renders the route's prompt template, or the built-in prompt
+// asking for a TriageNote (structured) or free text
+func (r *RAGService) triagePrompt(route Route, incident IncidentData, results []SearchResult, structured bool) (string, *PromptReport, error) {
+	if route.Prompt == nil {
+		prompt, report := r.buildPrompt(route, incident, results, structured)
+		return prompt, report, nil
+	}
+
+	var sb strings.Builder
+	if err := route.Prompt.Execute(&sb, PromptData{Incident: incident, Results: results}); err != nil {
+		return "", nil, fmt.Errorf("failed to render prompt %s: %w", route.Prompt.Name(), err)
+	}
+	return sb.String(), nil, nil
+}
+
+func (r *RAGService) buildPostmortemPrompt(route Route, incident IncidentData, results []SearchResult) (string, *PromptReport) {
+	sections := alertSections("You are an expert SRE writing a blameless postmortem draft for a resolved incident.\n\nRESOLVED INCIDENT:\n", incident)
+
+	if len(results) > 0 {
+		sections = append(sections, PromptSection{Name: "similar incidents", Text: "SIMILAR PAST INCIDENTS (for structure and recurring causes):\n\n"})
+		for idx, result := range results {
+			sections = append(sections, PromptSection{
+				Name:     resultSectionName(result),
+				Text:     fmt.Sprintf("%d. %s (%s section)\n   Content: %s\n\n", idx+1, result.IncidentID, result.Section, result.Text),
+				Priority: sectionPriority(result.Section),
+			})
+		}
+	}
+
+	var sb strings.Builder
 	sb.WriteString("TASK:\n")
-	sb.WriteString("Generate a concise triage note (max 400 words) with:\n")
-	sb.WriteString("1. Likely Root Cause (based on similar incidents)\n")
-	sb.WriteString("2. Recommended Resolution Steps (specific and actionable)\n")
-	sb.WriteString("3. Related Incident IDs for reference\n\n")
-	sb.WriteString("Format the response in clear, professional sections using proper headers.\n")
+	sb.WriteString("Draft a postmortem with these sections: Summary, Impact, Timeline, Root Cause,\n")
+	sb.WriteString("Resolution, Action Items. Mark anything you cannot know from the alert as TODO\n")
+	sb.WriteString("for the incident owner to fill in. Reference similar incident IDs where relevant.\n")
 	sb.WriteString("Use plain text formatting - no bold, italics, or markdown styling.\n")
-	sb.WriteString("Be concise and action-oriented. Focus on what the on-call engineer should do NOW.\n")
+	sections = append(sections, PromptSection{Name: "task", Text: sb.String()})
 
-	return sb.String()
+	return r.promptAssembler(route).Assemble(sections)
+}
+
+// buildPrompt fits the alert, the similar incidents and the task into the
+// route's token budget. Results keep their retrieval numbers, matching the
+// note's similarity scores, even when some are dropped.
+func (r *RAGService) buildPrompt(route Route, incident IncidentData, results []SearchResult, structured bool) (string, *PromptReport) {
+	sections := alertSections("You are an expert SRE assistant helping with incident triage.\n\nNEW ALERT:\n", incident)
+
+	sections = append(sections, resultSections(results)...)
+
+	var sb strings.Builder
+	sb.WriteString("TASK:\n")
+	if structured {
+		sb.WriteString("Triage the new alert as a JSON triage note:\n")
+		sb.WriteString("- root_cause: the likely root cause, based on the similar incidents\n")
+		sb.WriteString("- resolution_steps: specific, actionable steps in the order to take them\n")
+		sb.WriteString("- related_incidents: the IDs of the past incidents you drew on\n")
+		sb.WriteString("- confidence: 0 to 1; low when the past incidents only loosely match\n")
+		sb.WriteString("- suggested_severity: SEV1 (most severe) to SEV4\n")
+		sb.WriteString("- open_questions: what to check to confirm or rule out the root cause\n\n")
+		sb.WriteString("Be concise and action-oriented. Focus on what the on-call engineer should do NOW.\n")
+	} else {
+		sb.WriteString("Generate a concise triage note (max 400 words) with:\n")
+		sb.WriteString("1. Likely Root Cause (based on similar incidents)\n")
+		sb.WriteString("2. Recommended Resolution Steps (specific and actionable)\n")
+		sb.WriteString("3. Related Incident IDs for reference\n\n")
+		sb.WriteString("Format the response in clear, professional sections using proper headers.\n")
+		sb.WriteString("Use plain text formatting - no bold, italics, or markdown styling.\n")
+		sb.WriteString("Be concise and action-oriented. Focus on what the on-call engineer should do NOW.\n")
+	}
+	sections = append(sections, PromptSection{Name: "task", Text: sb.String()})
+
+	return r.promptAssembler(route).Assemble(sections)
+}
+
+// resultSections lays out the similar incidents, each droppable by its
+// section's priority
+func resultSections(results []SearchResult) []PromptSection {
+	sections := []PromptSection{{Name: "similar incidents", Text: "SIMILAR PAST INCIDENTS:\n\n"}}
+	for idx, result := range results {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("%d. %s (%s section, %.0f%% match)\n", idx+1, result.IncidentID, result.Section, result.Score*100))
+		sb.WriteString(fmt.Sprintf("   Service: %s | Severity: %s | Date: %s\n", result.Service, result.Severity, result.Date))
+		sb.WriteString(fmt.Sprintf("   Content: %s\n\n", result.Text))
+		sections = append(sections, PromptSection{Name: resultSectionName(result), Text: sb.String(), Priority: sectionPriority(result.Section)})
+	}
+	return sections
+}
+
+// alertSections lays out the alert after intro. The description and details
+// are trimmed rather than dropped when the alert alone overflows the budget.
+func alertSections(intro string, incident IncidentData) []PromptSection {
+	var details strings.Builder
+	writeDetails(&details, incident.Details)
+
+	return []PromptSection{
+		{Name: "alert", Text: intro + fmt.Sprintf("Title: %s\n", incident.Title)},
+		{Name: "alert description", Text: fmt.Sprintf("Description: %s\n", incident.Description), Trim: true},
+		{Name: "alert service", Text: fmt.Sprintf("Service: %s\nUrgency: %s\n", incident.Service, incident.Urgency)},
+		{Name: "alert details", Text: details.String(), Trim: true},
+		{Name: "alert", Text: "\n"},
+	}
 }
 
-func (r *RAGService) formatNote(aiContext string, results []SearchResult) string {
+// writeDetails lists an incident's source-specific details in key order
+func writeDetails(sb *strings.Builder, details map[string]string) {
+	keys := make([]string, 0, len(details))
+	for key := range details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", key, details[key]))
+	}
+}
+
+func (r *RAGService) formatNote(degraded []string, aiContext string, results []SearchResult) string {
 	var sb strings.Builder
 
 	sb.WriteString("================================\n")
 	sb.WriteString("       AI ENRICHMENT\n")
 	sb.WriteString("================================\n\n")
+	writeDegraded(&sb, degraded)
 	sb.WriteString(aiContext)
 	sb.WriteString("\n\n")
 	sb.WriteString("--------------------------------\n")
@@ -135,7 +861,40 @@ func (r *RAGService) formatNote(aiContext string, results []SearchResult) string
 	return sb.String()
 }
 
+// formatRetrievalNote lists the similar incidents for routes that skip
+// generation, or when the model gave no usable answer
+func (r *RAGService) formatRetrievalNote(degraded []string, results []SearchResult) string {
+	var sb strings.Builder
+
+	sb.WriteString("================================\n")
+	sb.WriteString("       AI ENRICHMENT\n")
+	sb.WriteString("================================\n\n")
+	writeDegraded(&sb, degraded)
+	sb.WriteString("SIMILAR PAST INCIDENTS\n")
+	sb.WriteString("--------------------------------\n")
+	for idx, result := range results {
+		sb.WriteString(fmt.Sprintf("  [%d] %s: %.1f%% match (%s)\n", idx+1, result.IncidentID, result.Score*100, result.Section))
+		sb.WriteString(fmt.Sprintf("      %s\n", truncateUTF8(result.Text, 200)))
+	}
+	sb.WriteString("\n")
+
+	return sb.String()
+}
+
+// writeDegraded flags a note whose AI output is incomplete or second-best, so
+// on-call doesn't take it at face value
+func writeDegraded(sb *strings.Builder, degraded []string) {
+	if len(degraded) == 0 {
+		return
+	}
+	sb.WriteString("*** DEGRADED AI OUTPUT ***\n")
+	for _, reason := range degraded {
+		sb.WriteString(fmt.Sprintf("- %s\n", reason))
+	}
+	sb.WriteString("\n")
+}
+
 func (r *RAGService) Close() {
-	r.gemini.Close()
+	r.providers.Close()
 	r.qdrant.Close()
 }
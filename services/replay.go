@@ -0,0 +1,106 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// enrichmentTitle heads every triage note, which is how earlier
+// enrichments are found among an incident's notes
+const enrichmentTitle = "AI ENRICHMENT"
+
+// noteHeaderWidth is the width of the ==== rule around note titles
+const noteHeaderWidth = 32
+
+// ReplayIncident fetches a PagerDuty incident's current title, body and
+// service from the tenant's account, runs the enrichment again and posts the
+// note marked as a revision of the latest earlier enrichment. It reports what
+// the model calls cost.
+func (r *RAGService) ReplayIncident(tenant, incidentID string) (*Usage, error) {
+	pagerduty := r.PagerDuty(tenant)
+
+	incident, err := pagerduty.GetIncident(incidentID)
+	if err != nil {
+		return nil, err
+	}
+	incident.Tenant = tenant
+
+	notes, err := pagerduty.ListNotes(incidentID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sink NoteSink = pagerduty
+	if previous := enrichmentNotes(notes); len(previous) > 0 {
+		sink = RevisionSink{
+			Sink:       pagerduty,
+			Revision:   len(previous) + 1,
+			Supersedes: previous[len(previous)-1],
+		}
+	}
+
+	// Revisions always go to PagerDuty, where the earlier notes were found,
+	// whatever sink a routing rule names
+	enrichment, err := r.Enrich(incident)
+	if err != nil {
+		return enrichment.usage(), err
+	}
+	if err := sink.PostNote(incident.ID, enrichment.Note); err != nil {
+		return enrichment.Usage, fmt.Errorf("failed to post note: %w", err)
+	}
+	return enrichment.Usage, nil
+}
+
+// enrichmentNotes picks the triage notes out of an incident's notes
+func enrichmentNotes(notes []Note) []Note {
+	var enrichments []Note
+	for _, note := range notes {
+		if strings.Contains(note.Content, enrichmentTitle) {
+			enrichments = append(enrichments, note)
+		}
+	}
+	return enrichments
+}
+
+// RevisionSink marks each note as a revision of an earlier enrichment before
+// passing it on
+type RevisionSink struct {
+	Sink       NoteSink
+	Revision   int
+	Supersedes Note
+}
+
+func (s RevisionSink) PostNote(incidentID, content string) error {
+	return s.Sink.PostNote(incidentID, markRevision(content, s.Revision, s.Supersedes))
+}
+
+// markRevision retitles a triage note "AI ENRICHMENT (REVISION n)" and notes
+// which enrichment it supersedes just below the header
+func markRevision(note string, revision int, previous Note) string {
+	at := strings.Index(note, enrichmentTitle+"\n")
+	if at < 0 {
+		return note
+	}
+	start := strings.LastIndex(note[:at], "\n") + 1
+	titleLine := note[start : at+len(enrichmentTitle)+1]
+
+	title := fmt.Sprintf("%s (REVISION %d)", enrichmentTitle, revision)
+	padding := (noteHeaderWidth - len(title)) / 2
+	if padding < 0 {
+		padding = 0
+	}
+	note = note[:start] + strings.Repeat(" ", padding) + title + "\n" + note[start+len(titleLine):]
+
+	supersedes := "Supersedes the earlier AI enrichment"
+	if previous.CreatedAt != "" {
+		supersedes += " posted at " + previous.CreatedAt
+	}
+	supersedes += ".\n\n"
+
+	// The header ends at the first blank line after the title
+	if end := strings.Index(note[start:], "\n\n"); end >= 0 {
+		end += start + 2
+		return note[:end] + supersedes + note[end:]
+	}
+	return note + "\n" + supersedes
+}
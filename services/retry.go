@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Gemini retry defaults
+const (
+	DefaultGeminiMaxRetries = 3
+	DefaultGeminiRetryBase  = 1 * time.Second
+	DefaultGeminiRetryMax   = 20 * time.Second
+)
+
+// RetryPolicy retries transient failures (see IsTransient) with jittered
+// exponential backoff
+type RetryPolicy struct {
+	// MaxRetries is how many times a failed call is repeated; 0 never retries
+	MaxRetries int
+	Base       time.Duration
+	Max        time.Duration
+}
+
+// DefaultGeminiRetry is used when RAGOptions sets no policy
+var DefaultGeminiRetry = RetryPolicy{
+	MaxRetries: DefaultGeminiMaxRetries,
+	Base:       DefaultGeminiRetryBase,
+	Max:        DefaultGeminiRetryMax,
+}
+
+// jitteredBackoff doubles from base per attempt, capped at max, with up to
+// 20% jitter so retries from an alert storm don't line up
+func jitteredBackoff(base, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// GeminiQuota is the client-side pace for Gemini calls; 0 is unlimited
+type GeminiQuota struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+// callLimiter paces calls to one API by requests and tokens per minute; a nil
+// bucket is unlimited
+type callLimiter struct {
+	requests *RateLimiter
+	tokens   *RateLimiter
+}
+
+// wait blocks until the call fits under both limits
+func (l *callLimiter) wait(ctx context.Context, tokens int) error {
+	if err := l.requests.Wait(ctx, 1); err != nil {
+		return fmt.Errorf("waiting for the request rate limit: %w", err)
+	}
+	if err := l.tokens.Wait(ctx, tokens); err != nil {
+		return fmt.Errorf("waiting for the token rate limit: %w", err)
+	}
+	return nil
+}
+
+var (
+	geminiLimitersMu sync.Mutex
+	geminiLimiters   = map[string]*callLimiter{}
+)
+
+// sharedGeminiLimiter returns the process's limiter for an API key, so every
+// pipeline built in a warm Vercel instance or the local server shares the
+// project's quota
+func sharedGeminiLimiter(apiKey string, quota GeminiQuota) *callLimiter {
+	geminiLimitersMu.Lock()
+	defer geminiLimitersMu.Unlock()
+
+	key := fmt.Sprintf("%s|%d|%d", apiKey, quota.RequestsPerMinute, quota.TokensPerMinute)
+	limiter, ok := geminiLimiters[key]
+	if !ok {
+		limiter = &callLimiter{
+			requests: NewRateLimiter(RateLimitConfig{EventsPerMinute: quota.RequestsPerMinute}),
+			tokens:   NewRateLimiter(RateLimitConfig{EventsPerMinute: quota.TokensPerMinute}),
+		}
+		geminiLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// call runs fn under the rate limit with a deadline of timeout from ctx,
+// retrying transient failures until the policy or ctx runs out, and logs each
+// retry through logger. tokens is what the call is expected to cost against
+// the tokens-per-minute limit.
+func (p RetryPolicy) call(ctx context.Context, logger *log.Logger, service string, limiter *callLimiter, timeout time.Duration, tokens int, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := limiter.wait(ctx, tokens); err != nil {
+			return err
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := fn(callCtx)
+		cancel()
+		if err == nil || attempt > p.MaxRetries || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := jitteredBackoff(p.Base, p.Max, attempt)
+		logger.Printf("🔁 %s call failed (attempt %d of %d), retrying in %v: %v", service, attempt, p.MaxRetries+1, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
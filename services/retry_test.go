@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyCall(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		errs       []error
+		wantCalls  int
+		wantErr    error
+	}{
+		{name: "succeeds first time", maxRetries: 3, errs: []error{nil}, wantCalls: 1},
+		{name: "transient error is retried", maxRetries: 3, errs: []error{errTestTransient, errTestTransient, nil}, wantCalls: 3},
+		{name: "permanent error is not retried", maxRetries: 3, errs: []error{errTestPermanent}, wantCalls: 1, wantErr: errTestPermanent},
+		{
+			name:       "gives up after MaxRetries",
+			maxRetries: 2,
+			errs:       []error{errTestTransient, errTestTransient, errTestTransient, nil},
+			wantCalls:  3,
+			wantErr:    errTestTransient,
+		},
+		{name: "no retries", maxRetries: 0, errs: []error{errTestTransient, nil}, wantCalls: 1, wantErr: errTestTransient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := RetryPolicy{MaxRetries: tt.maxRetries, Base: time.Millisecond, Max: 2 * time.Millisecond}
+
+			calls := 0
+			err := policy.call(context.Background(), log.Default(), "Gemini", &callLimiter{}, time.Second, 10, func(ctx context.Context) error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyCallDeadline(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 1, Base: time.Millisecond, Max: time.Millisecond}
+	start := time.Now()
+
+	err := policy.call(context.Background(), log.Default(), "Gemini", &callLimiter{}, 50*time.Millisecond, 10, func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok || deadline.Sub(start) > time.Second {
+			t.Errorf("call deadline = %v (set: %v), want about 50ms away", deadline, ok)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	// A timed-out attempt is retried, and each retry gets a fresh deadline
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("returned after %v, want two 50ms attempts", elapsed)
+	}
+}
+
+func TestRetryPolicyCallStopsWithContext(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, Base: time.Hour, Max: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- policy.call(ctx, log.Default(), "Gemini", &callLimiter{}, time.Second, 10, func(ctx context.Context) error {
+			calls++
+			return errTestTransient
+		})
+	}()
+
+	// Cancelling during the hour-long backoff ends the call with the last error
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errTestTransient) || calls != 1 {
+			t.Errorf("err = %v after %d call(s), want the first attempt's error", err, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call kept waiting after its context was cancelled")
+	}
+}
+
+func TestRetryPolicyCallWaitsForLimiter(t *testing.T) {
+	limiter := &callLimiter{requests: NewRateLimiter(RateLimitConfig{EventsPerMinute: 1})}
+	policy := RetryPolicy{}
+
+	if err := policy.call(context.Background(), log.Default(), "Gemini", limiter, time.Second, 10, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second request has to wait a minute, longer than its context allows
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	called := false
+	err := policy.call(ctx, log.Default(), "Gemini", limiter, time.Second, 10, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "waiting for the request rate limit") || called {
+		t.Errorf("err = %v (called: %v), want the rate limit wait to fail before calling", err, called)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "first", attempt: 1, min: time.Second, max: 1200 * time.Millisecond},
+		{name: "doubles", attempt: 2, min: 2 * time.Second, max: 2400 * time.Millisecond},
+		{name: "capped", attempt: 8, min: 20 * time.Second, max: 24 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				if got := jitteredBackoff(DefaultGeminiRetryBase, DefaultGeminiRetryMax, tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("jitteredBackoff(%d) = %v, want within [%v, %v]", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RoutingConfig tailors enrichment per alert. Rules live in the routing
+// section of the config file or in their own rules file.
+type RoutingConfig struct {
+	// File is a YAML file with prompts and rules; it replaces any set inline
+	File    string            `yaml:"file" env:"ROUTING_RULES_FILE"`
+	Prompts map[string]string `yaml:"prompts"`
+	Rules   []RoutingRule     `yaml:"rules"`
+}
+
+// RoutingRule picks the collections, model, prompt and sink for the alerts
+// it matches. The first matching rule wins; unset fields keep the defaults.
+type RoutingRule struct {
+	Name  string    `yaml:"name"`
+	Match RuleMatch `yaml:"match"`
+
+	Collections []string `yaml:"collections"`
+	TopK        int      `yaml:"top_k"`
+	// EmbeddingProvider embeds the query; its vectors must match the collections
+	EmbeddingProvider string `yaml:"embedding_provider"`
+	// Provider and GenerativeModel pick who writes the note; an empty model
+	// is the provider's default
+	Provider        string `yaml:"provider"`
+	GenerativeModel string `yaml:"generative_model"`
+	// Prompt names a template under prompts; empty uses the built-in triage prompt
+	Prompt string `yaml:"prompt"`
+	// RetrievalOnly posts the similar incidents without calling the model
+	RetrievalOnly bool `yaml:"retrieval_only"`
+	// Mode is classic or agent; empty keeps the default mode
+	Mode string `yaml:"mode"`
+	// Sink overrides where notes go: log, webhook, pagerduty or opsgenie
+	Sink    string `yaml:"sink"`
+	SinkURL string `yaml:"sink_url"`
+}
+
+// RuleMatch lists the conditions a rule needs; empty fields match anything
+type RuleMatch struct {
+	// Service is the PagerDuty service summary, compared ignoring case
+	Service string `yaml:"service"`
+	Urgency string `yaml:"urgency"`
+	// Title is a regular expression matched against the alert title
+	Title string `yaml:"title"`
+}
+
+// Route is the enrichment settings chosen for one incident
+type Route struct {
+	Rule              string
+	Collections       []string
+	TopK              uint64
+	EmbeddingProvider string
+	Provider          string
+	GenerativeModel   string
+	// Prompt is nil for the built-in triage prompt
+	Prompt        *template.Template
+	RetrievalOnly bool
+	// Mode is TriageModeClassic or TriageModeAgent
+	Mode string
+	// Sink is empty when notes go to the caller's sink
+	Sink SourceConfig
+}
+
+// PromptData is what a prompt template is executed with
+type PromptData struct {
+	Incident IncidentData
+	Results  []SearchResult
+}
+
+// promptFuncs are available to prompt templates
+var promptFuncs = template.FuncMap{
+	"percent": func(score float32) string { return fmt.Sprintf("%.0f%%", score*100) },
+	"truncate": func(n int, s string) string {
+		if len(s) <= n {
+			return s
+		}
+		return truncateUTF8(s, n) + "..."
+	},
+	"details": func(details map[string]string) string {
+		var sb strings.Builder
+		writeDetails(&sb, details)
+		return sb.String()
+	},
+}
+
+// RuleSet is a compiled RoutingConfig
+type RuleSet struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	RoutingRule
+	title  *regexp.Regexp
+	prompt *template.Template
+}
+
+// loadFile replaces the inline prompts and rules with the rules file's
+func (c *RoutingConfig) loadFile() error {
+	if c.File == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.File)
+	if err != nil {
+		return fmt.Errorf("failed to read routing rules file: %w", err)
+	}
+
+	var file RoutingConfig
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse routing rules file %s: %w", c.File, err)
+	}
+
+	c.Prompts = file.Prompts
+	c.Rules = file.Rules
+	return nil
+}
+
+// NewRuleSet compiles every rule's title pattern and prompt template
+func NewRuleSet(cfg RoutingConfig) (*RuleSet, error) {
+	prompts := make(map[string]*template.Template, len(cfg.Prompts))
+	for name, text := range cfg.Prompts {
+		tmpl, err := template.New(name).Funcs(promptFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("prompt %q: %w", name, err)
+		}
+		prompts[name] = tmpl
+	}
+
+	set := &RuleSet{}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		compiled := compiledRule{RoutingRule: rule}
+
+		if rule.Match.Title != "" {
+			title, err := regexp.Compile(rule.Match.Title)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid title pattern: %w", rule.Name, err)
+			}
+			compiled.title = title
+		}
+		if rule.Prompt != "" {
+			prompt, ok := prompts[rule.Prompt]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown prompt %q", rule.Name, rule.Prompt)
+			}
+			compiled.prompt = prompt
+		}
+		if rule.TopK < 0 {
+			return nil, fmt.Errorf("%s: top_k must not be negative", rule.Name)
+		}
+		if err := validateTriageMode(rule.Mode, true); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		if err := validateSinkKind(SourceConfig{Sink: rule.Sink, SinkURL: rule.SinkURL}); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+
+		set.rules = append(set.rules, compiled)
+	}
+
+	return set, nil
+}
+
+// Route applies the first rule matching incident on top of defaults
+func (s *RuleSet) Route(incident IncidentData, defaults Route) Route {
+	if s == nil {
+		return defaults
+	}
+
+	for _, rule := range s.rules {
+		if !rule.matches(incident) {
+			continue
+		}
+
+		route := defaults
+		route.Rule = rule.Name
+		if len(rule.Collections) > 0 {
+			route.Collections = rule.Collections
+		}
+		if rule.TopK > 0 {
+			route.TopK = uint64(rule.TopK)
+		}
+		if rule.EmbeddingProvider != "" {
+			route.EmbeddingProvider = rule.EmbeddingProvider
+		}
+		if rule.Provider != "" {
+			route.Provider = rule.Provider
+			route.GenerativeModel = ""
+		}
+		if rule.GenerativeModel != "" {
+			route.GenerativeModel = rule.GenerativeModel
+		}
+		if rule.prompt != nil {
+			route.Prompt = rule.prompt
+		}
+		route.RetrievalOnly = rule.RetrievalOnly
+		if rule.Mode != "" {
+			route.Mode = rule.Mode
+		}
+		route.Sink = SourceConfig{Sink: rule.Sink, SinkURL: rule.SinkURL}
+		return route
+	}
+
+	return defaults
+}
+
+// validateTriageMode accepts classic or agent, and empty when allowEmpty
+func validateTriageMode(mode string, allowEmpty bool) error {
+	switch {
+	case mode == TriageModeClassic, mode == TriageModeAgent, mode == "" && allowEmpty:
+		return nil
+	}
+	return fmt.Errorf("mode must be %s or %s, got %q", TriageModeClassic, TriageModeAgent, mode)
+}
+
+func (r compiledRule) matches(incident IncidentData) bool {
+	if r.Match.Service != "" && !strings.EqualFold(r.Match.Service, incident.Service) {
+		return false
+	}
+	if r.Match.Urgency != "" && !strings.EqualFold(r.Match.Urgency, incident.Urgency) {
+		return false
+	}
+	if r.title != nil && !r.title.MatchString(incident.Title) {
+		return false
+	}
+	return true
+}
+
+// mergeResults orders results from several collections by score and keeps
+// the best limit
+func mergeResults(results []SearchResult, limit uint64) []SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if uint64(len(results)) > limit {
+		results = results[:limit]
+	}
+	return results
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRuleSet(t *testing.T) *RuleSet {
+	t.Helper()
+	rules, err := NewRuleSet(RoutingConfig{
+		Prompts: map[string]string{"short": "{{.Incident.Title}}"},
+		Rules: []RoutingRule{
+			{
+				Name:        "checkout",
+				Match:       RuleMatch{Service: "Checkout-API"},
+				Collections: []string{"checkout_incidents"},
+				TopK:        5,
+				Provider:    "openai",
+			},
+			{
+				Name:            "disk",
+				Match:           RuleMatch{Title: `(?i)disk (full|space)`},
+				GenerativeModel: "gemini-2.5-pro",
+				Prompt:          "short",
+				Mode:            TriageModeAgent,
+				Sink:            "webhook",
+				SinkURL:         "https://chat.example.com/hook",
+			},
+			{
+				Name:            "low urgency",
+				Match:           RuleMatch{Urgency: "low"},
+				Provider:        "ollama",
+				GenerativeModel: "llama3.1",
+				RetrievalOnly:   true,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestRuleSetRoute(t *testing.T) {
+	defaults := Route{
+		Collections:       []string{"incidents"},
+		TopK:              3,
+		EmbeddingProvider: "gemini",
+		Provider:          "gemini",
+		GenerativeModel:   "gemini-2.5-flash",
+		RetrievalOnly:     true,
+		Mode:              TriageModeClassic,
+		Sink:              SourceConfig{Sink: "log"},
+	}
+
+	tests := []struct {
+		name       string
+		incident   IncidentData
+		want       func(route Route) Route
+		wantPrompt string
+	}{
+		{
+			name:     "no match keeps the defaults",
+			incident: IncidentData{Service: "search", Title: "Latency above SLO", Urgency: "high"},
+			want:     func(route Route) Route { return route },
+		},
+		{
+			name:     "service matches ignoring case",
+			incident: IncidentData{Service: "checkout-api", Title: "5xx rate above 5%"},
+			want: func(route Route) Route {
+				route.Rule = "checkout"
+				route.Collections = []string{"checkout_incidents"}
+				route.TopK = 5
+				// A new provider doesn't inherit the default provider's model
+				route.Provider = "openai"
+				route.GenerativeModel = ""
+				route.RetrievalOnly = false
+				route.Sink = SourceConfig{}
+				return route
+			},
+		},
+		{
+			name:     "first match wins",
+			incident: IncidentData{Service: "CHECKOUT-API", Title: "Disk full on checkout-db", Urgency: "low"},
+			want: func(route Route) Route {
+				route.Rule = "checkout"
+				route.Collections = []string{"checkout_incidents"}
+				route.TopK = 5
+				route.Provider = "openai"
+				route.GenerativeModel = ""
+				route.RetrievalOnly = false
+				route.Sink = SourceConfig{}
+				return route
+			},
+		},
+		{
+			name:     "title pattern",
+			incident: IncidentData{Service: "search", Title: "Low DISK SPACE on search-3"},
+			want: func(route Route) Route {
+				route.Rule = "disk"
+				route.GenerativeModel = "gemini-2.5-pro"
+				route.Mode = TriageModeAgent
+				route.RetrievalOnly = false
+				route.Sink = SourceConfig{Sink: "webhook", SinkURL: "https://chat.example.com/hook"}
+				return route
+			},
+			wantPrompt: "short",
+		},
+		{
+			name:     "provider and model",
+			incident: IncidentData{Service: "search", Title: "Slow queries", Urgency: "LOW"},
+			want: func(route Route) Route {
+				route.Rule = "low urgency"
+				route.Provider = "ollama"
+				route.GenerativeModel = "llama3.1"
+				route.RetrievalOnly = true
+				route.Sink = SourceConfig{}
+				return route
+			},
+		},
+	}
+
+	rules := testRuleSet(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rules.Route(tt.incident, defaults)
+			want := tt.want(defaults)
+
+			// Templates are compared by name
+			prompt := ""
+			if got.Prompt != nil {
+				prompt = got.Prompt.Name()
+			}
+			if prompt != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", prompt, tt.wantPrompt)
+			}
+			got.Prompt = nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Route() = %+v\nwant      %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestNilRuleSetRoute(t *testing.T) {
+	var rules *RuleSet
+	defaults := Route{Collections: []string{"incidents"}, TopK: 3, RetrievalOnly: true}
+	if got := rules.Route(IncidentData{Service: "checkout-api"}, defaults); !reflect.DeepEqual(got, defaults) {
+		t.Errorf("Route() = %+v, want the defaults", got)
+	}
+}
+
+func TestNewRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RoutingConfig
+		wantErr string
+	}{
+		{
+			name:    "bad title pattern",
+			cfg:     RoutingConfig{Rules: []RoutingRule{{Name: "broken", Match: RuleMatch{Title: "(unclosed"}}}},
+			wantErr: "broken: invalid title pattern",
+		},
+		{
+			name:    "unknown prompt",
+			cfg:     RoutingConfig{Rules: []RoutingRule{{Prompt: "missing"}}},
+			wantErr: `rule 1: unknown prompt "missing"`,
+		},
+		{
+			name:    "bad prompt template",
+			cfg:     RoutingConfig{Prompts: map[string]string{"bad": "{{.Incident"}},
+			wantErr: `prompt "bad"`,
+		},
+		{
+			name:    "negative top_k",
+			cfg:     RoutingConfig{Rules: []RoutingRule{{Name: "r", TopK: -1}}},
+			wantErr: "r: top_k must not be negative",
+		},
+		{
+			name:    "unknown mode",
+			cfg:     RoutingConfig{Rules: []RoutingRule{{Name: "r", Mode: "chatty"}}},
+			wantErr: "r: mode must be classic or agent",
+		},
+		{
+			name:    "webhook sink without a URL",
+			cfg:     RoutingConfig{Rules: []RoutingRule{{Name: "r", Sink: "webhook"}}},
+			wantErr: "r: sink_url is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRuleSet(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewRuleSet() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	results := []SearchResult{
+		{IncidentID: "INC-1", Score: 0.5},
+		{IncidentID: "INC-2", Score: 0.9},
+		{IncidentID: "INC-3", Score: 0.7},
+	}
+	got := mergeResults(results, 2)
+	if len(got) != 2 || got[0].IncidentID != "INC-2" || got[1].IncidentID != "INC-3" {
+		t.Errorf("mergeResults() = %+v, want INC-2 then INC-3", got)
+	}
+}
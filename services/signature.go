@@ -0,0 +1,84 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// SignatureHeader is the header PagerDuty v3 webhooks carry their HMAC signatures in
+const SignatureHeader = "X-PagerDuty-Signature"
+
+var (
+	ErrNoSigningSecrets = errors.New("no webhook signing secrets configured")
+	ErrMissingSignature = errors.New("missing " + SignatureHeader + " header")
+	ErrInvalidSignature = errors.New("no signature matched a configured signing secret")
+	ErrNoBearerTokens   = errors.New("no bearer tokens configured")
+	ErrInvalidToken     = errors.New("missing or invalid bearer token")
+)
+
+// VerifyWebhookSignature checks the X-PagerDuty-Signature header against the raw
+// request body. The header may list several "v1=<hex>" signatures (PagerDuty
+// signs with every active secret during rotation); one match against any of
+// the configured secrets is enough.
+func VerifyWebhookSignature(body []byte, header string, secrets []string) error {
+	if len(secrets) == 0 {
+		return ErrNoSigningSecrets
+	}
+	if strings.TrimSpace(header) == "" {
+		return ErrMissingSignature
+	}
+
+	for _, secret := range secrets {
+		expected := SignWebhookBody(body, secret)
+		for _, signature := range strings.Split(header, ",") {
+			if hmac.Equal([]byte(strings.TrimSpace(signature)), []byte(expected)) {
+				return nil
+			}
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// SignWebhookBody returns the "v1=<hex>" signature PagerDuty would send for body
+func SignWebhookBody(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SplitSecrets splits a comma-separated list of secrets, dropping blanks
+func SplitSecrets(raw string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(raw, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// VerifyBearerToken checks an "Authorization: Bearer <token>" header against
+// the configured tokens, for senders such as Alertmanager that can't sign bodies
+func VerifyBearerToken(header string, tokens []string) error {
+	if len(tokens) == 0 {
+		return ErrNoBearerTokens
+	}
+
+	presented, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || presented == "" {
+		return ErrInvalidToken
+	}
+
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return nil
+		}
+	}
+
+	return ErrInvalidToken
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"event": {"id": "01ABC", "event_type": "incident.triggered"}}`)
+
+	tests := []struct {
+		name    string
+		header  string
+		secrets []string
+		wantErr error
+	}{
+		{
+			name:    "valid",
+			header:  SignWebhookBody(body, "current"),
+			secrets: []string{"current"},
+		},
+		{
+			name:    "any configured secret",
+			header:  SignWebhookBody(body, "next"),
+			secrets: []string{"current", "next"},
+		},
+		{
+			name:    "any listed signature during rotation",
+			header:  SignWebhookBody(body, "old") + ", " + SignWebhookBody(body, "current"),
+			secrets: []string{"current"},
+		},
+		{
+			name:    "missing",
+			header:  "",
+			secrets: []string{"current"},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name:    "blank",
+			header:  "  ",
+			secrets: []string{"current"},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name:    "wrong secret",
+			header:  SignWebhookBody(body, "other"),
+			secrets: []string{"current"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "other body",
+			header:  SignWebhookBody([]byte(`{}`), "current"),
+			secrets: []string{"current"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "no version prefix",
+			header:  strings.TrimPrefix(SignWebhookBody(body, "current"), "v1="),
+			secrets: []string{"current"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "garbage",
+			header:  "v1=not-hex",
+			secrets: []string{"current"},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "no secrets configured",
+			header:  SignWebhookBody(body, "current"),
+			wantErr: ErrNoSigningSecrets,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyWebhookSignature(body, tt.header, tt.secrets)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyWebhookSignature() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPagerDutySourceRejectsUnsignedDeliveries(t *testing.T) {
+	body := []byte(`{"event": {"id": "01ABC", "event_type": "incident.triggered", "data": {"id": "PINC123", "title": "Checkout errors"}}}`)
+	source := PagerDutySource{Secrets: []string{"current"}}
+
+	tests := []struct {
+		name       string
+		header     string
+		wantOK     bool
+		wantStatus int
+	}{
+		{name: "signed", header: SignWebhookBody(body, "current"), wantOK: true, wantStatus: http.StatusOK},
+		{name: "missing signature", header: "", wantStatus: http.StatusUnauthorized},
+		{name: "bad signature", header: SignWebhookBody(body, "other"), wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/webhook", bytes.NewReader(body))
+			if tt.header != "" {
+				r.Header.Set(SignatureHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			event, ok := ReadSourceEvent(w, r, source)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ok && event.Incident.ID != "PINC123" {
+				t.Errorf("incident = %q, want PINC123", event.Incident.ID)
+			}
+		})
+	}
+}
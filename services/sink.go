@@ -0,0 +1,101 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NoteSink receives the finished enrichment note for an incident
+type NoteSink interface {
+	PostNote(incidentID, content string) error
+}
+
+// NewNoteSink builds a source's sink: "pagerduty", "opsgenie", "webhook"
+// (POSTs JSON to the sink URL) or "log". Each source has its own sink, so one
+// deployment can answer PagerDuty and Opsgenie alerts side by side.
+func NewNoteSink(cfg *Config, source SourceConfig) (NoteSink, error) {
+	if err := validateSinkKind(source); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(source.Sink) {
+	case "pagerduty":
+		return NewPagerDutyService(cfg), nil
+	case "opsgenie":
+		return NewOpsgenieService(cfg)
+	case "webhook":
+		return NewWebhookSink(source.SinkURL, cfg.HTTPTimeout), nil
+	default:
+		return LogSink{}, nil
+	}
+}
+
+// validateSinkKind checks a source's sink settings without building the sink
+func validateSinkKind(source SourceConfig) error {
+	switch strings.ToLower(source.Sink) {
+	case "", "log", "pagerduty", "opsgenie":
+		return nil
+	case "webhook":
+		if source.SinkURL == "" {
+			return fmt.Errorf("sink_url is required for the webhook sink")
+		}
+		return nil
+	default:
+		return fmt.Errorf("sink %q is unknown (expected log, webhook, pagerduty or opsgenie)", source.Sink)
+	}
+}
+
+// LogSink writes notes to the process log
+type LogSink struct{}
+
+func (LogSink) PostNote(incidentID, content string) error {
+	log.Printf("📝 Enrichment for %s:\n%s", incidentID, content)
+	return nil
+}
+
+// WebhookSink POSTs {"incident_id", "content"} as JSON to a URL, e.g. a chat
+// incoming webhook or an internal incident tracker
+type WebhookSink struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewWebhookSink(url string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{
+		url:        url,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *WebhookSink) PostNote(incidentID, content string) error {
+	jsonData, err := json.Marshal(map[string]string{
+		"incident_id": incidentID,
+		"content":     content,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post note: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &APIError{Service: "Note webhook", StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// maxSourceBodyBytes caps how much of a webhook request body is read
+const maxSourceBodyBytes = 1 << 20
+
+// Source adapts one alerting tool's webhook to a lifecycle event, so every
+// route shares the same request handling and only parsing differs
+type Source interface {
+	// Name identifies the source in logs and responses
+	Name() string
+	// Authenticate checks the raw request before its body is parsed
+	Authenticate(r *http.Request, body []byte) error
+	// Parse turns the body into an event; ok is false when there is nothing to act on
+	Parse(body []byte) (event Event, ok bool, err error)
+}
+
+// SourceRoute wires an alert source into an entrypoint. The name doubles as
+// the route path (/api/<name>), the job sink name and the sources.<name>
+// config section.
+type SourceRoute struct {
+	Name string
+	New  func(auth BearerAuth) Source
+}
+
+// NewSource builds the route's source with its configured tokens
+func (r SourceRoute) NewSource(cfg *Config) Source {
+	return r.New(BearerAuth{Tokens: cfg.Sources.Source(r.Name).Tokens})
+}
+
+// NewSink builds the route's configured note sink
+func (r SourceRoute) NewSink(cfg *Config) (NoteSink, error) {
+	return NewNoteSink(cfg, cfg.Sources.Source(r.Name))
+}
+
+// SourceRoutes lists the alert sources served next to the PagerDuty webhook
+var SourceRoutes = []SourceRoute{
+	{Name: "alertmanager", New: func(auth BearerAuth) Source { return AlertmanagerSource{auth} }},
+	{Name: "opsgenie", New: func(auth BearerAuth) Source { return OpsgenieSource{auth} }},
+	{Name: "grafana", New: func(auth BearerAuth) Source { return GrafanaSource{auth} }},
+	{Name: "datadog", New: func(auth BearerAuth) Source { return DatadogSource{auth} }},
+}
+
+// LookupSourceRoute finds a source route by name
+func LookupSourceRoute(name string) (SourceRoute, bool) {
+	for _, route := range SourceRoutes {
+		if route.Name == name {
+			return route, true
+		}
+	}
+	return SourceRoute{}, false
+}
+
+// ReadSourceEvent reads, authenticates and parses a webhook request. When ok
+// is false the response has already been written: an error, or 200 "ignored"
+// for a payload with nothing to act on.
+func ReadSourceEvent(w http.ResponseWriter, r *http.Request, source Source) (event Event, ok bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return Event{}, false
+	}
+	logger := sourceLogger(source)
+
+	// Read the raw body so it can be authenticated before decoding
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSourceBodyBytes))
+	if err != nil {
+		logger.Printf("Failed to read %s payload: %v", source.Name(), err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return Event{}, false
+	}
+
+	if err := source.Authenticate(r, body); err != nil {
+		logger.Printf("🚫 Rejected %s webhook from %s: %v", source.Name(), r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return Event{}, false
+	}
+
+	event, ok, err = source.Parse(body)
+	if err != nil {
+		logger.Printf("Failed to decode %s payload: %v", source.Name(), err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return Event{}, false
+	}
+	if !ok {
+		logger.Printf("⭐️ Ignoring %s payload: nothing to triage", source.Name())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "ignored",
+			"reason": "nothing to triage",
+		})
+		return Event{}, false
+	}
+
+	event.Incident.Source = source.Name()
+
+	// Force is never read from the request: the signature covers only the
+	// body, so anyone holding one signed delivery could replay it at will.
+	// DryRun is, but handlers only honour it with AuthorizeDryRun.
+	event.DryRun = IsDryRun(r)
+	return event, true
+}
+
+// ClaimEvent reports whether an event is new. Events without a delivery ID,
+// forced replays and dedup failures are always processed.
+func ClaimEvent(store DedupStore, event Event) bool {
+	if event.ID == "" || event.Force {
+		return true
+	}
+	fresh, err := store.Claim(EventKey(event.ID))
+	if err != nil {
+		TenantLogger(event.Incident.Tenant).Printf("⚠️  Dedup check failed for event %s, processing anyway: %v", event.ID, err)
+		return true
+	}
+	return fresh
+}
+
+// SourcePagerDuty is IncidentData.Source for incidents with PagerDuty IDs
+const SourcePagerDuty = "pagerduty"
+
+// PagerDutySource handles PagerDuty v3 webhooks signed with X-PagerDuty-Signature
+// for one tenant's account
+type PagerDutySource struct {
+	Secrets []string
+	Tenant  string
+}
+
+// NewPagerDutySource uses the tenant's webhook signing secrets
+func NewPagerDutySource(tenant TenantConfig) PagerDutySource {
+	return PagerDutySource{Secrets: tenant.PagerDuty.WebhookSecrets, Tenant: tenant.ID()}
+}
+
+func (PagerDutySource) Name() string { return SourcePagerDuty }
+
+func (s PagerDutySource) TenantID() string { return s.Tenant }
+
+func (s PagerDutySource) Authenticate(r *http.Request, body []byte) error {
+	return VerifyWebhookSignature(body, r.Header.Get(SignatureHeader), s.Secrets)
+}
+
+func (s PagerDutySource) Parse(body []byte) (Event, bool, error) {
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, false, err
+	}
+	event := payload.ToEvent()
+	event.Incident.Tenant = s.Tenant
+	return event, true, nil
+}
+
+// tenantSource is implemented by sources bound to one tenant
+type tenantSource interface {
+	TenantID() string
+}
+
+// sourceLogger tags log lines with the source's tenant
+func sourceLogger(source Source) *log.Logger {
+	var tenant string
+	if ts, ok := source.(tenantSource); ok {
+		tenant = ts.TenantID()
+	}
+	return TenantLogger(tenant)
+}
+
+// BearerAuth is embedded by sources that authenticate with a bearer token
+type BearerAuth struct {
+	Tokens []string
+}
+
+func (a BearerAuth) Authenticate(r *http.Request, body []byte) error {
+	return VerifyBearerToken(r.Header.Get("Authorization"), a.Tokens)
+}
+
+// AlertmanagerSource handles Prometheus Alertmanager webhooks
+type AlertmanagerSource struct {
+	BearerAuth
+}
+
+func (AlertmanagerSource) Name() string { return "alertmanager" }
+
+// Parse folds the group into one triggered event; resolved notifications
+// carry nothing to triage
+func (AlertmanagerSource) Parse(body []byte) (Event, bool, error) {
+	var payload AlertmanagerPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, false, err
+	}
+	if len(payload.FiringAlerts()) == 0 {
+		return Event{}, false, nil
+	}
+	return Event{Type: EventIncidentTriggered, Incident: payload.ToIncident()}, true, nil
+}
+
+// OpsgenieSource handles Opsgenie alert webhooks
+type OpsgenieSource struct {
+	BearerAuth
+}
+
+func (OpsgenieSource) Name() string { return "opsgenie" }
+
+func (OpsgenieSource) Parse(body []byte) (Event, bool, error) {
+	var payload OpsgeniePayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, false, err
+	}
+	event, ok := payload.ToEvent()
+	return event, ok, nil
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTenant is the tenant built from the top-level PagerDuty settings.
+// Its incidents carry an empty Tenant.
+const DefaultTenant = "default"
+
+// SubscriptionHeader carries the ID of the PagerDuty webhook subscription a
+// delivery came from
+const SubscriptionHeader = "X-Webhook-Subscription"
+
+// tenantNamePattern keeps tenant names usable as a path segment and an env prefix
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// TenantConfig is one PagerDuty account. Deliveries reach a tenant on
+// /api/webhook/<name>, or on /api/webhook by their subscription ID.
+type TenantConfig struct {
+	Name            string          `yaml:"name"`
+	SubscriptionIDs []string        `yaml:"subscription_ids" env:"SUBSCRIPTION_IDS"`
+	PagerDuty       PagerDutyConfig `yaml:"pagerduty"`
+	// Collection defaults to qdrant.collection
+	Collection string          `yaml:"collection" env:"COLLECTION_NAME"`
+	RateLimit  RateLimitConfig `yaml:"rate_limit" env:"RATE_LIMIT_"`
+}
+
+// RateLimitConfig caps how many events a tenant may submit; zero is unlimited
+type RateLimitConfig struct {
+	EventsPerMinute int `yaml:"events_per_minute" env:"EVENTS_PER_MINUTE"`
+	Burst           int `yaml:"burst" env:"BURST"`
+}
+
+// ID is the tenant's value for IncidentData.Tenant
+func (t TenantConfig) ID() string {
+	if t.Name == DefaultTenant {
+		return ""
+	}
+	return t.Name
+}
+
+// envPrefix is where a tenant's environment overrides live, e.g.
+// TENANT_ACME_PAGERDUTY_API_TOKEN
+func (t TenantConfig) envPrefix() string {
+	return "TENANT_" + strings.ToUpper(strings.ReplaceAll(t.Name, "-", "_")) + "_"
+}
+
+// DefaultTenant returns the tenant built from the top-level settings
+func (c *Config) DefaultTenant() TenantConfig {
+	return TenantConfig{
+		Name:       DefaultTenant,
+		PagerDuty:  c.PagerDuty,
+		Collection: c.Qdrant.Collection,
+		RateLimit:  c.RateLimit,
+	}
+}
+
+// AllTenants returns the default tenant followed by the configured ones
+func (c *Config) AllTenants() []TenantConfig {
+	return append([]TenantConfig{c.DefaultTenant()}, c.Tenants...)
+}
+
+// Tenant finds a tenant by name; an empty name is the default tenant
+func (c *Config) Tenant(name string) (TenantConfig, bool) {
+	if name == "" || name == DefaultTenant {
+		return c.DefaultTenant(), true
+	}
+	for _, tenant := range c.Tenants {
+		if tenant.Name == name {
+			return tenant, true
+		}
+	}
+	return TenantConfig{}, false
+}
+
+// ResolveTenant picks the tenant for a PagerDuty delivery: the one named in
+// the path if any, else the one owning the subscription, else the default
+func (c *Config) ResolveTenant(r *http.Request, name string) (TenantConfig, bool) {
+	if name != "" {
+		return c.Tenant(name)
+	}
+	if subscription := r.Header.Get(SubscriptionHeader); subscription != "" {
+		for _, tenant := range c.Tenants {
+			for _, id := range tenant.SubscriptionIDs {
+				if id == subscription {
+					return tenant, true
+				}
+			}
+		}
+	}
+	return c.DefaultTenant(), true
+}
+
+// applyTenantEnv applies each tenant's TENANT_<NAME>_ overrides
+func (c *Config) applyTenantEnv() error {
+	for i := range c.Tenants {
+		tenant := &c.Tenants[i]
+		if tenant.Name == "" {
+			continue
+		}
+		if err := applyEnv(reflect.ValueOf(tenant).Elem(), tenant.envPrefix()); err != nil {
+			return err
+		}
+		if tenant.Collection == "" {
+			tenant.Collection = c.Qdrant.Collection
+		}
+		if tenant.PagerDuty.APIURL == "" {
+			tenant.PagerDuty.APIURL = c.PagerDuty.APIURL
+		}
+	}
+	return nil
+}
+
+// validateTenants reports each tenant's problems through report
+func (c *Config) validateTenants(report func(format string, args ...interface{})) {
+	names := map[string]bool{DefaultTenant: true}
+	subscriptions := map[string]string{}
+
+	for i, tenant := range c.Tenants {
+		field := fmt.Sprintf("tenants[%d]", i)
+		switch {
+		case tenant.Name == DefaultTenant:
+			report("%s.name %q is reserved for the top-level settings", field, DefaultTenant)
+		case !tenantNamePattern.MatchString(tenant.Name):
+			report("%s.name %q must be lowercase letters, digits and dashes", field, tenant.Name)
+		case names[tenant.Name]:
+			report("%s.name %q is used twice", field, tenant.Name)
+		}
+		names[tenant.Name] = true
+
+		prefix := tenant.envPrefix()
+		if tenant.PagerDuty.APIToken == "" {
+			report("%s.pagerduty.api_token is required (set %sPAGERDUTY_API_TOKEN)", field, prefix)
+		}
+		if tenant.PagerDuty.Email == "" {
+			report("%s.pagerduty.email is required (set %sPAGERDUTY_EMAIL)", field, prefix)
+		}
+		if tenant.RateLimit.EventsPerMinute < 0 || tenant.RateLimit.Burst < 0 {
+			report("%s.rate_limit must not be negative", field)
+		}
+
+		for _, id := range tenant.SubscriptionIDs {
+			if owner, ok := subscriptions[id]; ok {
+				report("%s: subscription %s already belongs to tenant %s", field, id, owner)
+			}
+			subscriptions[id] = tenant.Name
+		}
+	}
+}
+
+// TenantLogger tags every line with the tenant; an empty tenant is the default
+func TenantLogger(tenant string) *log.Logger {
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	return log.New(log.Writer(), "[tenant="+tenant+"] ", log.Flags()|log.Lmsgprefix)
+}
+
+// RateLimiter is a token bucket allowing EventsPerMinute with bursts of Burst
+type RateLimiter struct {
+	mu       sync.Mutex
+	perToken time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+// NewRateLimiter returns nil, which allows everything, when cfg has no limit
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.EventsPerMinute <= 0 {
+		return nil
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.EventsPerMinute
+	}
+	return &RateLimiter{
+		perToken: time.Minute / time.Duration(cfg.EventsPerMinute),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// Allow takes a token if one is available, otherwise it reports how long
+// until the next one
+func (l *RateLimiter) Allow() (bool, time.Duration) {
+	return l.take(1)
+}
+
+// Wait blocks until n tokens are available, or ctx is done. More than the
+// burst waits for a full bucket.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	for {
+		ok, wait := l.take(float64(n))
+		if ok {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *RateLimiter) take(n float64) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n > l.burst {
+		n = l.burst
+	}
+
+	now := time.Now()
+	l.tokens += float64(now.Sub(l.last)) / float64(l.perToken)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < n {
+		return false, time.Duration((n - l.tokens) * float64(l.perToken))
+	}
+	l.tokens -= n
+	return true, 0
+}
+
+// TenantLimiters holds each tenant's rate limiter and counts its decisions
+type TenantLimiters struct {
+	limiters map[string]*RateLimiter
+
+	mu    sync.Mutex
+	stats map[string]*TenantStats
+}
+
+// TenantStats counts a tenant's accepted and rate-limited events
+type TenantStats struct {
+	Accepted    int `json:"accepted"`
+	RateLimited int `json:"rate_limited"`
+}
+
+// NewTenantLimiters builds a limiter for every tenant in cfg
+func NewTenantLimiters(cfg *Config) *TenantLimiters {
+	t := &TenantLimiters{
+		limiters: make(map[string]*RateLimiter),
+		stats:    make(map[string]*TenantStats),
+	}
+	for _, tenant := range cfg.AllTenants() {
+		t.limiters[tenant.ID()] = NewRateLimiter(tenant.RateLimit)
+	}
+	return t
+}
+
+var (
+	tenantLimitersMu sync.Mutex
+	tenantLimiters   *TenantLimiters
+)
+
+// SharedTenantLimiters returns the process's limiters, built from cfg on
+// first use, so every handler in a warm Vercel instance spends the same
+// tenant budgets
+func SharedTenantLimiters(cfg *Config) *TenantLimiters {
+	tenantLimitersMu.Lock()
+	defer tenantLimitersMu.Unlock()
+
+	if tenantLimiters == nil {
+		tenantLimiters = NewTenantLimiters(cfg)
+	}
+	return tenantLimiters
+}
+
+// Admit applies the event's tenant rate limit. When it is exceeded it answers
+// 429 with Retry-After and returns false.
+func (t *TenantLimiters) Admit(w http.ResponseWriter, event Event) bool {
+	tenant := event.Incident.Tenant
+	ok, wait := t.limiters[tenant].Allow()
+
+	t.mu.Lock()
+	stats := t.stats[tenant]
+	if stats == nil {
+		stats = &TenantStats{}
+		t.stats[tenant] = stats
+	}
+	if ok {
+		stats.Accepted++
+	} else {
+		stats.RateLimited++
+	}
+	t.mu.Unlock()
+
+	if ok {
+		return true
+	}
+
+	retryAfter := int(wait.Seconds()) + 1
+	TenantLogger(tenant).Printf("🚦 Rate limit reached, asking sender to retry in %ds", retryAfter)
+	w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+	http.Error(w, "Tenant rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+// Stats returns each tenant's counts, keyed by tenant name
+func (t *TenantLimiters) Stats() map[string]TenantStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make(map[string]TenantStats, len(t.stats))
+	for tenant, s := range t.stats {
+		if tenant == "" {
+			tenant = DefaultTenant
+		}
+		stats[tenant] = *s
+	}
+	return stats
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema that Gemini, OpenAI-compatible APIs
+// and Ollama all accept for structured output
+type Schema struct {
+	Type        string             `json:"type"`
+	Description string             `json:"description,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+}
+
+// StructuredGenerator is a Generator that can hold its output to a schema
+type StructuredGenerator interface {
+	Generator
+	// GenerateJSON completes prompt with a JSON document matching schema
+	GenerateJSON(model, prompt string, schema *Schema) (string, error)
+}
+
+// Severities a TriageNote may suggest, matching the incident corpus
+var Severities = []string{"SEV1", "SEV2", "SEV3", "SEV4"}
+
+// TriageNote is the model's triage of a new alert
+type TriageNote struct {
+	RootCause         string   `json:"root_cause"`
+	ResolutionSteps   []string `json:"resolution_steps"`
+	RelatedIncidents  []string `json:"related_incidents"`
+	Confidence        float64  `json:"confidence"`
+	SuggestedSeverity string   `json:"suggested_severity"`
+	OpenQuestions     []string `json:"open_questions"`
+}
+
+// TriageNoteSchema is the response schema generation is held to
+var TriageNoteSchema = &Schema{
+	Type: "object",
+	Properties: map[string]*Schema{
+		"root_cause": {
+			Type:        "string",
+			Description: "The most likely root cause, grounded in the similar past incidents",
+		},
+		"resolution_steps": {
+			Type:        "array",
+			Description: "Specific, actionable steps for the on-call engineer, in the order to take them",
+			Items:       &Schema{Type: "string"},
+		},
+		"related_incidents": {
+			Type:        "array",
+			Description: "IDs of the past incidents the triage draws on",
+			Items:       &Schema{Type: "string"},
+		},
+		"confidence": {
+			Type:        "number",
+			Description: "Confidence in the root cause, from 0 to 1",
+		},
+		"suggested_severity": {
+			Type:        "string",
+			Description: "Suggested severity for the new incident",
+			Enum:        Severities,
+		},
+		"open_questions": {
+			Type:        "array",
+			Description: "What the on-call engineer should check to confirm or rule out the root cause",
+			Items:       &Schema{Type: "string"},
+		},
+	},
+	Required: []string{"root_cause", "resolution_steps", "related_incidents", "confidence", "suggested_severity", "open_questions"},
+}
+
+// ParseTriageNote decodes and validates a model's JSON answer
+func ParseTriageNote(text string) (*TriageNote, error) {
+	// Some OpenAI-compatible servers wrap JSON in a code fence despite the schema
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "```json")
+	text = strings.TrimPrefix(text, "```")
+	text = strings.TrimSuffix(text, "```")
+
+	var note TriageNote
+	if err := json.Unmarshal([]byte(text), &note); err != nil {
+		return nil, fmt.Errorf("triage note is not valid JSON: %w", err)
+	}
+	if err := note.Validate(); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// Validate reports every field that doesn't satisfy the schema
+func (n *TriageNote) Validate() error {
+	var problems []string
+	if strings.TrimSpace(n.RootCause) == "" {
+		problems = append(problems, "root_cause is empty")
+	}
+	if len(n.ResolutionSteps) == 0 {
+		problems = append(problems, "resolution_steps is empty")
+	}
+	if n.Confidence < 0 || n.Confidence > 1 {
+		problems = append(problems, fmt.Sprintf("confidence %g is not between 0 and 1", n.Confidence))
+	}
+	if !containsString(Severities, n.SuggestedSeverity) {
+		problems = append(problems, fmt.Sprintf("suggested_severity %q is not one of %s", n.SuggestedSeverity, strings.Join(Severities, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid triage note: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Render lays the note out as the plain-text sections of a PagerDuty note
+func (n *TriageNote) Render() string {
+	var sb strings.Builder
+
+	sb.WriteString("LIKELY ROOT CAUSE\n")
+	sb.WriteString("--------------------------------\n")
+	sb.WriteString(n.RootCause)
+	sb.WriteString(fmt.Sprintf("\n(confidence %.0f%%, suggested severity %s)\n\n", n.Confidence*100, n.SuggestedSeverity))
+
+	sb.WriteString("RESOLUTION STEPS\n")
+	sb.WriteString("--------------------------------\n")
+	for idx, step := range n.ResolutionSteps {
+		sb.WriteString(fmt.Sprintf("%d. %s\n", idx+1, step))
+	}
+
+	if len(n.RelatedIncidents) > 0 {
+		sb.WriteString("\nRELATED INCIDENTS\n")
+		sb.WriteString("--------------------------------\n")
+		sb.WriteString(strings.Join(n.RelatedIncidents, ", "))
+		sb.WriteString("\n")
+	}
+
+	if len(n.OpenQuestions) > 0 {
+		sb.WriteString("\nOPEN QUESTIONS\n")
+		sb.WriteString("--------------------------------\n")
+		for _, question := range n.OpenQuestions {
+			sb.WriteString(fmt.Sprintf("- %s\n", question))
+		}
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+const testTriageNoteJSON = `{"root_cause": "Connection pool exhausted after the deploy.", "resolution_steps": ["Roll back the deploy.", "Raise the pool size."], "related_incidents": ["INC-2024-007"], "confidence": 0.8, "suggested_severity": "SEV2", "open_questions": ["Did traffic spike?"]}`
+
+func TestParseTriageNote(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr []string
+	}{
+		{name: "valid", text: testTriageNoteJSON},
+		{name: "code fence", text: "```json\n" + testTriageNoteJSON + "\n```"},
+		{name: "not JSON", text: "Likely root cause: the deploy", wantErr: []string{"not valid JSON"}},
+		{
+			name:    "empty root cause",
+			text:    `{"root_cause": " ", "resolution_steps": ["Roll back."], "confidence": 0.5, "suggested_severity": "SEV3"}`,
+			wantErr: []string{"root_cause is empty"},
+		},
+		{
+			name:    "confidence out of range",
+			text:    `{"root_cause": "Deploy", "resolution_steps": ["Roll back."], "confidence": 80, "suggested_severity": "SEV3"}`,
+			wantErr: []string{"confidence 80 is not between 0 and 1"},
+		},
+		{
+			name: "every problem is reported",
+			text: `{"root_cause": "", "resolution_steps": [], "confidence": -1, "suggested_severity": "P1"}`,
+			wantErr: []string{
+				"root_cause is empty",
+				"resolution_steps is empty",
+				"confidence -1 is not between 0 and 1",
+				`suggested_severity "P1" is not one of SEV1, SEV2, SEV3, SEV4`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			note, err := ParseTriageNote(tt.text)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if note.SuggestedSeverity != "SEV2" || len(note.ResolutionSteps) != 2 {
+					t.Errorf("note = %+v, want the fixture's", note)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ParseTriageNote() = %+v, want an error", note)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err = %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTriageNoteRender(t *testing.T) {
+	note, err := ParseTriageNote(testTriageNoteJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "LIKELY ROOT CAUSE\n--------------------------------\n" +
+		"Connection pool exhausted after the deploy.\n(confidence 80%, suggested severity SEV2)\n\n" +
+		"RESOLUTION STEPS\n--------------------------------\n" +
+		"1. Roll back the deploy.\n2. Raise the pool size.\n\n" +
+		"RELATED INCIDENTS\n--------------------------------\nINC-2024-007\n\n" +
+		"OPEN QUESTIONS\n--------------------------------\n- Did traffic spike?"
+	if got := note.Render(); got != want {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// jsonAnswers is a StructuredGenerator that gives its answers in turn and
+// records the prompts it was sent
+type jsonAnswers struct {
+	answers []string
+	prompts []string
+}
+
+func (j *jsonAnswers) Generate(model, prompt string) (string, error) {
+	return "", errors.New("free text not expected")
+}
+
+func (j *jsonAnswers) GenerateJSON(model, prompt string, schema *Schema) (string, error) {
+	j.prompts = append(j.prompts, prompt)
+	answer := j.answers[0]
+	j.answers = j.answers[1:]
+	return answer, nil
+}
+
+func TestGenerateTriageNote(t *testing.T) {
+	const invalid = `{"root_cause": "", "resolution_steps": [], "confidence": 0.5, "suggested_severity": "SEV2"}`
+
+	tests := []struct {
+		name        string
+		answers     []string
+		wantCalls   int
+		wantInvalid bool
+	}{
+		{name: "valid first time", answers: []string{testTriageNoteJSON}, wantCalls: 1},
+		{name: "valid on retry", answers: []string{invalid, testTriageNoteJSON}, wantCalls: 2},
+		{name: "invalid twice", answers: []string{invalid, "not json"}, wantCalls: 2, wantInvalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generator := &jsonAnswers{answers: tt.answers}
+			run := &generationRun{provider: ProviderGemini, generator: generator, logger: log.Default()}
+
+			note, text, err := generateTriageNote(run, "triage this")
+			if len(generator.prompts) != tt.wantCalls {
+				t.Fatalf("model asked %d times, want %d", len(generator.prompts), tt.wantCalls)
+			}
+			if tt.wantCalls == 2 && !strings.Contains(generator.prompts[1], "Your previous answer was rejected") {
+				t.Errorf("retry prompt doesn't say why the answer was rejected:\n%s", generator.prompts[1])
+			}
+
+			if tt.wantInvalid {
+				var genErr *GenerationError
+				if !errors.As(err, &genErr) || genErr.Reason != FinishInvalid {
+					t.Fatalf("err = %v, want a GenerationError with reason %s", err, FinishInvalid)
+				}
+				if text != "not json" || genErr.Text != "not json" {
+					t.Errorf("text = %q, want the last answer kept", text)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if note == nil || text != testTriageNoteJSON {
+				t.Errorf("note = %+v, text = %q; want the valid answer", note, text)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBudgetSpent is returned for work that needs generation once the day's
+// model budget is spent
+var ErrBudgetSpent = errors.New("daily model budget spent")
+
+// ModelPrice is what a model charges in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// ModelPrices maps model names, without the models/ prefix, to their rates
+type ModelPrices map[string]ModelPrice
+
+// ParseModelPrices reads a rate table written as model=input/output pairs
+// separated by commas, e.g. gemini-2.0-flash=0.10/0.40
+func ParseModelPrices(raw string) (ModelPrices, error) {
+	prices := ModelPrices{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, rates, ok := strings.Cut(entry, "=")
+		input, output, ok2 := strings.Cut(rates, "/")
+		if !ok || !ok2 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("price %q is not model=input/output", entry)
+		}
+
+		var price ModelPrice
+		var err error
+		if price.Input, err = strconv.ParseFloat(strings.TrimSpace(input), 64); err != nil {
+			return nil, fmt.Errorf("price %q: %w", entry, err)
+		}
+		if price.Output, err = strconv.ParseFloat(strings.TrimSpace(output), 64); err != nil {
+			return nil, fmt.Errorf("price %q: %w", entry, err)
+		}
+		prices[usageModelName(strings.TrimSpace(model))] = price
+	}
+	return prices, nil
+}
+
+// usageModelName is how usage and prices name a model: models/x and x are
+// the same Gemini model
+func usageModelName(model string) string {
+	return strings.TrimPrefix(model, "models/")
+}
+
+// ModelUsage is the tokens one model used and what they cost
+type ModelUsage struct {
+	// Tenant is set in the ledger's totals, which are kept per tenant
+	Tenant           string  `json:"tenant,omitempty"`
+	Model            string  `json:"model"`
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+	// Estimated marks counts made locally because the API reported none,
+	// as with Gemini embeddings and blocked answers
+	Estimated bool `json:"estimated,omitempty"`
+	// Unpriced marks a model missing from the rate table; its cost is 0
+	Unpriced bool `json:"unpriced,omitempty"`
+}
+
+func (m *ModelUsage) add(other ModelUsage) {
+	m.Calls += other.Calls
+	m.PromptTokens += other.PromptTokens
+	m.CompletionTokens += other.CompletionTokens
+	m.CostUSD += other.CostUSD
+	m.Estimated = m.Estimated || other.Estimated
+	m.Unpriced = m.Unpriced || other.Unpriced
+}
+
+// Usage is what the model calls behind one enrichment or postmortem cost
+type Usage struct {
+	PromptTokens     int          `json:"prompt_tokens"`
+	CompletionTokens int          `json:"completion_tokens"`
+	CostUSD          float64      `json:"cost_usd"`
+	Models           []ModelUsage `json:"models,omitempty"`
+}
+
+// addUsage returns total plus more, model by model, so a job retried after a
+// failure reports every attempt's calls. total is left as it was, since job
+// snapshots share it.
+func addUsage(total, more *Usage) *Usage {
+	if more == nil {
+		return total
+	}
+
+	sum := &Usage{}
+	if total != nil {
+		*sum = *total
+		sum.Models = append([]ModelUsage(nil), total.Models...)
+	}
+	sum.PromptTokens += more.PromptTokens
+	sum.CompletionTokens += more.CompletionTokens
+	sum.CostUSD += more.CostUSD
+next:
+	for _, counted := range more.Models {
+		for i := range sum.Models {
+			if sum.Models[i].Model == counted.Model {
+				sum.Models[i].add(counted)
+				continue next
+			}
+		}
+		sum.Models = append(sum.Models, counted)
+	}
+	return sum
+}
+
+// UsageMeter counts the model calls made for one enrichment. Providers bound
+// to it record every call that reaches the API; a nil meter records nothing.
+type UsageMeter struct {
+	mu     sync.Mutex
+	prices ModelPrices
+	models map[string]*ModelUsage
+	order  []string
+}
+
+func NewUsageMeter(prices ModelPrices) *UsageMeter {
+	return &UsageMeter{prices: prices, models: make(map[string]*ModelUsage)}
+}
+
+// Record counts one call to model. estimated says the counts are local
+// estimates rather than the API's.
+func (m *UsageMeter) Record(model string, promptTokens, completionTokens int, estimated bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	model = usageModelName(model)
+	usage, ok := m.models[model]
+	if !ok {
+		usage = &ModelUsage{Model: model}
+		m.models[model] = usage
+		m.order = append(m.order, model)
+	}
+	usage.add(ModelUsage{Calls: 1, PromptTokens: promptTokens, CompletionTokens: completionTokens, Estimated: estimated})
+}
+
+// Usage prices the calls recorded so far, per model in the order first used
+func (m *UsageMeter) Usage() *Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage := &Usage{}
+	for _, model := range m.order {
+		counted := *m.models[model]
+		price, ok := m.prices[model]
+		counted.Unpriced = !ok
+		counted.CostUSD = (float64(counted.PromptTokens)*price.Input + float64(counted.CompletionTokens)*price.Output) / 1e6
+
+		usage.PromptTokens += counted.PromptTokens
+		usage.CompletionTokens += counted.CompletionTokens
+		usage.CostUSD += counted.CostUSD
+		usage.Models = append(usage.Models, counted)
+	}
+	return usage
+}
+
+// UsageLedger totals usage across the process for metrics, and the day's
+// spend for the budget. With a file the spend is re-read on every call, so
+// it survives restarts and processes on one host share it.
+type UsageLedger struct {
+	mu     sync.Mutex
+	budget float64
+	file   string
+	// day is the UTC date spend belongs to
+	day    string
+	spend  float64
+	models map[string]*ModelUsage
+}
+
+// usageDay is what the ledger keeps in its file
+type usageDay struct {
+	Day      string  `json:"day"`
+	SpendUSD float64 `json:"spend_usd"`
+}
+
+// UsageStats is the ledger's state, for the health endpoint
+type UsageStats struct {
+	Day       string       `json:"day"`
+	SpendUSD  float64      `json:"spend_usd"`
+	BudgetUSD float64      `json:"budget_usd,omitempty"`
+	Models    []ModelUsage `json:"models"`
+}
+
+var (
+	usageLedgersMu sync.Mutex
+	usageLedgers   = map[string]*UsageLedger{}
+)
+
+// sharedUsageLedger returns the process's ledger for cfg, so every pipeline
+// built in a warm Vercel instance or the local server counts toward the
+// same budget
+func sharedUsageLedger(cfg UsageConfig) *UsageLedger {
+	usageLedgersMu.Lock()
+	defer usageLedgersMu.Unlock()
+
+	key := fmt.Sprintf("%s|%g", cfg.File, cfg.DailyBudget)
+	ledger, ok := usageLedgers[key]
+	if !ok {
+		ledger = &UsageLedger{budget: cfg.DailyBudget, file: cfg.File, models: make(map[string]*ModelUsage)}
+		usageLedgers[key] = ledger
+	}
+	return ledger
+}
+
+// Add counts a tenant's enrichment toward the totals and today's spend. The
+// budget is shared by every tenant.
+func (l *UsageLedger) Add(tenant string, usage *Usage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	for _, counted := range usage.Models {
+		key := tenant + "|" + counted.Model
+		total, ok := l.models[key]
+		if !ok {
+			total = &ModelUsage{Tenant: tenant, Model: counted.Model}
+			l.models[key] = total
+		}
+		total.add(counted)
+	}
+	if usage.CostUSD == 0 {
+		return
+	}
+
+	if l.file == "" {
+		l.load()
+		l.spend += usage.CostUSD
+		return
+	}
+
+	// Other processes add to the same file, so the read and write happen
+	// under a file lock
+	err := withFileLock(l.file, func() error {
+		l.load()
+		l.spend += usage.CostUSD
+		data, err := json.Marshal(usageDay{Day: l.day, SpendUSD: l.spend})
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(l.file, data)
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to save usage file: %v", err)
+	}
+}
+
+// OverBudget reports whether today's spend has reached the daily budget
+func (l *UsageLedger) OverBudget() bool {
+	if l.budget <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.load()
+	return l.spend >= l.budget
+}
+
+// Budget is the daily budget in USD; 0 is none
+func (l *UsageLedger) Budget() float64 {
+	return l.budget
+}
+
+// Stats reports today's spend and the lifetime totals per tenant and model
+func (l *UsageLedger) Stats() UsageStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.load()
+	stats := UsageStats{Day: l.day, SpendUSD: l.spend, BudgetUSD: l.budget, Models: []ModelUsage{}}
+	for _, total := range l.models {
+		stats.Models = append(stats.Models, *total)
+	}
+	sort.Slice(stats.Models, func(i, j int) bool {
+		a, b := stats.Models[i], stats.Models[j]
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.Model < b.Model
+	})
+	return stats
+}
+
+// load brings the spend up to date: from the file when there is one, and
+// back to zero when the UTC day has changed. The caller holds l.mu.
+func (l *UsageLedger) load() {
+	today := time.Now().UTC().Format("2006-01-02")
+
+	if l.file != "" {
+		data, err := os.ReadFile(l.file)
+		var saved usageDay
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			log.Printf("⚠️  Failed to read usage file: %v", err)
+		case json.Unmarshal(data, &saved) != nil:
+			log.Printf("⚠️  Ignoring unreadable usage file %s", l.file)
+		default:
+			l.day, l.spend = saved.Day, saved.SpendUSD
+		}
+	}
+
+	if l.day != today {
+		l.day, l.spend = today, 0
+	}
+}
+
+// WriteMetrics writes the ledger in the Prometheus text format
+func (l *UsageLedger) WriteMetrics(w io.Writer) error {
+	stats := l.Stats()
+	var sb strings.Builder
+
+	metric := func(name, help, kind string) {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind))
+	}
+	sample := func(name, labels string, value float64) {
+		sb.WriteString(fmt.Sprintf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64)))
+	}
+
+	metric("incident_triage_model_calls_total", "Model API calls.", "counter")
+	for _, m := range stats.Models {
+		sample("incident_triage_model_calls_total", modelLabels(m, ""), float64(m.Calls))
+	}
+	metric("incident_triage_model_tokens_total", "Tokens sent to and generated by each model.", "counter")
+	for _, m := range stats.Models {
+		sample("incident_triage_model_tokens_total", modelLabels(m, "prompt"), float64(m.PromptTokens))
+		sample("incident_triage_model_tokens_total", modelLabels(m, "completion"), float64(m.CompletionTokens))
+	}
+	metric("incident_triage_model_cost_usd_total", "What each model's calls cost at the configured prices.", "counter")
+	for _, m := range stats.Models {
+		sample("incident_triage_model_cost_usd_total", modelLabels(m, ""), m.CostUSD)
+	}
+
+	metric("incident_triage_daily_spend_usd", "Model spend so far this UTC day.", "gauge")
+	sample("incident_triage_daily_spend_usd", "", stats.SpendUSD)
+	metric("incident_triage_daily_budget_usd", "Daily model budget; 0 is none.", "gauge")
+	sample("incident_triage_daily_budget_usd", "", stats.BudgetUSD)
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func modelLabels(m ModelUsage, kind string) string {
+	labels := fmt.Sprintf(`tenant="%s",model="%s"`, labelEscaper.Replace(m.Tenant), labelEscaper.Replace(m.Model))
+	if kind != "" {
+		labels += fmt.Sprintf(`,kind="%s"`, kind)
+	}
+	return "{" + labels + "}"
+}
+
+// metered returns a copy of the pipeline whose providers record every call
+// to meter, so concurrent enrichments each count their own, and which logs
+// through logger
+func (r *RAGService) metered(meter *UsageMeter, logger *log.Logger) *RAGService {
+	run := *r
+	run.providers = r.providers.metered(meter, logger)
+	run.logger = logger
+	return &run
+}
+
+// recordUsage attaches what an enrichment's model calls cost to it, and
+// counts that toward the ledger under the incident's tenant
+func (r *RAGService) recordUsage(incident IncidentData, meter *UsageMeter, record *Enrichment) {
+	usage := meter.Usage()
+	r.usage.Add(incident.Tenant, usage)
+	if record != nil {
+		record.Usage = usage
+	}
+	if len(usage.Models) > 0 {
+		TenantLogger(incident.Tenant).Printf("💰 Incident %s used %d prompt and %d completion tokens ($%.4f)", incident.ID, usage.PromptTokens, usage.CompletionTokens, usage.CostUSD)
+	}
+}
+
+// usage is the enrichment's usage, or nil when the enrichment failed before
+// one was built
+func (e *Enrichment) usage() *Usage {
+	if e == nil {
+		return nil
+	}
+	return e.Usage
+}
+
+// Usage returns the ledger of every model call the process has made
+func (r *RAGService) Usage() *UsageLedger {
+	return r.usage
+}
+
+// metered copies the set with each provider bound to meter and logger.
+// Providers passed in RAGOptions, e.g. fakes, are kept as they are.
+func (s *providerSet) metered(meter *UsageMeter, logger *log.Logger) *providerSet {
+	set := &providerSet{
+		embedders:  make(map[string]Embedder, len(s.embedders)),
+		generators: make(map[string]Generator, len(s.generators)),
+		fallbacks:  s.fallbacks,
+	}
+	for name, embedder := range s.embedders {
+		set.embedders[name] = withMeter(embedder, meter, logger).(Embedder)
+	}
+	for name, generator := range s.generators {
+		set.generators[name] = withMeter(generator, meter, logger).(Generator)
+	}
+	return set
+}
+
+// withMeter copies a built-in provider with its calls recorded to meter and
+// its retries logged through logger. The copies share their clients, limiters
+// and caches with the original.
+func withMeter(provider interface{}, meter *UsageMeter, logger *log.Logger) interface{} {
+	switch p := provider.(type) {
+	case *GeminiService:
+		metered := *p
+		metered.meter = meter
+		metered.logger = logger
+		return &metered
+	case *OpenAIService:
+		metered := *p
+		metered.meter = meter
+		return &metered
+	case *OllamaService:
+		metered := *p
+		metered.meter = meter
+		return &metered
+	case *CachingEmbedder:
+		return &CachingEmbedder{Embedder: withMeter(p.Embedder, meter, logger).(Embedder), cache: p.cache}
+	}
+	return provider
+}
@@ -0,0 +1,78 @@
+package services
+
+// PagerDuty v3 webhook payload structures
+type WebhookPayload struct {
+	Event WebhookEvent `json:"event"`
+}
+
+type WebhookEvent struct {
+	ID           string      `json:"id"`
+	EventType    string      `json:"event_type"`
+	ResourceType string      `json:"resource_type"`
+	OccurredAt   string      `json:"occurred_at"`
+	Agent        *Reference  `json:"agent"`
+	Data         WebhookData `json:"data"`
+}
+
+// WebhookData is the "data" object of a webhook event. For most incident events
+// it is the incident itself; for incident.annotated it is the note, with the
+// incident referenced under Incident.
+type WebhookData struct {
+	ID          string      `json:"id"`
+	Type        string      `json:"type"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Service     Reference   `json:"service"`
+	Urgency     string      `json:"urgency"`
+	Status      string      `json:"status"`
+	Priority    *Reference  `json:"priority"`
+	Assignees   []Reference `json:"assignees"`
+
+	Incident *Reference `json:"incident"`
+	Content  string     `json:"content"`
+}
+
+// Reference is PagerDuty's summary form of a linked object (service, user, priority, ...)
+type Reference struct {
+	ID      string `json:"id"`
+	Summary string `json:"summary"`
+}
+
+// ToEvent flattens the webhook payload into the Event the router dispatches on
+func (p WebhookPayload) ToEvent() Event {
+	data := p.Event.Data
+
+	event := Event{
+		ID:         p.Event.ID,
+		Type:       p.Event.EventType,
+		OccurredAt: p.Event.OccurredAt,
+		Incident: IncidentData{
+			ID:          data.ID,
+			Title:       data.Title,
+			Description: data.Description,
+			Service:     data.Service.Summary,
+			Urgency:     data.Urgency,
+		},
+	}
+
+	if p.Event.Agent != nil {
+		event.Agent = p.Event.Agent.Summary
+	}
+	if data.Priority != nil {
+		event.Priority = data.Priority.Summary
+	}
+	for _, assignee := range data.Assignees {
+		event.Assignees = append(event.Assignees, assignee.Summary)
+	}
+
+	// Annotations carry the note as data and only reference the incident
+	if data.Incident != nil {
+		event.Incident = IncidentData{
+			ID:    data.Incident.ID,
+			Title: data.Incident.Summary,
+		}
+		event.Note = data.Content
+	}
+
+	return event
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/stahir80td/incident-management/services"
 )
 
 type TestWebhook struct {
@@ -203,8 +204,19 @@ func main() {
 	fmt.Println(string(jsonData))
 	fmt.Println()
 
-	// Send to webhook URL
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
+	// Send to webhook URL, signed the same way PagerDuty signs deliveries
+	httpReq, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if secrets := services.SplitSecrets(os.Getenv("PAGERDUTY_WEBHOOK_SECRETS")); len(secrets) > 0 {
+		httpReq.Header.Set(services.SignatureHeader, services.SignWebhookBody(jsonData, secrets[0]))
+	} else {
+		log.Println("PAGERDUTY_WEBHOOK_SECRETS not set in .env, sending unsigned webhook (expect 401)")
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		log.Fatalf("Failed to send webhook: %v", err)
 	}